@@ -5,6 +5,7 @@ package auth
 import (
 	"bytes"
 	"crypto/ed25519"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -13,6 +14,7 @@ import (
 
 	"github.com/blang/semver"
 	"github.com/wireleap/common/api/jsonb"
+	"github.com/wireleap/common/api/signer"
 )
 
 const (
@@ -48,13 +50,33 @@ func join(c, f string) string {
 	return strings.Join([]string{Prefix, c, f}, "-")
 }
 
+// MaxBodySize is the maximum size of bodies read by SignedRead.
+var MaxBodySize int64 = 1 << 20
+
+// ErrBodyTooLarge is returned when a body exceeds the size limit.
+var ErrBodyTooLarge = errors.New("body too large")
+
+// SignedRead reads the body *r of at most MaxBodySize bytes and verifies it
+// using the pubkey and signature headers in h of the components cs. *r is
+// replaced with a reader of the same contents.
 func SignedRead(r *io.ReadCloser, h http.Header, cs ...string) ([]byte, error) {
-	body0, err := ioutil.ReadAll(*r)
+	return SignedReadLimit(r, h, MaxBodySize, cs...)
+}
+
+// SignedReadLimit is like SignedRead, but reads at most limit bytes.
+func SignedReadLimit(r *io.ReadCloser, h http.Header, limit int64, cs ...string) ([]byte, error) {
+	// read one byte more to tell a body of exactly limit bytes from a
+	// longer one
+	body0, err := ioutil.ReadAll(io.LimitReader(*r, limit+1))
 
 	if err != nil {
 		return nil, err
 	}
 
+	if int64(len(body0)) > limit {
+		return nil, fmt.Errorf("%w: exceeds %d bytes", ErrBodyTooLarge, limit)
+	}
+
 	for _, c := range cs {
 		var (
 			pks  = []byte(h.Get(join(c, Pubkey)))
@@ -92,6 +114,32 @@ func SignedRead(r *io.ReadCloser, h http.Header, cs ...string) ([]byte, error) {
 	return body, nil
 }
 
+// SignBody signs body using s and sets the pubkey and signature headers of
+// component c in h accordingly.
+func SignBody(h http.Header, c string, s signer.Signer, body []byte) {
+	SetHeader(h, c, Pubkey, jsonb.PK(s.Public()).String())
+	SetHeader(h, c, Signature, jsonb.B(s.Sign(body)).String())
+}
+
+// SignedBy checks whether the pubkey header of component c in h is equal to
+// pk. It does not verify the signature itself, see SignedRead for that.
+func SignedBy(h http.Header, c string, pk ed25519.PublicKey) error {
+	var have jsonb.PK
+
+	if err := (&have).UnmarshalText([]byte(GetHeader(h, c, Pubkey))); err != nil {
+		return fmt.Errorf("could not parse %s pubkey header: %w", c, err)
+	}
+
+	if !bytes.Equal(have, pk) {
+		return fmt.Errorf(
+			"%s pubkey mismatch: expected %s, got %s",
+			c, jsonb.PK(pk), have,
+		)
+	}
+
+	return nil
+}
+
 func SignedReqBody(r *http.Request, cs ...string) ([]byte, error) {
 	return SignedRead(&r.Body, r.Header, cs...)
 }
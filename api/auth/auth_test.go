@@ -7,11 +7,13 @@ import (
 	"crypto/ed25519"
 	"crypto/rand"
 	"encoding/base64"
+	"errors"
 	"io/ioutil"
 	"net/http"
 	"testing"
 
 	"github.com/blang/semver"
+	"github.com/wireleap/common/api/signer"
 )
 
 func TestSignedReqBody(t *testing.T) {
@@ -62,6 +64,29 @@ func TestSignedReqBody(t *testing.T) {
 	}
 }
 
+func TestSignedReadLimit(t *testing.T) {
+	_, sk, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := bytes.Repeat([]byte("x"), 16)
+	h := http.Header{}
+	SignBody(h, Relay, signer.New(sk), body)
+
+	r := ioutil.NopCloser(bytes.NewReader(body))
+
+	if _, err := SignedReadLimit(&r, h, 16, Relay); err != nil {
+		t.Fatal(err)
+	}
+
+	r = ioutil.NopCloser(bytes.NewReader(body))
+
+	if _, err := SignedReadLimit(&r, h, 15, Relay); !errors.Is(err, ErrBodyTooLarge) {
+		t.Fatalf("expected ErrBodyTooLarge, got %v", err)
+	}
+}
+
 func TestVersionCheck(t *testing.T) {
 	r := new(http.Response)
 	r.Header = map[string][]string{
@@ -87,3 +112,35 @@ func TestVersionCheck(t *testing.T) {
 		t.Fatal("Invalid version passed as valid")
 	}
 }
+
+func TestSignBody(t *testing.T) {
+	pk, sk, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := &http.Response{
+		Header: http.Header{},
+		Body:   ioutil.NopCloser(bytes.NewReader([]byte("foo"))),
+	}
+	SignBody(res.Header, Contract, signer.New(sk), []byte("foo"))
+
+	// Should pass
+	if _, err := SignedResBody(res, Contract); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := SignedBy(res.Header, Contract, pk); err != nil {
+		t.Fatal(err)
+	}
+
+	// Should fail
+	pk2, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := SignedBy(res.Header, Contract, pk2); err == nil {
+		t.Fatal("Wrong signer pubkey passed as valid")
+	}
+}
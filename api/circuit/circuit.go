@@ -0,0 +1,292 @@
+// Copyright (c) 2022 Wireleap
+
+// Package circuit provides relay selection for building circuits out of a
+// relay list.
+package circuit
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	mathrand "math/rand"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/blang/semver"
+	"github.com/wireleap/common/api/interfaces/clientrelay"
+	"github.com/wireleap/common/api/interfaces/relayrelay"
+	"github.com/wireleap/common/api/relayentry"
+	"github.com/wireleap/common/api/relaylist"
+)
+
+// T is an ordered list of relays making up a circuit, from the first hop
+// (dialed by the client) to the last hop (dialing the target).
+type T []*relayentry.T
+
+// String returns a human-readable representation of the circuit.
+func (t T) String() string {
+	ss := make([]string, len(t))
+
+	for i, r := range t {
+		ss[i] = r.String()
+	}
+
+	return strings.Join(ss, " -> ")
+}
+
+// DefaultRoles are the relay roles of the hops of a default circuit.
+var DefaultRoles = []string{"fronting", "entropic", "backing"}
+
+// Options describes how relays are selected when building a circuit.
+type Options struct {
+	// Roles are the roles of the circuit hops in order. If empty,
+	// DefaultRoles is used.
+	Roles []string
+	// Pins optionally fixes the relay to use for the hop at the same index,
+	// given either by its public key or address. Empty strings and hops
+	// past the end of Pins are selected randomly.
+	Pins []string
+	// Weight returns the selection weight of a relay. If nil, all relays
+	// have the same weight. Relays with weight <= 0 are never selected
+	// randomly.
+	Weight func(*relayentry.T) float64
+	// DistinctSubnets excludes relays sharing a /16 (IPv4) or /32 (IPv6)
+	// subnet with other hops of the circuit.
+	DistinctSubnets bool
+	// LookupIP is used to resolve relay hostnames when DistinctSubnets is
+	// set. If nil, relays with hostnames are compared by hostname.
+	LookupIP func(host string) ([]net.IP, error)
+	// Operator returns the operator of a relay. Relays with the same
+	// non-empty operator are not used together in a circuit. If nil,
+	// operators are not considered.
+	Operator func(*relayentry.T) string
+	// Rand is the source of randomness for selection. If nil, a source
+	// seeded from crypto/rand is used.
+	Rand *mathrand.Rand
+}
+
+// KeyOperator is an Options.Operator func which uses the user part of the
+// relay enrollment key as the operator, same as relayentry.T.String().
+func KeyOperator(r *relayentry.T) string {
+	if strings.ContainsRune(r.Key, ':') {
+		return strings.SplitN(r.Key, ":", 2)[0]
+	}
+	return ""
+}
+
+// Compatible returns whether r can be used as the hop at index i of a
+// circuit. All hops must implement a compatible client-relay interface
+// version and all hops past the first must also implement a compatible
+// relay-relay interface version. Relays not advertising versions are not
+// compatible.
+func Compatible(r *relayentry.T, i int) bool {
+	if !compatible(r.Versions.ClientRelay, clientrelay.T.Version) {
+		return false
+	}
+
+	if i > 0 && !compatible(r.Versions.RelayRelay, relayrelay.T.Version) {
+		return false
+	}
+
+	return true
+}
+
+// compatible checks have against want the same way auth.VersionCheck does.
+func compatible(have *semver.Version, want semver.Version) bool {
+	return have != nil && have.Major == want.Major && have.Minor == want.Minor
+}
+
+// Build selects relays from rl to build a circuit according to o.
+func Build(rl relaylist.T, o Options) (T, error) {
+	roles := o.Roles
+
+	if len(roles) == 0 {
+		roles = DefaultRoles
+	}
+
+	rnd := o.Rand
+
+	if rnd == nil {
+		var seed [8]byte
+
+		if _, err := rand.Read(seed[:]); err != nil {
+			return nil, fmt.Errorf("could not seed relay selection: %w", err)
+		}
+
+		rnd = mathrand.New(mathrand.NewSource(int64(binary.LittleEndian.Uint64(seed[:]))))
+	}
+
+	var (
+		c  = make(T, len(roles))
+		ex = &exclusions{o: o, used: map[*relayentry.T]bool{}, nets: map[string]bool{}, ops: map[string]bool{}}
+		rs = rl.All()
+	)
+
+	// map order is random, sort so selection only depends on rnd
+	sort.Slice(rs, func(i, j int) bool { return rs[i].String() < rs[j].String() })
+
+	// pinned hops go first so random hops can avoid them
+	for i, role := range roles {
+		if i >= len(o.Pins) || o.Pins[i] == "" {
+			continue
+		}
+
+		r := find(rs, o.Pins[i])
+
+		switch {
+		case r == nil:
+			return nil, fmt.Errorf("pinned relay %s for hop %d not found", o.Pins[i], i)
+		case r.Role != role:
+			return nil, fmt.Errorf("pinned relay %s for hop %d has role %s, expected %s", o.Pins[i], i, r.Role, role)
+		case !Compatible(r, i):
+			return nil, fmt.Errorf("pinned relay %s for hop %d has incompatible versions", o.Pins[i], i)
+		}
+
+		c[i] = r
+		ex.add(r)
+	}
+
+	for i, role := range roles {
+		if c[i] != nil {
+			continue
+		}
+
+		var (
+			cands []*relayentry.T
+			ws    []float64
+			total float64
+		)
+
+		for _, r := range rs {
+			if r == nil || r.Role != role || !Compatible(r, i) || ex.excludes(r) {
+				continue
+			}
+
+			w := 1.0
+
+			if o.Weight != nil {
+				w = o.Weight(r)
+			}
+
+			if w <= 0 {
+				continue
+			}
+
+			cands = append(cands, r)
+			ws = append(ws, w)
+			total += w
+		}
+
+		if len(cands) == 0 {
+			return nil, fmt.Errorf("no suitable %s relay found for hop %d", role, i)
+		}
+
+		x := rnd.Float64() * total
+		r := cands[len(cands)-1]
+
+		for j, w := range ws {
+			if x < w {
+				r = cands[j]
+				break
+			}
+
+			x -= w
+		}
+
+		c[i] = r
+		ex.add(r)
+	}
+
+	return c, nil
+}
+
+// find returns the relay from rs with the public key or address s.
+func find(rs []*relayentry.T, s string) *relayentry.T {
+	for _, r := range rs {
+		if r != nil && (r.Pubkey.String() == s || (r.Addr != nil && r.Addr.String() == s)) {
+			return r
+		}
+	}
+
+	return nil
+}
+
+// exclusions keeps track of relays, subnets and operators already used in a
+// circuit.
+type exclusions struct {
+	o    Options
+	used map[*relayentry.T]bool
+	nets map[string]bool
+	ops  map[string]bool
+}
+
+func (e *exclusions) add(r *relayentry.T) {
+	e.used[r] = true
+
+	if e.o.DistinctSubnets {
+		for _, n := range e.subnets(r) {
+			e.nets[n] = true
+		}
+	}
+
+	if e.o.Operator != nil {
+		if op := e.o.Operator(r); op != "" {
+			e.ops[op] = true
+		}
+	}
+}
+
+func (e *exclusions) excludes(r *relayentry.T) bool {
+	if e.used[r] {
+		return true
+	}
+
+	if e.o.DistinctSubnets {
+		for _, n := range e.subnets(r) {
+			if e.nets[n] {
+				return true
+			}
+		}
+	}
+
+	if e.o.Operator != nil {
+		if op := e.o.Operator(r); op != "" && e.ops[op] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// subnets returns the keys of the subnets the relay r is in.
+func (e *exclusions) subnets(r *relayentry.T) (ns []string) {
+	if r.Addr == nil {
+		return
+	}
+
+	host := r.Addr.Hostname()
+	ips := []net.IP{}
+
+	if ip := net.ParseIP(host); ip != nil {
+		ips = append(ips, ip)
+	} else if e.o.LookupIP != nil {
+		if rips, err := e.o.LookupIP(host); err == nil {
+			ips = rips
+		}
+	}
+
+	if len(ips) == 0 {
+		return []string{"host:" + host}
+	}
+
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			ns = append(ns, ip4.Mask(net.CIDRMask(16, 32)).String()+"/16")
+		} else {
+			ns = append(ns, ip.Mask(net.CIDRMask(32, 128)).String()+"/32")
+		}
+	}
+
+	return
+}
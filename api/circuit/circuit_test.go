@@ -0,0 +1,106 @@
+// Copyright (c) 2022 Wireleap
+
+package circuit
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/wireleap/common/api/interfaces/clientrelay"
+	"github.com/wireleap/common/api/interfaces/relayrelay"
+	"github.com/wireleap/common/api/relayentry"
+	"github.com/wireleap/common/api/relaylist"
+	"github.com/wireleap/common/api/texturl"
+)
+
+func entry(role, addr, key string) *relayentry.T {
+	return &relayentry.T{
+		Role: role,
+		Addr: texturl.URLMustParse(addr),
+		Key:  key,
+		Versions: relayentry.Versions{
+			ClientRelay: &clientrelay.T.Version,
+			RelayRelay:  &relayrelay.T.Version,
+		},
+	}
+}
+
+func list(rs ...*relayentry.T) relaylist.T {
+	rl := relaylist.T{}
+	for _, r := range rs {
+		rl[r.Addr.String()] = r
+	}
+	return rl
+}
+
+func TestBuild(t *testing.T) {
+	rl := list(
+		entry("fronting", "wireleap://10.0.0.1:443", "alice:x"),
+		entry("entropic", "wireleap://10.0.0.2:443", "bob:x"),
+		entry("entropic", "wireleap://10.1.0.2:443", "carol:x"),
+		entry("backing", "wireleap://10.0.0.3:443", "dave:x"),
+		entry("backing", "wireleap://10.2.0.3:443", "alice:x"),
+		entry("backing", "wireleap://10.3.0.3:443", "erin:x"),
+	)
+	o := Options{Rand: rand.New(rand.NewSource(1))}
+
+	c, err := Build(rl, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, r := range c {
+		if r.Role != DefaultRoles[i] {
+			t.Fatalf("hop %d has role %s, expected %s", i, r.Role, DefaultRoles[i])
+		}
+	}
+
+	// exclusions
+	o.DistinctSubnets = true
+	o.Operator = KeyOperator
+	for i := 0; i < 32; i++ {
+		c, err = Build(rl, o)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c[1].Addr.Hostname() != "10.1.0.2" || c[2].Addr.Hostname() != "10.3.0.3" {
+			t.Fatalf("exclusions not respected: %s", c)
+		}
+	}
+
+	// pins
+	o.Pins = []string{"", "", "wireleap://10.2.0.3:443"}
+	if _, err = Build(rl, o); err == nil {
+		t.Fatal("circuit with same operator twice built")
+	}
+	o.Operator = nil
+	o.DistinctSubnets = false
+	if c, err = Build(rl, o); err != nil {
+		t.Fatal(err)
+	}
+	if c[2].Addr.Hostname() != "10.2.0.3" {
+		t.Fatalf("pin not respected: %s", c)
+	}
+
+	// weights
+	o.Pins = nil
+	o.Weight = func(r *relayentry.T) float64 {
+		if r.Addr.Hostname() == "10.0.0.2" {
+			return 0
+		}
+		return 1
+	}
+	for i := 0; i < 32; i++ {
+		if c, err = Build(rl, o); err != nil {
+			t.Fatal(err)
+		}
+		if c[1].Addr.Hostname() != "10.1.0.2" {
+			t.Fatalf("zero weight relay selected: %s", c)
+		}
+	}
+
+	// versions
+	rl["wireleap://10.1.0.2:443"].Versions.RelayRelay = nil
+	if _, err = Build(rl, o); err == nil {
+		t.Fatal("circuit with incompatible relay built")
+	}
+}
@@ -10,7 +10,6 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"net/http/httptest"
 	"time"
@@ -20,6 +19,8 @@ import (
 	"github.com/wireleap/common/api/nonce"
 	"github.com/wireleap/common/api/signer"
 	"github.com/wireleap/common/api/status"
+	"github.com/wireleap/common/logger"
+	"github.com/wireleap/common/metrics"
 )
 
 // Client is an API client type. It exposes the http.Client interface and it is
@@ -30,10 +31,20 @@ type Client struct {
 	signer.Signer
 	is       []interfaces.T
 	RetryOpt RetryOptions
+	// Logger is the logger used by the client. If nil, logger.Default is
+	// used.
+	Logger logger.Logger
 
 	do func(*http.Request) (*http.Response, error)
 }
 
+// retries counts the retried requests by HTTP method.
+var retries = metrics.Default.Counter(
+	"wireleap_client_retries_total",
+	"Total number of retried API requests by HTTP method.",
+	"method",
+)
+
 type RetryOptions struct {
 	Tries    int
 	Interval time.Duration
@@ -166,16 +177,42 @@ func (c *Client) Perform(method string, url string, in interface{}, out interfac
 	if err != nil {
 		return
 	}
+	_, err = c.PerformRequest(req, out, cs...)
+	return
+}
+
+// PerformRequest performs the prepared request req and parses the JSON
+// response into out with the retry logic of Perform. The last response is
+// returned with its body closed so its headers can be inspected. A 304 Not
+// Modified response to a conditional request (one with an If-None-Match or
+// If-Modified-Since header) is returned without parsing; it is an error for
+// any other request.
+func (c *Client) PerformRequest(req *http.Request, out interface{}, cs ...string) (res *http.Response, err error) {
+	conditional := req.Header.Get("If-None-Match") != "" || req.Header.Get("If-Modified-Since") != ""
+
 	for i := 1; i <= c.RetryOpt.Tries; i++ {
-		err = c.PerformRequestOnce(req, out, cs...)
+		res, err = c.PerformRequestNoParse(req, cs...)
+		if err != nil {
+			err = fmt.Errorf("error from PerformRequestNoParse: %w", err)
+		} else if res.StatusCode == http.StatusNotModified {
+			res.Body.Close()
+			if !conditional {
+				err = fmt.Errorf("got 304 Not Modified response to unconditional request %s %s", req.Method, req.URL)
+			}
+			return
+		} else {
+			err = c.ParseResponse(res, out, cs...)
+		}
 		if err == nil || i == c.RetryOpt.Tries || !status.IsRetryable(err) {
 			// success or max retries hit or no-retry error; return nil or last error
 			break
 		}
+		retries.Inc(req.Method)
 		if c.RetryOpt.Verbose {
-			log.Printf(
-				"client: error performing %s %s: %s on try %d of %d, retrying in %s...",
-				method, url, err, i, c.RetryOpt.Tries, c.RetryOpt.Interval,
+			logger.OrDefault(c.Logger).Warn(
+				"client: error performing request, retrying",
+				"method", req.Method, "url", req.URL.String(), "error", err,
+				"try", i, "tries", c.RetryOpt.Tries, "interval", c.RetryOpt.Interval,
 			)
 		}
 		time.Sleep(c.RetryOpt.Interval)
@@ -187,12 +224,16 @@ func (c *Client) Perform(method string, url string, in interface{}, out interfac
 // ParseResponse extracts the JSON-encoded payload of a request response and
 // checks for API errors. It is not a method of the Client type since it uses
 // no Client-specific data. Therefore, while low-level, it can be called by
-// code which does not use Client if needed.
+// code which does not use Client if needed. Signatures of components cs are
+// only verified on successful responses since error responses are unsigned,
+// so API errors are returned as such but are not authenticated.
 func (c *Client) ParseResponse(res *http.Response, dst interface{}, cs ...string) (err error) {
 	defer res.Body.Close()
 	var body []byte
 
-	if len(cs) > 0 {
+	ok := res.StatusCode >= 200 && res.StatusCode < 300
+
+	if len(cs) > 0 && ok {
 		body, err = auth.SignedResBody(res, cs...)
 	} else {
 		body, err = ioutil.ReadAll(res.Body)
@@ -221,7 +262,7 @@ func (c *Client) ParseResponse(res *http.Response, dst interface{}, cs ...string
 	}
 
 	// check for API error
-	if res.StatusCode < 200 || res.StatusCode >= 300 {
+	if !ok {
 		e := &status.T{}
 		err = json.Unmarshal(body, e)
 
@@ -0,0 +1,211 @@
+// Copyright (c) 2022 Wireleap
+
+package consume
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wireleap/common/api/auth"
+	"github.com/wireleap/common/api/client"
+	"github.com/wireleap/common/api/contractinfo"
+	"github.com/wireleap/common/api/dirinfo"
+	"github.com/wireleap/common/api/jsonb"
+	"github.com/wireleap/common/api/relaylist"
+	"github.com/wireleap/common/api/texturl"
+)
+
+// Cache is a cache of verified contract info, directory info and relay list
+// documents. Expired entries are revalidated using the ETag of the cached
+// document so that unchanged documents are not transferred again. The public
+// key which signed a contract info document is remembered and a later
+// document for the same contract signed by a different key is refused. The
+// first fetch of a contract info document is only authenticated if its key
+// has been pinned using Pin; otherwise, the first key seen is trusted.
+type Cache struct {
+	// DefaultMaxAge is the time to cache documents for if the server does
+	// not specify a Cache-Control max-age.
+	DefaultMaxAge time.Duration
+
+	cl *client.Client
+	mu sync.Mutex
+	m  map[string]*entry
+}
+
+// entry is a single cached document.
+type entry struct {
+	v       interface{}
+	pk      ed25519.PublicKey
+	etag    string
+	expires time.Time
+}
+
+// NewCache creates a new Cache which uses cl to perform requests.
+func NewCache(cl *client.Client) *Cache {
+	return &Cache{cl: cl, m: map[string]*entry{}, DefaultMaxAge: 0}
+}
+
+// Pin requires the contract info document of sc to be signed by pk.
+func (c *Cache) Pin(sc *texturl.URL, pk ed25519.PublicKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.m[sc.String()+"/info"] = &entry{pk: pk}
+}
+
+// Purge removes all cached documents while keeping pinned public keys.
+func (c *Cache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, e := range c.m {
+		c.m[k] = &entry{pk: e.pk}
+	}
+}
+
+// ContractInfo returns the info document of the contract sc.
+func (c *Cache) ContractInfo(sc *texturl.URL) (*contractinfo.T, error) {
+	v, err := c.get(sc.String()+"/info", auth.Contract,
+		func() interface{} { return &contractinfo.T{} },
+		func(v interface{}) ed25519.PublicKey { return v.(*contractinfo.T).Pubkey.T() },
+		true,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("could not get contract info from %s/info: %w", sc, err)
+	}
+	return v.(*contractinfo.T), nil
+}
+
+// DirectoryInfo returns the info document of the directory of the contract
+// sc.
+func (c *Cache) DirectoryInfo(sc *texturl.URL) (dinfo *dirinfo.T, err error) {
+	info, err := c.ContractInfo(sc)
+	if err != nil {
+		return
+	}
+	ddata := &info.Directory
+	dinfourl := ddata.Endpoint.String() + "/info"
+	v, err := c.get(dinfourl, auth.Directory,
+		func() interface{} { return &dirinfo.T{} },
+		func(interface{}) ed25519.PublicKey { return ddata.PublicKey.T() },
+		false,
+	)
+	if err == nil {
+		dinfo = v.(*dirinfo.T)
+		err = matchDirectoryPubkey(ddata, dinfo)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not get directory info from %s: %w", dinfourl, err)
+	}
+	return
+}
+
+// ContractRelays returns the relay list of the directory of the contract sc.
+func (c *Cache) ContractRelays(sc *texturl.URL) (rl relaylist.T, err error) {
+	info, err := c.ContractInfo(sc)
+	if err != nil {
+		return
+	}
+	dinfo, err := c.DirectoryInfo(sc)
+	if err != nil {
+		return
+	}
+	dirurl := dinfo.Endpoint.String() + "/relays"
+	v, err := c.get(dirurl, auth.Directory,
+		func() interface{} { return &relaylist.T{} },
+		func(interface{}) ed25519.PublicKey { return info.Directory.PublicKey.T() },
+		false,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("could not perform request towards %s: %w", dirurl, err)
+	}
+	return *v.(*relaylist.T), nil
+}
+
+// get returns the cached document under url, fetching or revalidating it if
+// needed. New documents are created with newf and must be signed by the key
+// returned by pkf for component comp. If pin is true, the signing key is
+// remembered and must not change between fetches.
+func (c *Cache) get(url, comp string, newf func() interface{}, pkf func(interface{}) ed25519.PublicKey, pin bool) (interface{}, error) {
+	c.mu.Lock()
+	e := c.m[url]
+	c.mu.Unlock()
+
+	now := time.Now()
+
+	if e != nil && e.v != nil && now.Before(e.expires) {
+		return e.v, nil
+	}
+
+	h := http.Header{}
+
+	if e != nil && e.etag != "" {
+		h.Set("If-None-Match", e.etag)
+	}
+
+	v := newf()
+	res, err := get(c.cl, url, h, v, comp)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode == http.StatusNotModified {
+		if e == nil || e.v == nil {
+			return nil, fmt.Errorf("got 304 Not Modified for a document which is not cached")
+		}
+
+		c.mu.Lock()
+		e.expires = now.Add(c.maxAge(res.Header))
+		c.mu.Unlock()
+		return e.v, nil
+	}
+
+	pk := pkf(v)
+
+	if err = auth.SignedBy(res.Header, comp, pk); err != nil {
+		return nil, err
+	}
+
+	if e != nil && e.pk != nil && !bytes.Equal(e.pk, pk) {
+		return nil, fmt.Errorf(
+			"document is signed by %s, expected %s",
+			jsonb.PK(pk), jsonb.PK(e.pk),
+		)
+	}
+
+	if !pin {
+		pk = nil
+	}
+
+	c.mu.Lock()
+	c.m[url] = &entry{
+		v:       v,
+		pk:      pk,
+		etag:    res.Header.Get("ETag"),
+		expires: now.Add(c.maxAge(res.Header)),
+	}
+	c.mu.Unlock()
+	return v, nil
+}
+
+// maxAge returns the caching duration from the Cache-Control header in h.
+func (c *Cache) maxAge(h http.Header) time.Duration {
+	for _, d := range strings.Split(h.Get("Cache-Control"), ",") {
+		d = strings.TrimSpace(d)
+
+		switch {
+		case d == "no-cache", d == "no-store":
+			return 0
+		case strings.HasPrefix(d, "max-age="):
+			if n, err := strconv.ParseInt(d[len("max-age="):], 10, 64); err == nil && n >= 0 {
+				return time.Duration(n) * time.Second
+			}
+		}
+	}
+	return c.DefaultMaxAge
+}
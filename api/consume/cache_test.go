@@ -0,0 +1,199 @@
+// Copyright (c) 2022 Wireleap
+
+package consume
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/wireleap/common/api/auth"
+	"github.com/wireleap/common/api/client"
+	"github.com/wireleap/common/api/contractinfo"
+	"github.com/wireleap/common/api/dirinfo"
+	"github.com/wireleap/common/api/jsonb"
+	"github.com/wireleap/common/api/provide"
+	"github.com/wireleap/common/api/relayentry"
+	"github.com/wireleap/common/api/relaylist"
+	"github.com/wireleap/common/api/signer"
+	"github.com/wireleap/common/api/status"
+	"github.com/wireleap/common/api/texturl"
+)
+
+func jsonHandler(x interface{}) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(x)
+	})
+}
+
+func TestCache(t *testing.T) {
+	_, csk, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dpk, dsk, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		cs = signer.New(csk)
+		ds = signer.New(dsk)
+
+		sc   = texturl.URLMustParse("https://contract.test")
+		info = &contractinfo.T{
+			Pubkey: jsonb.PK(cs.Public()),
+			Directory: contractinfo.Directory{
+				Endpoint:  texturl.URLMustParse("https://dir.test"),
+				PublicKey: jsonb.PK(dpk),
+			},
+		}
+		dinfo = &dirinfo.T{
+			PublicKey: jsonb.PK(dpk),
+			Endpoint:  texturl.URLMustParse("https://dir.test"),
+		}
+		rl = relaylist.T{
+			"wireleap://relay.test:443": &relayentry.T{
+				Role: "backing",
+				Addr: texturl.URLMustParse("wireleap://relay.test:443"),
+			},
+		}
+
+		hits        = map[string]int{}
+		tamper      = false
+		notModified = false
+		cmux        = http.NewServeMux()
+		dmux        = http.NewServeMux()
+		cacheFor    = time.Hour
+	)
+
+	cmux.Handle("/info", provide.CacheGate(provide.SignGate(jsonHandler(info), cs, auth.Contract), cacheFor))
+	dmux.Handle("/info", provide.CacheGate(provide.SignGate(jsonHandler(dinfo), ds, auth.Directory), cacheFor))
+	dmux.Handle("/relays", provide.CacheGate(provide.SignGate(jsonHandler(rl), ds, auth.Directory), cacheFor))
+
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits[r.Host+r.URL.Path]++
+		if notModified && r.URL.Path == "/relays" {
+			// emulate a MITM answering with an empty unsigned response
+			auth.SetHeader(w.Header(), auth.Directory, auth.Pubkey, jsonb.PK(dpk).String())
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		if tamper {
+			// emulate a MITM replacing the signer of the document
+			_, msk, _ := ed25519.GenerateKey(nil)
+			provide.SignGate(jsonHandler(info), signer.New(msk), auth.Contract).ServeHTTP(w, r)
+			return
+		}
+		switch r.Host {
+		case "contract.test":
+			cmux.ServeHTTP(w, r)
+		case "dir.test":
+			dmux.ServeHTTP(w, r)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+
+	cl := client.NewMock(nil, h)
+	cl.RetryOpt.Tries = 1
+
+	// uncached functions
+	if _, err = ContractInfo(cl, sc); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = DirectoryInfo(cl, sc); err != nil {
+		t.Fatal(err)
+	}
+	rl0, err := ContractRelays(cl, sc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rl0) != 1 {
+		t.Fatalf("expected 1 relay, got %d", len(rl0))
+	}
+
+	// forged 304 to an unconditional request
+	notModified = true
+	if rl0, err = ContractRelays(cl, sc); err == nil || rl0 != nil {
+		t.Fatalf("forged 304 passed as valid relay list: %v, %v", rl0, err)
+	}
+	notModified = false
+	hits["dir.test/relays"]--
+
+	// cached
+	c := NewCache(cl)
+	for i := 0; i < 3; i++ {
+		if _, err = c.ContractRelays(sc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := hits["dir.test/relays"]; n != 2 {
+		t.Fatalf("expected 2 relay list fetches, got %d", n)
+	}
+
+	// revalidation
+	c.mu.Lock()
+	for _, e := range c.m {
+		e.expires = time.Time{}
+	}
+	c.mu.Unlock()
+	if _, err = c.ContractRelays(sc); err != nil {
+		t.Fatal(err)
+	}
+	if n := hits["dir.test/relays"]; n != 3 {
+		t.Fatalf("expected 3 relay list fetches, got %d", n)
+	}
+
+	// tampering
+	c.Purge()
+	tamper = true
+	if _, err = c.ContractInfo(sc); err == nil {
+		t.Fatal("tampered contract info passed as valid")
+	}
+	if _, err = ContractInfo(cl, sc); err == nil {
+		t.Fatal("tampered contract info passed as valid")
+	}
+}
+
+func TestContractInfoErrors(t *testing.T) {
+	_, csk, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs := signer.New(csk)
+	info := &contractinfo.T{Pubkey: jsonb.PK(cs.Public())}
+
+	var (
+		hits int
+		errs []*status.T
+	)
+	h := provide.SignGate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		if len(errs) > 0 {
+			errs[0].WriteTo(w)
+			errs = errs[1:]
+			return
+		}
+		jsonHandler(info).ServeHTTP(w, r)
+	}), cs, auth.Contract)
+	cl := client.NewMock(nil, h)
+	cl.RetryOpt.Interval = 0
+	sc := texturl.URLMustParse("https://contract.test")
+
+	// unsigned error responses are parsed and retried if retryable
+	errs = []*status.T{status.ErrInternal, status.ErrGateway}
+	if _, err = ContractInfo(cl, sc); err != nil || hits != 3 {
+		t.Fatalf("expected success on third try, got %v after %d tries", err, hits)
+	}
+
+	hits = 0
+	errs = []*status.T{status.ErrNotFound}
+	if _, err = ContractInfo(cl, sc); !errors.Is(err, status.ErrNotFound) || hits != 1 {
+		t.Fatalf("expected not found without retries, got %v after %d tries", err, hits)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"crypto/ed25519"
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/wireleap/common/api/auth"
 	"github.com/wireleap/common/api/client"
@@ -15,10 +16,19 @@ import (
 	"github.com/wireleap/common/api/texturl"
 )
 
+// ContractInfo fetches the info document of the contract sc and verifies that
+// it is signed by the contract public key it contains. As that key comes from
+// the document itself, this only proves the document is intact, not that it
+// is from the contract: the fetch is unauthenticated unless the key is
+// checked against a known one, as Cache does for pinned contracts.
 func ContractInfo(cl *client.Client, sc *texturl.URL) (info *contractinfo.T, err error) {
 	infourl := sc.String() + "/info"
-	if err = cl.Perform(http.MethodGet, infourl, nil, &info); err != nil {
-		err = fmt.Errorf("could not get contract info from %s: %s", infourl, err)
+	res, err := get(cl, infourl, nil, &info, auth.Contract)
+	if err == nil {
+		err = verifyContractInfo(res.Header, info)
+	}
+	if err != nil {
+		err = fmt.Errorf("could not get contract info from %s: %w", infourl, err)
 	}
 	return
 }
@@ -45,11 +55,23 @@ func DirectoryInfo(cl *client.Client, sc *texturl.URL) (dinfo dirinfo.T, err err
 	if err != nil {
 		return
 	}
+	err = directoryInfo(cl, ddata, &dinfo)
+	return
+}
+
+// directoryInfo fetches the info document of the directory described by ddata
+// into dinfo and verifies that it is signed by the directory public key from
+// ddata.
+func directoryInfo(cl *client.Client, ddata *contractinfo.Directory, dinfo *dirinfo.T) error {
 	dinfourl := ddata.Endpoint.String() + "/info"
-	if err = cl.Perform(http.MethodGet, dinfourl, nil, &dinfo); err != nil {
-		err = fmt.Errorf("could not get directory info from %s: %s", dinfourl, err)
+	res, err := get(cl, dinfourl, nil, dinfo, auth.Directory)
+	if err == nil {
+		err = verifyDirectoryInfo(res.Header, ddata, dinfo)
 	}
-	return
+	if err != nil {
+		return fmt.Errorf("could not get directory info from %s: %w", dinfourl, err)
+	}
+	return nil
 }
 
 // returns relays of this sc's directory
@@ -58,19 +80,90 @@ func ContractRelays(cl *client.Client, sc *texturl.URL) (rl relaylist.T, err err
 	if err != nil {
 		return
 	}
-	dinfo, err := DirectoryInfo(cl, sc)
+	dinfo := &dirinfo.T{}
+	if err = directoryInfo(cl, ddata, dinfo); err != nil {
+		return
+	}
+	dirurl := dinfo.Endpoint.String() + "/relays"
+	res, err := get(cl, dirurl, nil, &rl, auth.Directory)
+	if err == nil && res.StatusCode == http.StatusNotModified {
+		err = fmt.Errorf("got 304 Not Modified for an unconditional request")
+	}
+	if err == nil {
+		err = auth.SignedBy(res.Header, auth.Directory, ddata.PublicKey.T())
+	}
+	if err != nil {
+		err = fmt.Errorf("could not perform request towards %s: %w", dirurl, err)
+	}
+	return
+}
+
+// ContractRelaySnapshot fetches the signed relay list snapshot of this sc's
+// directory and verifies it. Snapshots older than maxage or which cannot
+// replace the previously accepted snapshot prev (if not nil) are refused.
+func ContractRelaySnapshot(cl *client.Client, sc *texturl.URL, prev *relaylist.Snapshot, maxage time.Duration) (snap *relaylist.Snapshot, err error) {
+	ddata, err := DirectoryData(cl, sc)
 	if err != nil {
 		return
 	}
+	dinfo := &dirinfo.T{}
+	if err = directoryInfo(cl, ddata, dinfo); err != nil {
+		return
+	}
+	snapurl := dinfo.Endpoint.String() + "/relays/snapshot"
+	if _, err = get(cl, snapurl, nil, &snap); err == nil {
+		if snap == nil {
+			err = fmt.Errorf("relay list snapshot is null")
+		} else {
+			err = prev.Accept(snap, ddata.PublicKey.T(), time.Now().Unix(), maxage)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not get relay list snapshot from %s: %w", snapurl, err)
+	}
+	return
+}
+
+// verifyContractInfo checks that info is signed by its own public key.
+func verifyContractInfo(h http.Header, info *contractinfo.T) error {
+	if info == nil {
+		return fmt.Errorf("contract info is null")
+	}
+	return auth.SignedBy(h, auth.Contract, info.Pubkey.T())
+}
+
+// verifyDirectoryInfo checks that dinfo is signed by the directory public key
+// listed in ddata and that it advertises the same public key.
+func verifyDirectoryInfo(h http.Header, ddata *contractinfo.Directory, dinfo *dirinfo.T) error {
+	if err := matchDirectoryPubkey(ddata, dinfo); err != nil {
+		return err
+	}
+	return auth.SignedBy(h, auth.Directory, ddata.PublicKey.T())
+}
+
+// matchDirectoryPubkey checks that dinfo advertises the directory public key
+// listed in ddata.
+func matchDirectoryPubkey(ddata *contractinfo.Directory, dinfo *dirinfo.T) error {
 	if dinfo.PublicKey.String() != ddata.PublicKey.String() {
-		return nil, fmt.Errorf(
+		return fmt.Errorf(
 			"directory public key does not match: contract says %s, directory says %s",
 			ddata.PublicKey.String(), dinfo.PublicKey.String(),
 		)
 	}
-	dirurl := dinfo.Endpoint.String() + "/relays"
-	if err = cl.Perform(http.MethodGet, dirurl, nil, &rl, auth.Directory); err != nil {
-		err = fmt.Errorf("could not perform request towards %s: %w", dirurl, err)
+	return nil
+}
+
+// get performs a GET request towards url with the extra headers h and parses
+// the response into out, verifying the signatures of components cs. Retries
+// are done as in client.Perform. A 304 Not Modified response is returned
+// as-is without parsing if h makes the request conditional.
+func get(cl *client.Client, url string, h http.Header, out interface{}, cs ...string) (*http.Response, error) {
+	req, err := cl.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
 	}
-	return
+	for k, vs := range h {
+		req.Header[k] = vs
+	}
+	return cl.PerformRequest(req, out, cs...)
 }
@@ -2,6 +2,8 @@
 
 package api
 
+//go:generate go run ../contrib/openapi -o openapi
+
 /*
 Package api provides helper types, values and functions for implementing the
 Wireleap API. It contains code which is used by the Wireleap suite of
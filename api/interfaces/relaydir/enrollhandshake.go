@@ -6,24 +6,25 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"strconv"
-	"strings"
 
 	"github.com/wireleap/common/api/auth"
 	"github.com/wireleap/common/api/client"
+	"github.com/wireleap/common/api/pow"
 	"github.com/wireleap/common/api/status"
-	"golang.org/x/crypto/bcrypt"
 )
 
 // EnrollHandshake performs the first enrollment request given a client and the
 // prepared request itself. It completes the challenge-response PoW handshake
-// which is required for new enrollments.
+// which is required for new enrollments, offering all algorithms registered
+// in package pow.
 func EnrollHandshake(cl *client.Client, req *http.Request) (st *status.T, err error) {
 	var (
 		res *http.Response
 		jm  json.RawMessage
 	)
 
+	auth.SetHeader(req.Header, auth.Directory, auth.Challenge, pow.Offer(pow.Names()...))
+	auth.DelHeader(req.Header, auth.Directory, auth.Response)
 	res, err = cl.PerformRequestNoParse(req)
 
 	if err != nil {
@@ -72,8 +73,7 @@ func EnrollHandshake(cl *client.Client, req *http.Request) (st *status.T, err er
 
 	if st.Is(status.ErrChallenge) {
 		var (
-			cost int
-			hash []byte
+			resp string
 
 			challenge = auth.GetHeader(res.Header, auth.Directory, auth.Challenge)
 		)
@@ -86,11 +86,11 @@ func EnrollHandshake(cl *client.Client, req *http.Request) (st *status.T, err er
 			return
 		}
 
-		cost, err = strconv.Atoi(strings.SplitN(challenge, "~", 2)[0])
+		resp, err = pow.Solve(challenge)
 
 		if err != nil {
 			err = fmt.Errorf(
-				"could not parse pre-enrollment challenge '%s' from directory %s: %w, body='%s'",
+				"could not solve pre-enrollment challenge '%s' from directory %s: %w, body='%s'",
 				challenge,
 				req.URL,
 				err,
@@ -99,20 +99,8 @@ func EnrollHandshake(cl *client.Client, req *http.Request) (st *status.T, err er
 			return
 		}
 
-		hash, err = bcrypt.GenerateFromPassword([]byte(challenge), cost)
-
-		if err != nil {
-			err = fmt.Errorf(
-				"could not hash challenge from directory %s: %w, body='%s'",
-				req.URL,
-				err,
-				string(jm),
-			)
-			return
-		}
-
 		auth.SetHeader(req.Header, auth.Directory, auth.Challenge, challenge)
-		auth.SetHeader(req.Header, auth.Directory, auth.Response, string(hash))
+		auth.SetHeader(req.Header, auth.Directory, auth.Response, resp)
 
 		jm = nil // erase old body
 		err = cl.PerformRequestOnce(req, &jm)
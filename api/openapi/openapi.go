@@ -0,0 +1,400 @@
+// Copyright (c) 2022 Wireleap
+
+// Package openapi generates OpenAPI 3 documents describing the Wireleap API
+// from the Go types of its messages and the routes serving them.
+package openapi
+
+import (
+	"encoding"
+	"encoding/json"
+	"math/big"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/blang/semver"
+	"github.com/wireleap/common/api/auth"
+	"github.com/wireleap/common/api/duration"
+	"github.com/wireleap/common/api/jsonb"
+	"github.com/wireleap/common/api/provide"
+	"github.com/wireleap/common/api/status"
+	"github.com/wireleap/common/api/texturl"
+)
+
+// Version is the OpenAPI version of generated documents.
+const Version = "3.0.3"
+
+// Document is an OpenAPI document.
+type Document struct {
+	OpenAPI    string               `json:"openapi"`
+	Info       Info                 `json:"info"`
+	Paths      map[string]*PathItem `json:"paths"`
+	Components Components           `json:"components"`
+}
+
+// Info is the metadata of a Document.
+type Info struct {
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	Version     string `json:"version"`
+}
+
+// PathItem maps lowercase HTTP methods to the operations of a path.
+type PathItem map[string]*Operation
+
+// Operation is a single API operation.
+type Operation struct {
+	Summary     string               `json:"summary,omitempty"`
+	OperationID string               `json:"operationId,omitempty"`
+	Parameters  []*Parameter         `json:"parameters,omitempty"`
+	RequestBody *RequestBody         `json:"requestBody,omitempty"`
+	Responses   map[string]*Response `json:"responses"`
+}
+
+// Parameter is a path, query or header parameter of an Operation.
+type Parameter struct {
+	Name     string  `json:"name"`
+	In       string  `json:"in"`
+	Required bool    `json:"required,omitempty"`
+	Schema   *Schema `json:"schema"`
+}
+
+// RequestBody is the request body of an Operation.
+type RequestBody struct {
+	Required bool                  `json:"required,omitempty"`
+	Content  map[string]*MediaType `json:"content"`
+}
+
+// Response is a response of an Operation.
+type Response struct {
+	Description string                `json:"description"`
+	Content     map[string]*MediaType `json:"content,omitempty"`
+}
+
+// MediaType is the schema of a body with a given media type.
+type MediaType struct {
+	Schema *Schema `json:"schema"`
+}
+
+// Components holds the named schemas referenced in a Document.
+type Components struct {
+	Schemas map[string]*Schema `json:"schemas,omitempty"`
+}
+
+// Schema is a JSON schema as understood by OpenAPI.
+type Schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Pattern              string             `json:"pattern,omitempty"`
+	Description          string             `json:"description,omitempty"`
+	Nullable             bool               `json:"nullable,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+}
+
+// Op describes the operation of a route.
+type Op struct {
+	// Summary is a short description of the operation.
+	Summary string
+	// Request is a value of the request body type, if there is a body.
+	Request interface{}
+	// Response is a value of the successful response body type. If nil,
+	// the operation responds with 204 No Content.
+	Response interface{}
+	// Auth are the components (such as auth.Relay) whose signature headers
+	// are required by the operation.
+	Auth []string
+}
+
+var (
+	textMarshaler = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	jsonMarshaler = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+)
+
+// Generator builds a Document, collecting the schemas of named struct types
+// as components.
+type Generator struct {
+	doc       *Document
+	overrides map[reflect.Type]*Schema
+	names     map[reflect.Type]string
+}
+
+// New creates a new Generator of a document with the given title and
+// version. It knows the custom encodings of the types in this module.
+func New(title, version string) *Generator {
+	g := &Generator{
+		doc: &Document{
+			OpenAPI:    Version,
+			Info:       Info{Title: title, Version: version},
+			Paths:      map[string]*PathItem{},
+			Components: Components{Schemas: map[string]*Schema{}},
+		},
+		overrides: map[reflect.Type]*Schema{},
+		names:     map[reflect.Type]string{},
+	}
+
+	b64 := &Schema{Type: "string", Format: "base64url", Pattern: "^[A-Za-z0-9_-]*$"}
+	g.Override(jsonb.B{}, b64)
+	g.Override(jsonb.PK{}, &Schema{Type: "string", Format: "base64url", Description: "ed25519 public key", Pattern: b64.Pattern})
+	g.Override(jsonb.SK{}, &Schema{Type: "string", Format: "base64url", Description: "ed25519 private key", Pattern: b64.Pattern})
+	g.Override(texturl.URL{}, &Schema{Type: "string", Format: "uri"})
+	g.Override(duration.T(0), &Schema{
+		Type:        "string",
+		Format:      "duration",
+		Description: "duration such as 300ms, 1.5h or 30d",
+		Pattern:     `^-?([0-9]+(\.[0-9]+)?(ns|us|µs|ms|s|m|h|d))+$`,
+	})
+	g.Override(semver.Version{}, &Schema{Type: "string", Format: "semver"})
+	g.Override(big.Rat{}, &Schema{Type: "string", Description: "rational number such as 1/3 or 0.5"})
+	g.Override(time.Time{}, &Schema{Type: "string", Format: "date-time"})
+	g.Override(json.RawMessage{}, &Schema{Description: "arbitrary JSON"})
+	return g
+}
+
+// Override makes the schema of the type of v s, for types with custom
+// encodings which cannot be inferred by reflection.
+func (g *Generator) Override(v interface{}, s *Schema) {
+	g.overrides[reflect.TypeOf(v)] = s
+}
+
+// name returns the component name of the named type t, such as
+// "contractinfo" for contractinfo.T or "contractinfo.Pof".
+func (g *Generator) name(t reflect.Type) string {
+	if n, ok := g.names[t]; ok {
+		return n
+	}
+
+	pkg := t.PkgPath()
+	pkg = pkg[strings.LastIndex(pkg, "/")+1:]
+	n := pkg + "." + t.Name()
+
+	if t.Name() == "T" {
+		n = pkg
+	}
+
+	// disambiguate equally named types from different packages
+	for i, base := 2, n; ; i++ {
+		if _, taken := g.doc.Components.Schemas[n]; !taken {
+			break
+		}
+
+		n = base + strconv.Itoa(i)
+	}
+
+	g.names[t] = n
+	return n
+}
+
+// Schema returns the schema of the type of v, registering the named struct
+// types it refers to as components.
+func (g *Generator) Schema(v interface{}) *Schema { return g.schema(reflect.TypeOf(v)) }
+
+func (g *Generator) schema(t reflect.Type) *Schema {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	if s, ok := g.overrides[t]; ok {
+		c := *s
+		return &c
+	}
+
+	switch {
+	case t.Implements(jsonMarshaler) || reflect.PtrTo(t).Implements(jsonMarshaler):
+		return &Schema{Description: "custom JSON encoding"}
+	case t.Implements(textMarshaler) || reflect.PtrTo(t).Implements(textMarshaler):
+		return &Schema{Type: "string"}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int64, reflect.Uint, reflect.Uint64, reflect.Uint32:
+		return &Schema{Type: "integer", Format: "int64"}
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint8, reflect.Uint16:
+		return &Schema{Type: "integer", Format: "int32"}
+	case reflect.Float32:
+		return &Schema{Type: "number", Format: "float"}
+	case reflect.Float64:
+		return &Schema{Type: "number", Format: "double"}
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return &Schema{Type: "string", Format: "byte"}
+		}
+
+		return &Schema{Type: "array", Items: g.schema(t.Elem())}
+	case reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: g.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.object(t)
+		}
+
+		n := g.name(t)
+
+		if _, ok := g.doc.Components.Schemas[n]; !ok {
+			// reserve the name first so recursive types terminate
+			g.doc.Components.Schemas[n] = &Schema{}
+			*g.doc.Components.Schemas[n] = *g.object(t)
+		}
+
+		return &Schema{Ref: "#/components/schemas/" + n}
+	}
+
+	return &Schema{}
+}
+
+// object returns the schema of the struct type t following the rules of
+// encoding/json.
+func (g *Generator) object(t reflect.Type) *Schema {
+	s := &Schema{Type: "object", Properties: map[string]*Schema{}}
+	g.fields(t, s)
+	sort.Strings(s.Required)
+	return s
+}
+
+// fields adds the fields of the struct type t to s.
+func (g *Generator) fields(t reflect.Type, s *Schema) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+
+		if tag == "-" {
+			continue
+		}
+
+		opts := strings.Split(tag, ",")
+		name := opts[0]
+		ft := f.Type
+
+		for ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+
+		// embedded structs without a name tag are inlined
+		if f.Anonymous && name == "" && ft.Kind() == reflect.Struct {
+			g.fields(ft, s)
+			continue
+		}
+
+		if f.PkgPath != "" {
+			continue
+		}
+
+		if name == "" {
+			name = f.Name
+		}
+
+		var (
+			fs   = g.schema(f.Type)
+			omit bool
+		)
+
+		// nil pointers are encoded as null, references can't be amended
+		if f.Type.Kind() == reflect.Ptr && fs.Ref == "" {
+			fs.Nullable = true
+		}
+
+		for _, o := range opts[1:] {
+			switch o {
+			case "omitempty":
+				omit = true
+			case "string":
+				fs = &Schema{Type: "string"}
+			}
+		}
+
+		if !omit {
+			s.Required = append(s.Required, name)
+		}
+
+		s.Properties[name] = fs
+	}
+}
+
+// Add adds the operation op for method on the path pattern, which uses the
+// syntax of provide.Router.
+func (g *Generator) Add(method, pattern string, op Op) {
+	var params []*Parameter
+
+	segs := strings.Split(pattern, "/")
+
+	for i, s := range segs {
+		if strings.HasPrefix(s, "{") && strings.HasSuffix(s, "}") {
+			name := strings.TrimSuffix(s[1:len(s)-1], "...")
+			segs[i] = "{" + name + "}"
+			params = append(params, &Parameter{Name: name, In: "path", Required: true, Schema: &Schema{Type: "string"}})
+		}
+	}
+
+	for _, c := range op.Auth {
+		for _, f := range []string{auth.Pubkey, auth.Signature} {
+			params = append(params, &Parameter{
+				Name:     strings.Join([]string{auth.Prefix, c, f}, "-"),
+				In:       "header",
+				Required: true,
+				Schema:   g.Schema(jsonb.B{}),
+			})
+		}
+	}
+
+	o := &Operation{
+		Summary:     op.Summary,
+		OperationID: strings.ToLower(method) + strings.NewReplacer("/", "_", "{", "", "}", "", ".", "").Replace(pattern),
+		Parameters:  params,
+		Responses: map[string]*Response{
+			"default": {
+				Description: "error",
+				Content:     map[string]*MediaType{"application/json": {Schema: g.Schema(status.T{})}},
+			},
+		},
+	}
+
+	if op.Request != nil {
+		o.RequestBody = &RequestBody{
+			Required: true,
+			Content:  map[string]*MediaType{"application/json": {Schema: g.Schema(op.Request)}},
+		}
+	}
+
+	if op.Response != nil {
+		o.Responses["200"] = &Response{
+			Description: "success",
+			Content:     map[string]*MediaType{"application/json": {Schema: g.Schema(op.Response)}},
+		}
+	} else {
+		o.Responses["204"] = &Response{Description: "success"}
+	}
+
+	path := strings.Join(segs, "/")
+	pi := g.doc.Paths[path]
+
+	if pi == nil {
+		pi = &PathItem{}
+		g.doc.Paths[path] = pi
+	}
+
+	(*pi)[strings.ToLower(method)] = o
+}
+
+// AddRoutes adds the operations of the routes ris, as returned by
+// provide.Router.Routes, looking them up in ops by method and pattern
+// separated by a space, such as "GET /info". Operations missing from ops
+// are added as operations without bodies.
+func (g *Generator) AddRoutes(ris []provide.RouteInfo, ops map[string]Op) {
+	for _, ri := range ris {
+		for _, m := range ri.Methods {
+			g.Add(m, ri.Pattern, ops[m+" "+ri.Pattern])
+		}
+	}
+}
+
+// Document returns the generated document.
+func (g *Generator) Document() *Document { return g.doc }
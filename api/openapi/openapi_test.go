@@ -0,0 +1,111 @@
+// Copyright (c) 2022 Wireleap
+
+package openapi
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/wireleap/common/api/auth"
+	"github.com/wireleap/common/api/duration"
+	"github.com/wireleap/common/api/jsonb"
+	"github.com/wireleap/common/api/provide"
+	"github.com/wireleap/common/api/texturl"
+)
+
+type Embedded struct {
+	Inline string `json:"inline"`
+}
+
+type Node struct {
+	*Embedded
+
+	Key      jsonb.PK     `json:"key"`
+	URL      *texturl.URL `json:"url,omitempty"`
+	Every    duration.T   `json:"every,omitempty"`
+	Children []*Node      `json:"children,omitempty"`
+	Count    int64        `json:"count,string"`
+	Skipped  string       `json:"-"`
+	hidden   string
+}
+
+func TestSchema(t *testing.T) {
+	g := New("test", "0.1.0")
+	s := g.Schema(&Node{})
+
+	if s.Ref != "#/components/schemas/openapi.Node" {
+		t.Fatalf("unexpected reference %q", s.Ref)
+	}
+
+	n := g.Document().Components.Schemas["openapi.Node"]
+
+	if n == nil {
+		t.Fatal("component missing")
+	}
+
+	want := map[string]string{
+		"inline": "string",
+		"key":    "string",
+		"url":    "string",
+		"every":  "string",
+		"count":  "string",
+	}
+
+	for k, typ := range want {
+		if n.Properties[k] == nil || n.Properties[k].Type != typ {
+			t.Errorf("property %s: expected type %s, got %+v", k, typ, n.Properties[k])
+		}
+	}
+
+	if n.Properties["url"].Format != "uri" || n.Properties["key"].Format != "base64url" {
+		t.Error("custom encodings not applied")
+	}
+
+	if c := n.Properties["children"]; c == nil || c.Items == nil || c.Items.Ref != s.Ref {
+		t.Errorf("recursive property not referenced: %+v", c)
+	}
+
+	for _, k := range []string{"Skipped", "hidden", "Embedded"} {
+		if _, ok := n.Properties[k]; ok {
+			t.Errorf("unexpected property %s", k)
+		}
+	}
+
+	b, _ := json.Marshal(n.Required)
+
+	if string(b) != `["count","inline","key"]` {
+		t.Errorf("unexpected required properties %s", b)
+	}
+}
+
+func TestAddRoutes(t *testing.T) {
+	g := New("test", "0.1.0")
+	g.AddRoutes([]provide.RouteInfo{
+		{Pattern: "/nodes/{id}", Methods: []string{"GET", "PUT"}},
+		{Pattern: "/files/{rest...}", Methods: []string{"GET"}},
+	}, map[string]Op{
+		"PUT /nodes/{id}": {Request: Node{}, Auth: []string{auth.Relay}},
+		"GET /nodes/{id}": {Response: Node{}},
+	})
+
+	d := g.Document()
+	nodes := d.Paths["/nodes/{id}"]
+
+	if nodes == nil || d.Paths["/files/{rest}"] == nil {
+		t.Fatalf("paths missing: %v", d.Paths)
+	}
+
+	get, put := (*nodes)["get"], (*nodes)["put"]
+
+	if get.Responses["200"] == nil || get.Responses["default"] == nil || get.RequestBody != nil {
+		t.Errorf("unexpected get operation %+v", get)
+	}
+
+	if put.Responses["204"] == nil || put.RequestBody == nil {
+		t.Errorf("unexpected put operation %+v", put)
+	}
+
+	if len(put.Parameters) != 3 || put.Parameters[0].In != "path" || put.Parameters[1].Name != "Wireleap-Relay-Pubkey" {
+		t.Errorf("unexpected put parameters %+v", put.Parameters)
+	}
+}
@@ -0,0 +1,206 @@
+// Copyright (c) 2022 Wireleap
+
+package pow
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"math/bits"
+	"strconv"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Names of the built-in algorithms.
+const (
+	BcryptName   = "bcrypt"
+	Argon2idName = "argon2id"
+	HashcashName = "hashcash"
+)
+
+// Upper bounds of the parameters of the built-in algorithms accepted in
+// challenges, so that a directory can not make relays do unbounded work.
+const (
+	MaxArgon2idTime   = 16
+	MaxArgon2idMemory = 1 << 20 // KiB
+	MaxHashcashBits   = 32
+)
+
+// Argon2idKeyLen is the length in bytes of argon2id responses.
+const Argon2idKeyLen = 32
+
+// Bcrypt is the bcrypt algorithm: the response is the bcrypt hash of the
+// challenge with the given cost.
+type Bcrypt struct{ Cost int }
+
+func parseBcrypt(params string) (Algorithm, error) {
+	cost, err := strconv.Atoi(params)
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid bcrypt cost %q", params)
+	}
+
+	if cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+		return nil, fmt.Errorf("bcrypt cost %d out of range", cost)
+	}
+
+	return Bcrypt{Cost: cost}, nil
+}
+
+func (Bcrypt) Name() string     { return BcryptName }
+func (a Bcrypt) Params() string { return strconv.Itoa(a.Cost) }
+
+func (a Bcrypt) Solve(c string) (string, error) {
+	h, err := bcrypt.GenerateFromPassword([]byte(c), a.Cost)
+	return string(h), err
+}
+
+func (a Bcrypt) Verify(c, resp string) error {
+	cost, err := bcrypt.Cost([]byte(resp))
+
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrResponse, err)
+	}
+
+	if cost < a.Cost {
+		return fmt.Errorf("%w: bcrypt cost %d is lower than %d", ErrResponse, cost, a.Cost)
+	}
+
+	if err = bcrypt.CompareHashAndPassword([]byte(resp), []byte(c)); err != nil {
+		return fmt.Errorf("%w: %s", ErrResponse, err)
+	}
+
+	return nil
+}
+
+// Argon2id is the argon2id algorithm: the response is the unpadded
+// base64url-encoded argon2id key derived from the challenge with the given
+// time, memory (in KiB) and threads parameters.
+type Argon2id struct {
+	Time    uint32
+	Memory  uint32
+	Threads uint8
+}
+
+func parseArgon2id(params string) (Algorithm, error) {
+	m, err := parseParams(params, "m", "p", "t")
+
+	if err != nil {
+		return nil, err
+	}
+
+	var vs [3]uint64
+
+	for i, k := range []string{"t", "m", "p"} {
+		v, ok := m[k]
+
+		if !ok {
+			return nil, fmt.Errorf("argon2id parameter %s is missing", k)
+		}
+
+		if vs[i], err = strconv.ParseUint(v, 10, 32); err != nil {
+			return nil, fmt.Errorf("invalid argon2id parameter %s=%q", k, v)
+		}
+	}
+
+	switch {
+	case vs[0] < 1 || vs[0] > MaxArgon2idTime:
+		return nil, fmt.Errorf("argon2id time %d out of range", vs[0])
+	case vs[1] < 8*vs[2] || vs[1] > MaxArgon2idMemory:
+		return nil, fmt.Errorf("argon2id memory %d out of range", vs[1])
+	case vs[2] < 1 || vs[2] > 255:
+		return nil, fmt.Errorf("argon2id threads %d out of range", vs[2])
+	}
+
+	return Argon2id{Time: uint32(vs[0]), Memory: uint32(vs[1]), Threads: uint8(vs[2])}, nil
+}
+
+func (Argon2id) Name() string { return Argon2idName }
+
+func (a Argon2id) Params() string {
+	return fmt.Sprintf("t=%d,m=%d,p=%d", a.Time, a.Memory, a.Threads)
+}
+
+func (a Argon2id) key(c string) []byte {
+	return argon2.IDKey([]byte(c), []byte(c), a.Time, a.Memory, a.Threads, Argon2idKeyLen)
+}
+
+func (a Argon2id) Solve(c string) (string, error) {
+	return base64.RawURLEncoding.EncodeToString(a.key(c)), nil
+}
+
+func (a Argon2id) Verify(c, resp string) error {
+	k, err := base64.RawURLEncoding.DecodeString(resp)
+
+	if err != nil || len(k) != Argon2idKeyLen {
+		return fmt.Errorf("%w: malformed argon2id key", ErrResponse)
+	}
+
+	if subtle.ConstantTimeCompare(k, a.key(c)) != 1 {
+		return fmt.Errorf("%w: argon2id key mismatch", ErrResponse)
+	}
+
+	return nil
+}
+
+// Hashcash is a hashcash-style algorithm: the response is a decimal counter
+// such that the SHA-256 hash of the challenge, a colon and the counter
+// starts with the given number of zero bits.
+type Hashcash struct{ Bits int }
+
+func parseHashcash(params string) (Algorithm, error) {
+	b, err := strconv.Atoi(params)
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid hashcash bits %q", params)
+	}
+
+	if b < 1 || b > MaxHashcashBits {
+		return nil, fmt.Errorf("hashcash bits %d out of range", b)
+	}
+
+	return Hashcash{Bits: b}, nil
+}
+
+func (Hashcash) Name() string     { return HashcashName }
+func (a Hashcash) Params() string { return strconv.Itoa(a.Bits) }
+
+// zeros returns the number of leading zero bits of the hash of c and n.
+func (a Hashcash) zeros(c, n string) (z int) {
+	h := sha256.Sum256([]byte(c + ":" + n))
+
+	for _, b := range h {
+		z += bits.LeadingZeros8(b)
+
+		if b != 0 {
+			break
+		}
+	}
+
+	return
+}
+
+func (a Hashcash) Solve(c string) (string, error) {
+	for i := uint64(0); ; i++ {
+		if n := strconv.FormatUint(i, 10); a.zeros(c, n) >= a.Bits {
+			return n, nil
+		}
+	}
+}
+
+func (a Hashcash) Verify(c, resp string) error {
+	i, err := strconv.ParseUint(resp, 10, 64)
+
+	if err != nil || strconv.FormatUint(i, 10) != resp {
+		return fmt.Errorf("%w: malformed hashcash counter", ErrResponse)
+	}
+
+	if z := a.zeros(c, resp); z < a.Bits {
+		return fmt.Errorf("%w: hashcash has %d zero bits, need %d", ErrResponse, z, a.Bits)
+	}
+
+	return nil
+}
@@ -0,0 +1,223 @@
+// Copyright (c) 2022 Wireleap
+
+package pow
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wireleap/common/api/auth"
+	"github.com/wireleap/common/api/nonce"
+	"github.com/wireleap/common/api/status"
+)
+
+// Defaults of Issuer.
+const (
+	DefaultTTL        = 5 * time.Minute
+	DefaultMaxPending = 4096
+	NonceSize         = 32
+)
+
+// ErrTooManyPending is returned by Issue when the number of pending
+// challenges has reached the limit.
+var ErrTooManyPending = errors.New("too many pending proof-of-work challenges")
+
+// Issuer issues proof-of-work challenges and verifies the responses to them.
+// Every challenge can be responded to only once and only until it expires.
+type Issuer struct {
+	// Algorithms are the algorithms challenges are issued for, in order of
+	// preference. The first bcrypt algorithm, if any, is used for legacy
+	// challenges when no algorithms are offered.
+	Algorithms []Algorithm
+	// TTL is the time challenges can be responded to.
+	TTL time.Duration
+	// MaxPending is the maximum number of challenges which are pending at
+	// the same time.
+	MaxPending int
+	// Now returns the current time. If nil, time.Now is used.
+	Now func() time.Time
+
+	mu      sync.Mutex
+	pending map[string]time.Time
+}
+
+// NewIssuer returns a new issuer of challenges for the algorithms as in
+// order of preference with DefaultTTL and DefaultMaxPending.
+func NewIssuer(as ...Algorithm) *Issuer {
+	return &Issuer{
+		Algorithms: as,
+		TTL:        DefaultTTL,
+		MaxPending: DefaultMaxPending,
+		pending:    map[string]time.Time{},
+	}
+}
+
+func (i *Issuer) now() time.Time {
+	if i.Now != nil {
+		return i.Now()
+	}
+
+	return time.Now()
+}
+
+// pick returns the most preferred algorithm offered in the header value
+// offer, or the legacy bcrypt algorithm if offer is empty.
+func (i *Issuer) pick(offer string) (Algorithm, bool, error) {
+	names := Offered(offer)
+
+	for _, a := range i.Algorithms {
+		if len(names) == 0 {
+			if a.Name() == BcryptName {
+				return a, true, nil
+			}
+
+			continue
+		}
+
+		for _, n := range names {
+			if a.Name() == n {
+				return a, false, nil
+			}
+		}
+	}
+
+	if len(names) == 0 {
+		return nil, false, fmt.Errorf("%w: legacy bcrypt challenges are not issued", ErrUnsupported)
+	}
+
+	return nil, false, fmt.Errorf("%w: none of %s", ErrUnsupported, offer)
+}
+
+// prune removes expired challenges. i.mu must be held.
+func (i *Issuer) prune(now time.Time) {
+	for c, exp := range i.pending {
+		if !now.Before(exp) {
+			delete(i.pending, c)
+		}
+	}
+}
+
+// Issue returns a new challenge for the most preferred of the algorithms
+// offered in the header value offer.
+func (i *Issuer) Issue(offer string) (string, error) {
+	a, legacy, err := i.pick(offer)
+
+	if err != nil {
+		return "", err
+	}
+
+	n, err := nonce.New(NonceSize)
+
+	if err != nil {
+		return "", fmt.Errorf("could not generate challenge nonce: %w", err)
+	}
+
+	c := Format(a, n)
+
+	if legacy {
+		c = a.Params() + "~" + n
+	}
+
+	now := i.now()
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if i.pending == nil {
+		i.pending = map[string]time.Time{}
+	}
+
+	if i.MaxPending > 0 && len(i.pending) >= i.MaxPending {
+		i.prune(now)
+
+		if len(i.pending) >= i.MaxPending {
+			return "", ErrTooManyPending
+		}
+	}
+
+	i.pending[c] = now.Add(i.TTL)
+	return c, nil
+}
+
+// Verify checks that resp is a valid response to the challenge c issued by
+// i. The challenge can not be used again afterwards.
+func (i *Issuer) Verify(c, resp string) error {
+	now := i.now()
+
+	i.mu.Lock()
+	exp, ok := i.pending[c]
+	delete(i.pending, c)
+	i.mu.Unlock()
+
+	switch {
+	case !ok:
+		return ErrUnknown
+	case !now.Before(exp):
+		return ErrExpired
+	}
+
+	a, err := Parse(c)
+
+	if err != nil {
+		return err
+	}
+
+	return a.Verify(c, resp)
+}
+
+// Pending returns the number of challenges which can still be responded to.
+func (i *Issuer) Pending() int {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.prune(i.now())
+	return len(i.pending)
+}
+
+// Handle checks the challenge response in the headers of r, returning
+// whether the request can proceed. If not, a new challenge or an error is
+// written to w.
+func (i *Issuer) Handle(w http.ResponseWriter, r *http.Request) bool {
+	offer := auth.GetHeader(r.Header, auth.Directory, auth.Challenge)
+
+	if c := offer; c != "" && !IsOffer(c) {
+		err := i.Verify(c, auth.GetHeader(r.Header, auth.Directory, auth.Response))
+
+		switch {
+		case err == nil:
+			return true
+		case errors.Is(err, ErrResponse):
+			status.ErrForbidden.Wrap(err).WriteTo(w)
+			return false
+		}
+
+		// unknown or expired challenges get a new one for the same
+		// algorithm
+		offer = ""
+
+		if p := strings.SplitN(strings.SplitN(c, "~", 2)[0], ":", 2); len(p) == 2 {
+			offer = p[0]
+		}
+	}
+
+	c, err := i.Issue(offer)
+
+	switch {
+	case errors.Is(err, ErrUnsupported):
+		status.ErrRequest.Wrap(err).WriteTo(w)
+		return false
+	case errors.Is(err, ErrTooManyPending):
+		status.ErrTooManyRequests.Wrap(err).WriteTo(w)
+		return false
+	case err != nil:
+		status.ErrInternal.Wrap(err).WriteTo(w)
+		return false
+	}
+
+	auth.SetHeader(w.Header(), auth.Directory, auth.Challenge, c)
+	status.ErrChallenge.WriteTo(w)
+	return false
+}
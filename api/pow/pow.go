@@ -0,0 +1,170 @@
+// Copyright (c) 2022 Wireleap
+
+// Package pow implements the proof-of-work challenge-response handshake
+// required by directories for relay enrollment.
+//
+// A relay offers the algorithms it supports as a comma-separated list in the
+// Wireleap-Directory-Challenge header of its first request. The directory
+// picks one of them and responds with a challenge of the form
+// "algorithm:params~nonce" in the same header. The relay then repeats the
+// request with the challenge and its solution in the Wireleap-Directory-
+// Challenge and Wireleap-Directory-Response headers. Relays which do not
+// offer any algorithms are sent legacy bcrypt challenges of the form
+// "cost~nonce".
+package pow
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Errors returned when parsing or verifying challenges.
+var (
+	ErrUnsupported = errors.New("unsupported proof-of-work algorithm")
+	ErrMalformed   = errors.New("malformed proof-of-work challenge")
+	ErrUnknown     = errors.New("unknown proof-of-work challenge")
+	ErrExpired     = errors.New("expired proof-of-work challenge")
+	ErrResponse    = errors.New("invalid proof-of-work response")
+)
+
+// Algorithm is a proof-of-work algorithm with a given set of parameters.
+type Algorithm interface {
+	// Name returns the name of the algorithm.
+	Name() string
+	// Params returns the parameters of the algorithm as used in challenges.
+	Params() string
+	// Solve computes the response to the challenge c.
+	Solve(c string) (string, error)
+	// Verify checks that resp is a valid response to the challenge c.
+	Verify(c, resp string) error
+}
+
+// ParseFunc returns the algorithm described by the parameters params.
+type ParseFunc func(params string) (Algorithm, error)
+
+var (
+	mu      sync.RWMutex
+	parsers = map[string]ParseFunc{}
+	order   []string
+)
+
+// Register makes the algorithm name available to Parse, Solve and Offer.
+// Registering a name twice replaces its ParseFunc.
+func Register(name string, f ParseFunc) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if _, ok := parsers[name]; !ok {
+		order = append(order, name)
+	}
+
+	parsers[name] = f
+}
+
+// Names returns the names of the registered algorithms in registration
+// order.
+func Names() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	return append([]string(nil), order...)
+}
+
+// Format returns the challenge for algorithm a and nonce n.
+func Format(a Algorithm, n string) string {
+	return a.Name() + ":" + a.Params() + "~" + n
+}
+
+// Parse returns the algorithm a challenge c has to be solved with.
+func Parse(c string) (Algorithm, error) {
+	p := strings.SplitN(c, "~", 2)
+
+	if len(p) != 2 || p[1] == "" {
+		return nil, fmt.Errorf("%w: %q", ErrMalformed, c)
+	}
+
+	name, params := BcryptName, p[0]
+
+	if i := strings.IndexByte(p[0], ':'); i >= 0 {
+		name, params = p[0][:i], p[0][i+1:]
+	}
+
+	mu.RLock()
+	f, ok := parsers[name]
+	mu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupported, name)
+	}
+
+	a, err := f(params)
+
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrMalformed, err)
+	}
+
+	return a, nil
+}
+
+// Solve computes the response to challenge c.
+func Solve(c string) (string, error) {
+	a, err := Parse(c)
+
+	if err != nil {
+		return "", err
+	}
+
+	return a.Solve(c)
+}
+
+// Offer returns the header value offering the algorithms names.
+func Offer(names ...string) string { return strings.Join(names, ",") }
+
+// Offered returns the algorithm names offered in the header value h.
+func Offered(h string) (names []string) {
+	for _, n := range strings.Split(h, ",") {
+		if n = strings.TrimSpace(n); n != "" {
+			names = append(names, n)
+		}
+	}
+
+	return
+}
+
+// IsOffer returns whether the header value h is an offer of algorithms as
+// opposed to a challenge.
+func IsOffer(h string) bool { return h != "" && !strings.Contains(h, "~") }
+
+func init() {
+	Register(Argon2idName, parseArgon2id)
+	Register(HashcashName, parseHashcash)
+	Register(BcryptName, parseBcrypt)
+}
+
+// parseParams parses parameters of the form "k1=v1,k2=v2" into a map,
+// rejecting keys not in keys.
+func parseParams(s string, keys ...string) (map[string]string, error) {
+	m := map[string]string{}
+
+	for _, kv := range strings.Split(s, ",") {
+		p := strings.SplitN(kv, "=", 2)
+
+		if len(p) != 2 {
+			return nil, fmt.Errorf("invalid parameter %q", kv)
+		}
+
+		if i := sort.SearchStrings(keys, p[0]); i == len(keys) || keys[i] != p[0] {
+			return nil, fmt.Errorf("unknown parameter %q", p[0])
+		}
+
+		if _, ok := m[p[0]]; ok {
+			return nil, fmt.Errorf("duplicate parameter %q", p[0])
+		}
+
+		m[p[0]] = p[1]
+	}
+
+	return m, nil
+}
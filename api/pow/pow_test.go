@@ -0,0 +1,189 @@
+// Copyright (c) 2022 Wireleap
+
+package pow
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wireleap/common/api/auth"
+)
+
+var cheap = []Algorithm{
+	Hashcash{Bits: 8},
+	Argon2id{Time: 1, Memory: 64, Threads: 1},
+	Bcrypt{Cost: 4},
+}
+
+func TestAlgorithms(t *testing.T) {
+	for _, a := range cheap {
+		c := Format(a, "abcd")
+		a2, err := Parse(c)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if a2 != a {
+			t.Fatalf("expected %#v from %s, got %#v", a, c, a2)
+		}
+
+		resp, err := Solve(c)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err = a.Verify(c, resp); err != nil {
+			t.Fatalf("%s: %s", c, err)
+		}
+
+		if err = a.Verify(c+"x", resp); !errors.Is(err, ErrResponse) {
+			t.Fatalf("%s: expected response mismatch, got %v", c, err)
+		}
+	}
+
+	// cheaper bcrypt hashes are refused
+	resp, _ := Bcrypt{Cost: 4}.Solve("5~abcd")
+
+	if err := (Bcrypt{Cost: 5}).Verify("5~abcd", resp); !errors.Is(err, ErrResponse) {
+		t.Fatalf("expected cheap bcrypt hash to be refused, got %v", err)
+	}
+}
+
+func TestParse(t *testing.T) {
+	if a, err := Parse("10~abcd"); err != nil || a != (Bcrypt{Cost: 10}) {
+		t.Fatalf("expected legacy bcrypt challenge, got %v, %v", a, err)
+	}
+
+	for c, e := range map[string]error{
+		"abcd":                            ErrMalformed,
+		"10~":                             ErrMalformed,
+		"x~abcd":                          ErrMalformed,
+		"bcrypt:99~abcd":                  ErrMalformed,
+		"hashcash:64~abcd":                ErrMalformed,
+		"argon2id:t=1,m=64~abcd":          ErrMalformed,
+		"argon2id:t=1,t=1,m=64,p=1~abcd":  ErrMalformed,
+		"argon2id:t=1,m=9999999,p=1~abcd": ErrMalformed,
+		"scrypt:1~abcd":                   ErrUnsupported,
+	} {
+		if _, err := Parse(c); !errors.Is(err, e) {
+			t.Errorf("%s: expected %v, got %v", c, e, err)
+		}
+	}
+}
+
+func TestIssuer(t *testing.T) {
+	now := time.Now()
+	i := NewIssuer(cheap...)
+	i.Now = func() time.Time { return now }
+
+	// server preference wins among offered algorithms
+	c, err := i.Issue(Offer(BcryptName, Argon2idName))
+
+	if err != nil || !strings.HasPrefix(c, Argon2idName+":") {
+		t.Fatalf("expected argon2id challenge, got %q, %v", c, err)
+	}
+
+	// no offer means legacy bcrypt
+	c, err = i.Issue("")
+
+	if err != nil || !strings.HasPrefix(c, "4~") {
+		t.Fatalf("expected legacy bcrypt challenge, got %q, %v", c, err)
+	}
+
+	if _, err = i.Issue("scrypt"); !errors.Is(err, ErrUnsupported) {
+		t.Fatalf("expected unsupported offer, got %v", err)
+	}
+
+	c, _ = i.Issue(HashcashName)
+	resp, err := Solve(c)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = i.Verify(c, resp); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = i.Verify(c, resp); !errors.Is(err, ErrUnknown) {
+		t.Fatalf("expected replay to be refused, got %v", err)
+	}
+
+	c, _ = i.Issue(HashcashName)
+	resp, _ = Solve(c)
+	now = now.Add(i.TTL)
+
+	if err = i.Verify(c, resp); !errors.Is(err, ErrExpired) {
+		t.Fatalf("expected expired challenge, got %v", err)
+	}
+
+	if n := i.Pending(); n != 0 {
+		t.Fatalf("expected no pending challenges, got %d", n)
+	}
+
+	i.MaxPending = 1
+	i.Issue("")
+
+	if _, err = i.Issue(""); !errors.Is(err, ErrTooManyPending) {
+		t.Fatalf("expected too many pending challenges, got %v", err)
+	}
+}
+
+func TestHandle(t *testing.T) {
+	i := NewIssuer(cheap...)
+
+	do := func(c, resp string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/relays", nil)
+
+		if c != "" {
+			auth.SetHeader(r.Header, auth.Directory, auth.Challenge, c)
+		}
+
+		if resp != "" {
+			auth.SetHeader(r.Header, auth.Directory, auth.Response, resp)
+		}
+
+		w := httptest.NewRecorder()
+
+		if i.Handle(w, r) {
+			w.WriteHeader(http.StatusOK)
+		}
+
+		return w
+	}
+
+	w := do(Offer(Names()...), "")
+	c := auth.GetHeader(w.Header(), auth.Directory, auth.Challenge)
+
+	if w.Code != http.StatusAccepted || !strings.HasPrefix(c, HashcashName+":") {
+		t.Fatalf("expected hashcash challenge, got %d %q", w.Code, c)
+	}
+
+	if w = do(c, "nope"); w.Code != http.StatusForbidden {
+		t.Fatalf("expected invalid response to be forbidden, got %d", w.Code)
+	}
+
+	// consumed challenges are replaced by a new one for the same algorithm
+	w = do(c, "nope")
+	c = auth.GetHeader(w.Header(), auth.Directory, auth.Challenge)
+
+	if w.Code != http.StatusAccepted || !strings.HasPrefix(c, HashcashName+":") {
+		t.Fatalf("expected new hashcash challenge, got %d %q", w.Code, c)
+	}
+
+	resp, _ := Solve(c)
+
+	if w = do(c, resp); w.Code != http.StatusOK {
+		t.Fatalf("expected valid response to pass, got %d", w.Code)
+	}
+
+	if w = do("", ""); w.Code != http.StatusAccepted {
+		t.Fatalf("expected legacy challenge, got %d", w.Code)
+	}
+}
@@ -0,0 +1,323 @@
+// Copyright (c) 2022 Wireleap
+
+package provide
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	mrand "math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wireleap/common/logger"
+)
+
+// IPMode is the way client addresses are recorded in access logs.
+type IPMode int
+
+const (
+	// IPTruncate records the network prefix of the client address only.
+	IPTruncate IPMode = iota
+	// IPHash records a keyed hash of the client address, which allows
+	// correlating requests from the same address without revealing it.
+	IPHash
+	// IPFull records the client address as is.
+	IPFull
+	// IPOmit does not record the client address at all.
+	IPOmit
+)
+
+// QueryMode is the way URL query strings are recorded in access logs.
+type QueryMode int
+
+const (
+	// QueryRedact records the query parameter names but not their values.
+	QueryRedact QueryMode = iota
+	// QueryDrop does not record the query string at all.
+	QueryDrop
+	// QueryFull records the query string as is.
+	QueryFull
+)
+
+// AccessLogFormat is the format of access log entries.
+type AccessLogFormat int
+
+const (
+	// CommonLogFormat is the NCSA common log format.
+	CommonLogFormat AccessLogFormat = iota
+	// JSONLogFormat formats entries as JSON objects, one per line.
+	JSONLogFormat
+)
+
+// Default prefix lengths used by IPTruncate.
+const (
+	DefaultIPv4Prefix = 24
+	DefaultIPv6Prefix = 48
+)
+
+// AccessLogOptions are the options of AccessLogGate. The zero value records
+// truncated client addresses and redacted query strings of all requests in
+// the common log format.
+type AccessLogOptions struct {
+	// Format is the format of the entries.
+	Format AccessLogFormat
+	// Output receives the formatted entries. If nil, entries are logged at
+	// the info level using the logger of the request context instead, with
+	// their fields as key-value pairs regardless of Format.
+	Output io.Writer
+
+	// IP is the way client addresses are recorded.
+	IP IPMode
+	// IPv4Prefix and IPv6Prefix are the prefix lengths kept by IPTruncate.
+	// If zero, DefaultIPv4Prefix and DefaultIPv6Prefix are used.
+	IPv4Prefix, IPv6Prefix int
+	// HashKey is the key used by IPHash. If nil, a random key is generated
+	// when the gate is created, so hashes cannot be correlated across
+	// restarts.
+	HashKey []byte
+
+	// Query is the way query strings are recorded.
+	Query QueryMode
+
+	// Sample is the fraction of successful requests which are logged, from
+	// 0 (exclusive) to 1. If zero, all requests are logged. Requests
+	// resulting in status codes of 400 and above are always logged.
+	Sample float64
+
+	// Now returns the current time. If nil, time.Now is used.
+	Now func() time.Time
+}
+
+// accessEntry is a single access log entry.
+type accessEntry struct {
+	Time     time.Time     `json:"-"`
+	Remote   string        `json:"remote,omitempty"`
+	Method   string        `json:"method"`
+	URI      string        `json:"uri"`
+	Proto    string        `json:"proto"`
+	Status   int           `json:"status"`
+	Bytes    int64         `json:"bytes"`
+	Duration time.Duration `json:"-"`
+}
+
+// jsonEntry is the JSON representation of an accessEntry.
+type jsonEntry struct {
+	*accessEntry
+	Time       string  `json:"time"`
+	DurationMS float64 `json:"duration_ms"`
+}
+
+// common formats e in the common log format.
+func (e *accessEntry) common() string {
+	remote := e.Remote
+
+	if remote == "" {
+		remote = "-"
+	}
+
+	return fmt.Sprintf(
+		"%s - - [%s] %q %d %d",
+		remote,
+		e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		e.Method+" "+e.URI+" "+e.Proto,
+		e.Status,
+		e.Bytes,
+	)
+}
+
+// accessLogger records access log entries according to its options.
+type accessLogger struct {
+	o AccessLogOptions
+
+	mu  sync.Mutex
+	rnd *mrand.Rand
+}
+
+func newAccessLogger(o AccessLogOptions) *accessLogger {
+	if o.IPv4Prefix == 0 {
+		o.IPv4Prefix = DefaultIPv4Prefix
+	}
+
+	if o.IPv6Prefix == 0 {
+		o.IPv6Prefix = DefaultIPv6Prefix
+	}
+
+	if o.IP == IPHash && o.HashKey == nil {
+		o.HashKey = make([]byte, 32)
+
+		if _, err := rand.Read(o.HashKey); err != nil {
+			panic(fmt.Errorf("could not generate access log hash key: %w", err))
+		}
+	}
+
+	if o.Now == nil {
+		o.Now = time.Now
+	}
+
+	return &accessLogger{o: o, rnd: mrand.New(mrand.NewSource(time.Now().UnixNano()))}
+}
+
+// remote returns the recorded form of the client address addr.
+func (a *accessLogger) remote(addr string) string {
+	if a.o.IP == IPOmit {
+		return ""
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+
+	if err != nil {
+		host = addr
+	}
+
+	switch a.o.IP {
+	case IPFull:
+		return host
+	case IPHash:
+		m := hmac.New(sha256.New, a.o.HashKey)
+		m.Write([]byte(host))
+		return hex.EncodeToString(m.Sum(nil)[:8])
+	}
+
+	ip := net.ParseIP(host)
+
+	if ip == nil {
+		// not an address, so it can't be truncated
+		return "-"
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(a.o.IPv4Prefix, 32)).String()
+	}
+
+	return ip.Mask(net.CIDRMask(a.o.IPv6Prefix, 128)).String()
+}
+
+// uri returns the recorded form of the request URI of u.
+func (a *accessLogger) uri(u *url.URL) string {
+	p := u.EscapedPath()
+
+	if u.RawQuery == "" {
+		return p
+	}
+
+	switch a.o.Query {
+	case QueryFull:
+		return p + "?" + u.RawQuery
+	case QueryDrop:
+		return p
+	}
+
+	q, err := url.ParseQuery(u.RawQuery)
+
+	if err != nil {
+		return p + "?REDACTED"
+	}
+
+	keys := make([]string, 0, len(q))
+
+	for k := range q {
+		keys = append(keys, url.QueryEscape(k)+"=REDACTED")
+	}
+
+	sort.Strings(keys)
+	return p + "?" + strings.Join(keys, "&")
+}
+
+// sampled returns whether a request resulting in status code should be
+// logged.
+func (a *accessLogger) sampled(code int) bool {
+	if a.o.Sample <= 0 || a.o.Sample >= 1 || code >= 400 {
+		return true
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.rnd.Float64() < a.o.Sample
+}
+
+// log records e for request r.
+func (a *accessLogger) log(r *http.Request, e *accessEntry) {
+	if a.o.Output == nil {
+		logger.FromContext(r.Context()).Info(
+			"access",
+			"remote", e.Remote, "method", e.Method, "uri", e.URI, "proto", e.Proto,
+			"status", e.Status, "bytes", e.Bytes, "duration", e.Duration,
+		)
+		return
+	}
+
+	var line string
+
+	switch a.o.Format {
+	case JSONLogFormat:
+		var b strings.Builder
+
+		enc := json.NewEncoder(&b)
+		enc.SetEscapeHTML(false)
+
+		err := enc.Encode(jsonEntry{
+			accessEntry: e,
+			Time:        e.Time.Format(time.RFC3339Nano),
+			DurationMS:  float64(e.Duration) / float64(time.Millisecond),
+		})
+
+		if err != nil {
+			logger.FromContext(r.Context()).Error("could not marshal access log entry", "error", err)
+			return
+		}
+
+		line = strings.TrimSuffix(b.String(), "\n")
+	default:
+		line = e.common()
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	io.WriteString(a.o.Output, line+"\n")
+}
+
+// AccessLogGate logs requests to targetMux along with their response status,
+// size and latency as configured by o. Unlike LogRequestGate, it allows
+// limiting the recorded client information to what the privacy policy of
+// the service (see contractinfo.Metadata.PrivPolicy) permits.
+func AccessLogGate(targetMux http.Handler, o AccessLogOptions) http.Handler {
+	a := newAccessLogger(o)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var (
+			sw    = &statusWriter{ResponseWriter: w}
+			start = a.o.Now()
+		)
+
+		targetMux.ServeHTTP(sw, r)
+
+		if sw.code == 0 {
+			sw.code = http.StatusOK
+		}
+
+		if !a.sampled(sw.code) {
+			return
+		}
+
+		a.log(r, &accessEntry{
+			Time:     start,
+			Remote:   a.remote(r.RemoteAddr),
+			Method:   r.Method,
+			URI:      a.uri(r.URL),
+			Proto:    r.Proto,
+			Status:   sw.code,
+			Bytes:    sw.n,
+			Duration: a.o.Now().Sub(start),
+		})
+	})
+}
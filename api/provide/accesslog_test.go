@@ -0,0 +1,142 @@
+// Copyright (c) 2022 Wireleap
+
+package provide
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wireleap/common/logger"
+)
+
+// stepClock returns a clock advancing by step on every call.
+func stepClock(step time.Duration) func() time.Time {
+	t := time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	return func() time.Time {
+		t = t.Add(step)
+		return t
+	}
+}
+
+func TestAccessLogGate(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		h      http.HandlerFunc
+		status int
+		bytes  int64
+	}{
+		{"explicit", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte("hello"))
+		}, http.StatusCreated, 5},
+		{"implicit", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("hello"))
+			w.Write([]byte(" world"))
+		}, http.StatusOK, 11},
+		{"empty", func(w http.ResponseWriter, r *http.Request) {}, http.StatusOK, 0},
+		{"error", func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "nope", http.StatusNotFound)
+		}, http.StatusNotFound, 5},
+	} {
+		var out bytes.Buffer
+
+		h := AccessLogGate(c.h, AccessLogOptions{
+			Format: JSONLogFormat,
+			Output: &out,
+			Now:    stepClock(25 * time.Millisecond),
+			Sample: 0.000001,
+		})
+		r := httptest.NewRequest(http.MethodPut, "/x/y?secret=1", nil)
+		r.RemoteAddr = "192.0.2.77:1234"
+		h.ServeHTTP(httptest.NewRecorder(), r)
+
+		var e map[string]interface{}
+
+		if c.status < 400 {
+			// sampled out
+			if out.Len() != 0 {
+				t.Errorf("%s: expected no entry, got %s", c.name, out.String())
+			}
+
+			out.Reset()
+			h = AccessLogGate(c.h, AccessLogOptions{
+				Format: JSONLogFormat,
+				Output: &out,
+				Now:    stepClock(25 * time.Millisecond),
+			})
+			h.ServeHTTP(httptest.NewRecorder(), r)
+		}
+
+		if err := json.Unmarshal(out.Bytes(), &e); err != nil {
+			t.Fatalf("%s: %s: %q", c.name, err, out.String())
+		}
+
+		exp := map[string]interface{}{
+			"remote":      "192.0.2.0",
+			"method":      "PUT",
+			"uri":         "/x/y?secret=REDACTED",
+			"proto":       "HTTP/1.1",
+			"status":      float64(c.status),
+			"bytes":       float64(c.bytes),
+			"duration_ms": float64(25),
+			"time":        "2022-01-02T03:04:05.025Z",
+		}
+
+		for k, v := range exp {
+			if e[k] != v {
+				t.Errorf("%s: expected %s=%v, got %v", c.name, k, v, e[k])
+			}
+		}
+	}
+}
+
+func TestAccessLogGateFormats(t *testing.T) {
+	h := func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("hi")) }
+	r := httptest.NewRequest(http.MethodGet, "/a?b=c&d=e", nil)
+	r.RemoteAddr = "[2001:db8:1:2::1]:443"
+
+	var out bytes.Buffer
+
+	AccessLogGate(http.HandlerFunc(h), AccessLogOptions{
+		Output: &out,
+		Query:  QueryFull,
+		Now:    stepClock(time.Second),
+	}).ServeHTTP(httptest.NewRecorder(), r)
+
+	exp := `2001:db8:1:: - - [02/Jan/2022:03:04:06 +0000] "GET /a?b=c&d=e HTTP/1.1" 200 2` + "\n"
+
+	if out.String() != exp {
+		t.Errorf("expected %q, got %q", exp, out.String())
+	}
+
+	// without an output, entries go to the logger of the request context
+	var (
+		msg string
+		kvs = map[string]interface{}{}
+	)
+
+	l := logger.Func(func(lvl logger.Level, m string, p []interface{}) {
+		msg = m
+
+		for i := 0; i+1 < len(p); i += 2 {
+			kvs[fmt.Sprint(p[i])] = p[i+1]
+		}
+	})
+
+	AccessLogGate(http.HandlerFunc(h), AccessLogOptions{
+		IP:  IPOmit,
+		Now: stepClock(time.Second),
+	}).ServeHTTP(httptest.NewRecorder(), r.WithContext(logger.NewContext(r.Context(), l)))
+
+	if strings.Contains(msg, "GET") || kvs["method"] != "GET" || kvs["status"] != 200 ||
+		kvs["bytes"] != int64(2) || kvs["duration"] != time.Second || kvs["remote"] != "" {
+		t.Errorf("unexpected log entry %q %v", msg, kvs)
+	}
+}
@@ -3,25 +3,46 @@
 package provide
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
 	"fmt"
-	"log"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"net/http/httputil"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/wireleap/common/api/auth"
 	"github.com/wireleap/common/api/canned"
 	"github.com/wireleap/common/api/interfaces"
+	"github.com/wireleap/common/api/signer"
 	"github.com/wireleap/common/api/status"
+	"github.com/wireleap/common/logger"
+	"github.com/wireleap/common/metrics"
 )
 
 type Routes map[string]http.Handler
 
+// LoggerGate makes l the logger used by the gates wrapping requests to
+// targetMux. It should be the outermost gate, for example wrapping the
+// handler of a server created by DefaultServer.
+func LoggerGate(targetMux http.Handler, l logger.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		targetMux.ServeHTTP(w, r.WithContext(logger.NewContext(r.Context(), l)))
+	})
+}
+
 func LogRequestGate(targetMux http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("Got JSON API request: %s: %s %s %s\n", r.RemoteAddr, r.Method, r.Proto, r.URL)
+		logger.FromContext(r.Context()).Info(
+			"got JSON API request",
+			"remote", r.RemoteAddr, "method", r.Method, "proto", r.Proto, "url", r.URL.String(),
+		)
 		targetMux.ServeHTTP(w, r)
 	})
 }
@@ -35,7 +56,8 @@ func IdempotencyKeyGate(targetMux http.Handler) http.Handler {
 
 	go func() {
 		for _ = range t.C {
-			log.Printf("cleaning up cached idempotency keys/responses...")
+			// not tied to a request, so the default logger is used
+			logger.Default.Info("cleaning up cached idempotency keys/responses...")
 
 			mu.Lock()
 			for k := range m {
@@ -43,7 +65,7 @@ func IdempotencyKeyGate(targetMux http.Handler) http.Handler {
 			}
 			mu.Unlock()
 
-			log.Printf("done cleaning up cached idempotency keys/responses")
+			logger.Default.Info("done cleaning up cached idempotency keys/responses")
 		}
 	}()
 
@@ -74,13 +96,14 @@ func IdempotencyKeyGate(targetMux http.Handler) http.Handler {
 				can, err = canned.Can(res)
 
 				if err != nil {
-					log.Printf("could not put following http response in a can, this is weird...")
+					l := logger.FromContext(r.Context())
+					l.Error("could not put following http response in a can, this is weird...", "error", err)
 					b, err := httputil.DumpResponse(res, true)
 
 					if err == nil {
-						log.Print(string(b))
+						l.Error("uncannable http response", "response", string(b))
 					} else {
-						log.Printf("additionally, error while trying to dump response: %s", err)
+						l.Error("additionally, error while trying to dump response", "error", err)
 					}
 
 					status.ErrInternal.WriteTo(w)
@@ -107,6 +130,9 @@ func MethodGate(m Routes) http.Handler {
 		supported = append(supported, k)
 	}
 
+	sort.Strings(supported)
+	allow := strings.Join(supported, ", ")
+
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if m == nil {
 			// kinda weird but ok
@@ -125,6 +151,7 @@ func MethodGate(m Routes) http.Handler {
 				supported,
 			)
 
+			w.Header().Set("Allow", allow)
 			status.ErrMethod.Wrap(status.Cause(cause)).WriteTo(w)
 			return
 		}
@@ -133,10 +160,52 @@ func MethodGate(m Routes) http.Handler {
 	})
 }
 
+// BodyLimitGate refuses requests to targetMux with bodies larger than n
+// bytes with status.ErrTooLarge. Bodies of unknown length are cut off at n
+// bytes, making reads past that fail.
+func BodyLimitGate(targetMux http.Handler, n int64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > n {
+			status.ErrTooLarge.Wrap(fmt.Errorf(
+				"request body of %d bytes exceeds the limit of %d bytes",
+				r.ContentLength, n,
+			)).WriteTo(w)
+			return
+		}
+
+		r.Body = &maxBytesBody{ReadCloser: http.MaxBytesReader(w, r.Body, n), n: n}
+		targetMux.ServeHTTP(w, r)
+	})
+}
+
+// maxBytesBody wraps an http.MaxBytesReader of limit n, marking errors of
+// reads past the limit with auth.ErrBodyTooLarge so gates can report them as
+// such. http.MaxBytesError would do, but it needs Go 1.19.
+type maxBytesBody struct {
+	io.ReadCloser
+	n, read int64
+}
+
+func (b *maxBytesBody) Read(p []byte) (int, error) {
+	k, err := b.ReadCloser.Read(p)
+	b.read += int64(k)
+
+	if err != nil && err != io.EOF && b.read >= b.n {
+		err = fmt.Errorf("%w: %s", auth.ErrBodyTooLarge, err)
+	}
+
+	return k, err
+}
+
 func AuthGate(targetMux http.Handler, components ...string) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		_, err := auth.SignedReqBody(r, components...)
 
+		if errors.Is(err, auth.ErrBodyTooLarge) {
+			status.ErrTooLarge.Wrap(err).WriteTo(w)
+			return
+		}
+
 		if err != nil {
 			status.ErrForbidden.Wrap(err).WriteTo(w)
 			return
@@ -167,6 +236,143 @@ func VersionGate(targetMux http.Handler, is ...interfaces.T) http.Handler {
 	})
 }
 
+// SignGate signs the bodies of successful responses of targetMux using s and
+// sets the pubkey and signature headers of component c accordingly.
+func SignGate(targetMux http.Handler, s signer.Signer, c string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rr := httptest.NewRecorder()
+		targetMux.ServeHTTP(rr, r)
+
+		if rr.Code >= 200 && rr.Code < 300 {
+			auth.SignBody(rr.Header(), c, s, rr.Body.Bytes())
+		}
+
+		replay(w, rr)
+	})
+}
+
+// CacheGate sets the ETag and Cache-Control headers on successful GET
+// responses of targetMux, allowing clients to cache them for maxage. If the
+// request carries an If-None-Match header matching the current ETag, the body
+// is omitted and 304 Not Modified is returned instead.
+func CacheGate(targetMux http.Handler, maxage time.Duration) http.Handler {
+	cc := "max-age=" + strconv.FormatInt(int64(maxage/time.Second), 10)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			targetMux.ServeHTTP(w, r)
+			return
+		}
+
+		rr := httptest.NewRecorder()
+		targetMux.ServeHTTP(rr, r)
+
+		if rr.Code != http.StatusOK {
+			replay(w, rr)
+			return
+		}
+
+		sum := sha256.Sum256(rr.Body.Bytes())
+		etag := `"` + base64.RawURLEncoding.EncodeToString(sum[:]) + `"`
+
+		rr.Header().Set("ETag", etag)
+		rr.Header().Set("Cache-Control", cc)
+
+		for _, v := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+			v = strings.TrimPrefix(strings.TrimSpace(v), "W/")
+
+			if v == etag || v == "*" {
+				for k, vs := range rr.Header() {
+					w.Header()[k] = vs
+				}
+
+				w.Header().Del("Content-Length")
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+
+		replay(w, rr)
+	})
+}
+
+var (
+	apiRequests = metrics.Default.Counter(
+		"wireleap_api_requests_total",
+		"Total number of API requests by route, method and status code.",
+		"route", "method", "code",
+	)
+	apiLatency = metrics.Default.Histogram(
+		"wireleap_api_request_duration_seconds",
+		"Duration of API requests in seconds by route.",
+		nil,
+		"route",
+	)
+)
+
+// statusWriter is a http.ResponseWriter recording the status code and the
+// number of body bytes written.
+type statusWriter struct {
+	http.ResponseWriter
+	code int
+	n    int64
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(p []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+
+	n, err := w.ResponseWriter.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// MetricsGate counts the requests to targetMux and measures their duration
+// in metrics.Default, labeled with route. The route should be a fixed name
+// or pattern rather than the request path to keep the number of series low.
+func MetricsGate(targetMux http.Handler, route string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var (
+			sw    = &statusWriter{ResponseWriter: w}
+			start = time.Now()
+		)
+
+		targetMux.ServeHTTP(sw, r)
+
+		if sw.code == 0 {
+			sw.code = http.StatusOK
+		}
+
+		apiRequests.Inc(route, r.Method, strconv.Itoa(sw.code))
+		apiLatency.Observe(time.Since(start).Seconds(), route)
+	})
+}
+
+// replay writes the response recorded in rr to w.
+func replay(w http.ResponseWriter, rr *httptest.ResponseRecorder) {
+	for k, vs := range rr.Header() {
+		w.Header()[k] = vs
+	}
+
+	w.WriteHeader(rr.Code)
+	w.Write(rr.Body.Bytes())
+}
+
 func NewMux(routes ...Routes) *http.ServeMux {
 	mux := http.NewServeMux()
 
@@ -0,0 +1,91 @@
+// Copyright (c) 2022 Wireleap
+
+package provide
+
+import (
+	"crypto/ed25519"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/wireleap/common/api/auth"
+	"github.com/wireleap/common/api/signer"
+)
+
+func TestBodyLimitGate(t *testing.T) {
+	var got string
+
+	h := BodyLimitGate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := ioutil.ReadAll(r.Body)
+
+		if err != nil {
+			w.WriteHeader(http.StatusTeapot)
+			return
+		}
+
+		got = string(b)
+	}), 8)
+
+	for _, c := range []struct {
+		body    string
+		unknown bool
+		code    int
+	}{
+		{"12345678", false, http.StatusOK},
+		{"12345678", true, http.StatusOK},
+		{"123456789", false, http.StatusRequestEntityTooLarge},
+		// cut off while reading
+		{"123456789", true, http.StatusTeapot},
+	} {
+		got = ""
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(c.body))
+
+		if c.unknown {
+			r.ContentLength = -1
+			r.Body = ioutil.NopCloser(io.MultiReader(r.Body))
+		}
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		if w.Code != c.code {
+			t.Errorf("%q (unknown length: %v): expected %d, got %d", c.body, c.unknown, c.code, w.Code)
+		}
+
+		if c.code == http.StatusOK && got != c.body {
+			t.Errorf("%q: handler got body %q", c.body, got)
+		}
+	}
+}
+
+func TestBodyLimitAuthGate(t *testing.T) {
+	_, sk, err := ed25519.GenerateKey(nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := signer.New(sk)
+	h := BodyLimitGate(AuthGate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), auth.Relay), 8)
+
+	for body, code := range map[string]int{
+		"12345678":  http.StatusOK,
+		"123456789": http.StatusRequestEntityTooLarge,
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+
+		auth.SignBody(r.Header, auth.Relay, s, []byte(body))
+
+		// bodies of unknown length are only cut off while reading
+		r.ContentLength = -1
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		if w.Code != code {
+			t.Errorf("%q: expected %d, got %d: %s", body, code, w.Code, w.Body)
+		}
+	}
+}
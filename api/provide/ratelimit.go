@@ -0,0 +1,133 @@
+// Copyright (c) 2022 Wireleap
+
+package provide
+
+import (
+	"container/list"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/wireleap/common/api/auth"
+	"github.com/wireleap/common/api/status"
+	"github.com/wireleap/common/wlnet/ratelimit"
+)
+
+// DefaultRateLimitMaxKeys is the default maximum number of keys for which
+// RateLimitGate keeps state.
+const DefaultRateLimitMaxKeys = 10000
+
+// KeyFunc returns the key by which a request is rate limited.
+type KeyFunc func(r *http.Request) string
+
+// RemoteIPKey keys requests by the IP address of the client.
+func RemoteIPKey(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+// PubkeyKey returns a KeyFunc keying requests by the public key header of
+// component c (such as auth.Relay), so that clients sharing an address are
+// limited separately. Requests without the header are keyed by the IP
+// address of the client.
+func PubkeyKey(c string) KeyFunc {
+	return func(r *http.Request) string {
+		if pk := auth.GetHeader(r.Header, c, auth.Pubkey); pk != "" {
+			return "pk:" + pk
+		}
+
+		return "ip:" + RemoteIPKey(r)
+	}
+}
+
+// RateLimitOptions are the options of RateLimitGate.
+type RateLimitOptions struct {
+	// Every is the interval at which a key gains another request.
+	Every time.Duration
+	// Burst is the number of requests a key can make at once. If not
+	// positive, it is set to 1.
+	Burst int64
+	// Key returns the key of a request. If nil, RemoteIPKey is used.
+	Key KeyFunc
+	// MaxKeys is the maximum number of keys for which state is kept. When
+	// it is reached, the least recently seen key is forgotten. If zero,
+	// DefaultRateLimitMaxKeys is used.
+	MaxKeys int
+}
+
+// rateLimiter keeps a token bucket per key, evicting the least recently used
+// ones to bound memory use.
+type rateLimiter struct {
+	o RateLimitOptions
+
+	mu sync.Mutex
+	ll *list.List
+	m  map[string]*list.Element
+}
+
+// rateEntry is an element of rateLimiter.ll.
+type rateEntry struct {
+	key string
+	b   *ratelimit.Bucket
+}
+
+// bucket returns the bucket for key, creating it if needed.
+func (l *rateLimiter) bucket(key string) *ratelimit.Bucket {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if e, ok := l.m[key]; ok {
+		l.ll.MoveToFront(e)
+		return e.Value.(*rateEntry).b
+	}
+
+	if l.ll.Len() >= l.o.MaxKeys {
+		e := l.ll.Back()
+		l.ll.Remove(e)
+		delete(l.m, e.Value.(*rateEntry).key)
+	}
+
+	b := ratelimit.NewBucketEvery(l.o.Every, l.o.Burst)
+	l.m[key] = l.ll.PushFront(&rateEntry{key: key, b: b})
+	return b
+}
+
+// RateLimitGate limits the rate of requests to targetMux per key as
+// configured by o. Requests exceeding the limit are refused with
+// status.ErrTooManyRequests and a Retry-After header.
+func RateLimitGate(targetMux http.Handler, o RateLimitOptions) http.Handler {
+	if o.Key == nil {
+		o.Key = RemoteIPKey
+	}
+
+	if o.MaxKeys <= 0 {
+		o.MaxKeys = DefaultRateLimitMaxKeys
+	}
+
+	l := &rateLimiter{o: o, ll: list.New(), m: map[string]*list.Element{}}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ok, wait := l.bucket(o.Key(r)).Take(1)
+
+		if !ok {
+			// round up so clients retrying on time are not refused again
+			secs := int64((wait + time.Second - 1) / time.Second)
+
+			w.Header().Set("Retry-After", strconv.FormatInt(secs, 10))
+			status.ErrTooManyRequests.Wrap(fmt.Errorf(
+				"too many requests, retry after %d seconds", secs,
+			)).WriteTo(w)
+			return
+		}
+
+		targetMux.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,94 @@
+// Copyright (c) 2022 Wireleap
+
+package provide
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/wireleap/common/api/auth"
+)
+
+func TestRateLimitGate(t *testing.T) {
+	h := RateLimitGate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), RateLimitOptions{
+		Every: 100 * time.Millisecond,
+		Burst: 2,
+	})
+
+	do := func(remote string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = remote
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	for i := 0; i < 2; i++ {
+		if w := do("192.0.2.1:1000"); w.Code != http.StatusOK {
+			t.Fatalf("request %d: expected burst to allow it, got %d", i, w.Code)
+		}
+	}
+
+	// the port does not matter
+	w := do("192.0.2.1:2000")
+
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429, got %d", w.Code)
+	}
+
+	// 100ms are rounded up
+	if ra := w.Header().Get("Retry-After"); ra != "1" {
+		t.Fatalf("expected Retry-After of 1 second, got %q", ra)
+	}
+
+	// other keys are unaffected
+	if w = do("192.0.2.2:1000"); w.Code != http.StatusOK {
+		t.Fatalf("expected other address to be allowed, got %d", w.Code)
+	}
+
+	// refill over time
+	time.Sleep(120 * time.Millisecond)
+
+	if w = do("192.0.2.1:1000"); w.Code != http.StatusOK {
+		t.Fatalf("expected refilled bucket to allow request, got %d", w.Code)
+	}
+}
+
+func TestRateLimitGateKeys(t *testing.T) {
+	h := RateLimitGate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), RateLimitOptions{
+		Every:   time.Hour,
+		Key:     PubkeyKey(auth.Relay),
+		MaxKeys: 2,
+	})
+
+	do := func(pk string) int {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = "192.0.2.1:1000"
+
+		if pk != "" {
+			auth.SetHeader(r.Header, auth.Relay, auth.Pubkey, pk)
+		}
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	// clients sharing an address are limited separately by public key
+	for _, pk := range []string{"a", "b", ""} {
+		if c := do(pk); c != http.StatusOK {
+			t.Fatalf("%q: expected first request to be allowed, got %d", pk, c)
+		}
+
+		if c := do(pk); c != http.StatusTooManyRequests {
+			t.Fatalf("%q: expected second request to be refused, got %d", pk, c)
+		}
+	}
+
+	// the least recently seen key was forgotten
+	if c := do("a"); c != http.StatusOK {
+		t.Fatalf("expected evicted key to start over, got %d", c)
+	}
+}
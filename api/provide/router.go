@@ -0,0 +1,274 @@
+// Copyright (c) 2022 Wireleap
+
+package provide
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/wireleap/common/api/interfaces"
+	"github.com/wireleap/common/api/status"
+)
+
+// Gate wraps a handler, such as AuthGate or VersionGate do.
+type Gate func(http.Handler) http.Handler
+
+// Auth returns a Gate checking request signatures of components using
+// AuthGate.
+func Auth(components ...string) Gate {
+	return func(h http.Handler) http.Handler { return AuthGate(h, components...) }
+}
+
+// Version returns a Gate checking and setting the version headers of is
+// using VersionGate.
+func Version(is ...interfaces.T) Gate {
+	return func(h http.Handler) http.Handler { return VersionGate(h, is...) }
+}
+
+// segment kinds in increasing order of generality, which is also the order
+// of precedence when several routes match
+const (
+	literal = iota
+	param
+	wildcard
+)
+
+// segment is a single path segment of a route pattern.
+type segment struct {
+	kind int
+	// s is the literal or the parameter name
+	s string
+}
+
+// route is a route registered with a Router.
+type route struct {
+	pattern string
+	segs    []segment
+	methods []string
+	h       Routes
+}
+
+// RouteInfo describes a route of a Router.
+type RouteInfo struct {
+	// Pattern is the path pattern of the route.
+	Pattern string
+	// Methods are the HTTP methods supported by the route in sorted order.
+	Methods []string
+}
+
+// Router is a HTTP request router supporting path parameters. Patterns are
+// paths where a segment of the form {name} matches any single non-empty
+// segment and a final segment of the form {name...} matches the rest of the
+// path, including slashes. When several patterns match, the one with a
+// literal segment where the others have a parameter takes precedence.
+type Router struct {
+	routes []*route
+}
+
+// NewRouter creates a new empty Router.
+func NewRouter() *Router { return &Router{} }
+
+// parsePattern splits the pattern p into segments.
+func parsePattern(p string) ([]segment, error) {
+	if !strings.HasPrefix(p, "/") {
+		return nil, fmt.Errorf("pattern %q does not start with /", p)
+	}
+
+	parts := strings.Split(p[1:], "/")
+	segs := make([]segment, len(parts))
+
+	for i, s := range parts {
+		if !strings.HasPrefix(s, "{") || !strings.HasSuffix(s, "}") {
+			segs[i] = segment{kind: literal, s: s}
+			continue
+		}
+
+		name := s[1 : len(s)-1]
+		kind := param
+
+		if strings.HasSuffix(name, "...") {
+			if i != len(parts)-1 {
+				return nil, fmt.Errorf("pattern %q has a wildcard which is not the last segment", p)
+			}
+
+			name, kind = strings.TrimSuffix(name, "..."), wildcard
+		}
+
+		if name == "" {
+			return nil, fmt.Errorf("pattern %q has an unnamed parameter", p)
+		}
+
+		segs[i] = segment{kind: kind, s: name}
+	}
+
+	return segs, nil
+}
+
+// before returns whether route a takes precedence over route b.
+func before(a, b *route) bool {
+	for i := 0; i < len(a.segs) && i < len(b.segs); i++ {
+		if a.segs[i].kind != b.segs[i].kind {
+			return a.segs[i].kind < b.segs[i].kind
+		}
+	}
+
+	return len(a.segs) > len(b.segs)
+}
+
+// Handle registers the handlers in m, keyed by HTTP method, for requests
+// with paths matching pattern. The handlers are wrapped in gates, the first
+// gate being the outermost one. It panics if pattern is invalid or has been
+// registered already.
+func (rt *Router) Handle(pattern string, m Routes, gates ...Gate) {
+	segs, err := parsePattern(pattern)
+
+	if err != nil {
+		panic(err)
+	}
+
+	for _, r2 := range rt.routes {
+		if r2.pattern == pattern {
+			panic(fmt.Sprintf("pattern %q registered twice", pattern))
+		}
+	}
+
+	r := &route{pattern: pattern, segs: segs, h: Routes{}}
+
+	for meth, h := range m {
+		for i := len(gates) - 1; i >= 0; i-- {
+			h = gates[i](h)
+		}
+
+		r.h[meth] = h
+		r.methods = append(r.methods, meth)
+	}
+
+	sort.Strings(r.methods)
+	rt.routes = append(rt.routes, r)
+	sort.SliceStable(rt.routes, func(i, j int) bool { return before(rt.routes[i], rt.routes[j]) })
+}
+
+// Routes returns descriptions of the routes of rt in order of precedence.
+func (rt *Router) Routes() []RouteInfo {
+	ris := make([]RouteInfo, len(rt.routes))
+
+	for i, r := range rt.routes {
+		ris[i] = RouteInfo{Pattern: r.pattern, Methods: append([]string(nil), r.methods...)}
+	}
+
+	return ris
+}
+
+// match returns the parameters of path if it matches r.
+func (r *route) match(parts []string) (map[string]string, bool) {
+	var ps map[string]string
+
+	for i, s := range r.segs {
+		if i >= len(parts) {
+			return nil, false
+		}
+
+		switch s.kind {
+		case literal:
+			if parts[i] != s.s {
+				return nil, false
+			}
+
+			continue
+		case param:
+			if parts[i] == "" {
+				return nil, false
+			}
+		}
+
+		if ps == nil {
+			ps = map[string]string{}
+		}
+
+		if s.kind == wildcard {
+			ps[s.s] = strings.Join(parts[i:], "/")
+			return ps, true
+		}
+
+		ps[s.s] = parts[i]
+	}
+
+	return ps, len(parts) == len(r.segs)
+}
+
+// routeKey is the context key of the matched route and its parameters.
+type routeKey struct{}
+
+// routeMatch is the matched route of a request.
+type routeMatch struct {
+	pattern string
+	params  map[string]string
+}
+
+// Param returns the value of the path parameter name of r, or "" if r has
+// no such parameter.
+func Param(r *http.Request, name string) string {
+	m, _ := r.Context().Value(routeKey{}).(*routeMatch)
+
+	if m == nil {
+		return ""
+	}
+
+	return m.params[name]
+}
+
+// Pattern returns the pattern of the route matching r, or "" if r was not
+// routed by a Router. As opposed to the request path, it is suitable as a
+// metrics label.
+func Pattern(r *http.Request) string {
+	m, _ := r.Context().Value(routeKey{}).(*routeMatch)
+
+	if m == nil {
+		return ""
+	}
+
+	return m.pattern
+}
+
+// ServeHTTP dispatches the request to the handler of the matching route and
+// method. If no route matches, status.ErrNotFound is returned. If the route
+// does not support the method, status.ErrMethod is returned along with an
+// Allow header listing the supported ones.
+func (rt *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.EscapedPath(), "/"), "/")
+
+	for i, p := range parts {
+		if up, err := url.PathUnescape(p); err == nil {
+			parts[i] = up
+		}
+	}
+
+	for _, rte := range rt.routes {
+		ps, ok := rte.match(parts)
+
+		if !ok {
+			continue
+		}
+
+		h := rte.h[r.Method]
+
+		if h == nil {
+			w.Header().Set("Allow", strings.Join(rte.methods, ", "))
+			status.ErrMethod.Wrap(fmt.Errorf(
+				"request uses unsupported HTTP method '%s', supported methods are: %s",
+				r.Method, strings.Join(rte.methods, ", "),
+			)).WriteTo(w)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), routeKey{}, &routeMatch{pattern: rte.pattern, params: ps})
+		h.ServeHTTP(w, r.WithContext(ctx))
+		return
+	}
+
+	status.ErrNotFound.WriteTo(w)
+}
@@ -0,0 +1,115 @@
+// Copyright (c) 2022 Wireleap
+
+package provide
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// echoRoute returns a handler writing the pattern of the matched route and
+// the values of the parameters names.
+func echoRoute(names ...string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(Pattern(r)))
+
+		for _, n := range names {
+			w.Write([]byte(" " + n + "=" + Param(r, n)))
+		}
+	})
+}
+
+func TestRouter(t *testing.T) {
+	gate := func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Gate", w.Header().Get("X-Gate")+"a")
+			h.ServeHTTP(w, r)
+		})
+	}
+	gate2 := func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Gate", w.Header().Get("X-Gate")+"b")
+			h.ServeHTTP(w, r)
+		})
+	}
+
+	rt := NewRouter()
+	rt.Handle("/files/{path...}", Routes{http.MethodGet: echoRoute("path")})
+	rt.Handle("/relays/{id}", Routes{
+		http.MethodGet:    echoRoute("id"),
+		http.MethodDelete: echoRoute("id"),
+		http.MethodPut:    echoRoute("id"),
+	}, gate, gate2)
+	rt.Handle("/relays/snapshot", Routes{http.MethodGet: echoRoute()})
+	rt.Handle("/relays/{id}/{field}", Routes{http.MethodGet: echoRoute("id", "field")})
+
+	for _, c := range []struct {
+		method, path string
+		code         int
+		body, allow  string
+		gate         string
+	}{
+		{"GET", "/relays/abc", 200, "/relays/{id} id=abc", "", "ab"},
+		{"GET", "/relays/a%2Fb", 200, "/relays/{id} id=a/b", "", "ab"},
+		{"GET", "/relays/snapshot", 200, "/relays/snapshot", "", ""},
+		{"GET", "/relays/abc/role", 200, "/relays/{id}/{field} id=abc field=role", "", ""},
+		{"GET", "/files/a/b/c.txt", 200, "/files/{path...} path=a/b/c.txt", "", ""},
+		{"GET", "/files/", 200, "/files/{path...} path=", "", ""},
+		{"GET", "/relays/", 404, "", "", ""},
+		{"GET", "/relays", 404, "", "", ""},
+		{"GET", "/nope", 404, "", "", ""},
+		{"GET", "/relays/abc/role/x", 404, "", "", ""},
+		{"POST", "/relays/abc", 405, "", "DELETE, GET, PUT", ""},
+		{"POST", "/relays/snapshot", 405, "", "GET", ""},
+	} {
+		w := httptest.NewRecorder()
+		rt.ServeHTTP(w, httptest.NewRequest(c.method, c.path, nil))
+
+		if w.Code != c.code {
+			t.Errorf("%s %s: expected %d, got %d", c.method, c.path, c.code, w.Code)
+			continue
+		}
+
+		if c.code == 200 && w.Body.String() != c.body {
+			t.Errorf("%s %s: expected body %q, got %q", c.method, c.path, c.body, w.Body.String())
+		}
+
+		if a := w.Header().Get("Allow"); a != c.allow {
+			t.Errorf("%s %s: expected Allow %q, got %q", c.method, c.path, c.allow, a)
+		}
+
+		if g := w.Header().Get("X-Gate"); g != c.gate {
+			t.Errorf("%s %s: expected gates %q, got %q", c.method, c.path, c.gate, g)
+		}
+	}
+
+	exp := []RouteInfo{
+		{"/relays/snapshot", []string{"GET"}},
+		{"/relays/{id}/{field}", []string{"GET"}},
+		{"/relays/{id}", []string{"DELETE", "GET", "PUT"}},
+		{"/files/{path...}", []string{"GET"}},
+	}
+
+	if ris := rt.Routes(); !reflect.DeepEqual(ris, exp) {
+		t.Fatalf("expected routes %+v, got %+v", exp, ris)
+	}
+}
+
+func TestRouterPanics(t *testing.T) {
+	for _, p := range []string{"relays", "/{path...}/x", "/{}", "/dup"} {
+		func() {
+			rt := NewRouter()
+			rt.Handle("/dup", Routes{})
+
+			defer func() {
+				if recover() == nil {
+					t.Errorf("expected %q to panic", p)
+				}
+			}()
+
+			rt.Handle(p, Routes{})
+		}()
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright (c) 2022 Wireleap
+
+package relaylist
+
+import (
+	"sort"
+
+	"github.com/blang/semver"
+	"github.com/wireleap/common/api/relayentry"
+)
+
+// Diff describes the differences between two relay lists.
+type Diff struct {
+	// Added are the relays present only in the new list.
+	Added []*relayentry.T
+	// Removed are the relays present only in the old list.
+	Removed []*relayentry.T
+	// Changed are the relays present in both lists which differ.
+	Changed []*Change
+}
+
+// Change describes the differences between two entries of the same relay.
+type Change struct {
+	Old *relayentry.T
+	New *relayentry.T
+
+	// RoleChanged is true if the relay role changed.
+	RoleChanged bool
+	// AddrChanged is true if the relay address changed.
+	AddrChanged bool
+	// PubkeyChanged is true if the relay public key changed.
+	PubkeyChanged bool
+	// VersionsChanged is true if any of the relay versions changed.
+	VersionsChanged bool
+	// ChannelChanged is true if the relay upgrade channel changed.
+	ChannelChanged bool
+}
+
+// Compare returns the differences between the relay lists prev and next.
+// Entries are matched by their key in the relay list and the results are
+// sorted by key.
+func Compare(prev, next T) (d *Diff) {
+	d = &Diff{}
+
+	for _, k := range sortedKeys(prev) {
+		if _, ok := next[k]; !ok {
+			d.Removed = append(d.Removed, prev[k])
+		}
+	}
+
+	for _, k := range sortedKeys(next) {
+		r0, ok := prev[k]
+
+		if !ok {
+			d.Added = append(d.Added, next[k])
+			continue
+		}
+
+		if c := compareEntries(r0, next[k]); c != nil {
+			d.Changed = append(d.Changed, c)
+		}
+	}
+
+	return
+}
+
+// Empty returns whether there are no differences.
+func (d *Diff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// compareEntries returns the changes between r0 and r1 or nil if there are
+// none.
+func compareEntries(r0, r1 *relayentry.T) *Change {
+	if r0 == nil || r1 == nil {
+		if r0 == r1 {
+			return nil
+		}
+
+		return &Change{Old: r0, New: r1}
+	}
+
+	c := &Change{
+		Old:             r0,
+		New:             r1,
+		RoleChanged:     r0.Role != r1.Role,
+		AddrChanged:     r0.Addr.String() != r1.Addr.String(),
+		PubkeyChanged:   r0.Pubkey.String() != r1.Pubkey.String(),
+		VersionsChanged: !versionsEqual(&r0.Versions, &r1.Versions),
+		ChannelChanged:  r0.UpgradeChannel != r1.UpgradeChannel || r0.Channel != r1.Channel,
+	}
+
+	if c.RoleChanged || c.AddrChanged || c.PubkeyChanged || c.VersionsChanged || c.ChannelChanged {
+		return c
+	}
+
+	return nil
+}
+
+// versionsEqual returns whether all versions in v0 and v1 are equal.
+func versionsEqual(v0, v1 *relayentry.Versions) bool {
+	eq := func(a, b *semver.Version) bool {
+		if a == nil || b == nil {
+			return a == b
+		}
+
+		return a.Equals(*b)
+	}
+
+	return eq(v0.Software, v1.Software) &&
+		eq(v0.ClientRelay, v1.ClientRelay) &&
+		eq(v0.RelayRelay, v1.RelayRelay) &&
+		eq(v0.RelayDir, v1.RelayDir) &&
+		eq(v0.RelayContract, v1.RelayContract)
+}
+
+// sortedKeys returns the keys of t in sorted order.
+func sortedKeys(t T) (ks []string) {
+	for k := range t {
+		ks = append(ks, k)
+	}
+
+	sort.Strings(ks)
+	return
+}
@@ -2,7 +2,13 @@
 
 package relaylist
 
-import "github.com/wireleap/common/api/relayentry"
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+
+	"github.com/wireleap/common/api/relayentry"
+)
 
 type T map[string]*relayentry.T
 
@@ -13,3 +19,16 @@ func (t T) All() (rs []*relayentry.T) {
 	}
 	return
 }
+
+// Hash returns the SHA-256 hash of the JSON encoding of t. Since map keys are
+// sorted when encoding, equal relay lists have equal hashes.
+func (t T) Hash() ([]byte, error) {
+	b, err := json.Marshal(t)
+
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal relay list: %w", err)
+	}
+
+	sum := sha256.Sum256(b)
+	return sum[:], nil
+}
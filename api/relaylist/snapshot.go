@@ -0,0 +1,183 @@
+// Copyright (c) 2022 Wireleap
+
+package relaylist
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wireleap/common/api/jsonb"
+	"github.com/wireleap/common/api/signer"
+)
+
+// MaxClockSkew is the maximum amount of time a snapshot timestamp can be in
+// the future and still be considered fresh.
+const MaxClockSkew = 5 * time.Minute
+
+// Snapshot is a versioned, timestamped relay list signed by the directory.
+// Its JSON encoding is suitable for persisting the last known good relay
+// list to disk (e.g. with fsdir).
+type Snapshot struct {
+	// Version is the serial number of this snapshot which is incremented by
+	// the directory on every change of the relay list.
+	Version int64 `json:"version"`
+	// Timestamp is the unix time at which this snapshot was created.
+	Timestamp int64 `json:"timestamp"`
+	// Relays is the relay list itself.
+	Relays T `json:"relays"`
+	// PublicKey is the public key of the directory which signed this
+	// snapshot.
+	PublicKey jsonb.PK `json:"public_key,omitempty"`
+	// Signature is the signature of this snapshot's digest.
+	Signature jsonb.B `json:"signature,omitempty"`
+}
+
+// NewSnapshot creates a new unsigned snapshot of rl with the given version
+// and the current time as timestamp.
+func NewSnapshot(version int64, rl T) *Snapshot {
+	return &Snapshot{
+		Version:   version,
+		Timestamp: time.Now().Unix(),
+		Relays:    rl,
+	}
+}
+
+// Digest returns the string which is signed to produce the snapshot
+// signature. The relay list is included by its SHA-256 hash.
+func (s *Snapshot) Digest() (string, error) {
+	h, err := s.Relays.Hash()
+
+	if err != nil {
+		return "", err
+	}
+
+	return strings.Join([]string{
+		strconv.FormatInt(s.Version, 10),
+		strconv.FormatInt(s.Timestamp, 10),
+		s.PublicKey.String(),
+		base64.RawURLEncoding.EncodeToString(h),
+	}, ":"), nil
+}
+
+// Sign signs the snapshot using sg.
+func (s *Snapshot) Sign(sg signer.Signer) error {
+	s.PublicKey = jsonb.PK(sg.Public())
+	d, err := s.Digest()
+
+	if err != nil {
+		return err
+	}
+
+	s.Signature = sg.Sign([]byte(d))
+	return nil
+}
+
+// Verify checks that the snapshot is signed by the public key it contains.
+func (s *Snapshot) Verify() error {
+	if len(s.PublicKey) != ed25519.PublicKeySize {
+		return fmt.Errorf("relay list snapshot public key is missing or invalid")
+	}
+
+	d, err := s.Digest()
+
+	if err != nil {
+		return err
+	}
+
+	if !ed25519.Verify(s.PublicKey.T(), []byte(d), s.Signature) {
+		return fmt.Errorf("relay list snapshot signature is invalid")
+	}
+
+	return nil
+}
+
+// VerifyBy checks that the snapshot is validly signed by pk.
+func (s *Snapshot) VerifyBy(pk ed25519.PublicKey) error {
+	if !bytes.Equal(s.PublicKey, pk) {
+		return fmt.Errorf(
+			"relay list snapshot is signed by %s, expected %s",
+			s.PublicKey, jsonb.PK(pk),
+		)
+	}
+
+	return s.Verify()
+}
+
+// IsFreshAt returns whether the snapshot is not older than maxage at the unix
+// time utime. Snapshots from the future (accounting for MaxClockSkew) are not
+// fresh.
+func (s *Snapshot) IsFreshAt(utime int64, maxage time.Duration) bool {
+	var (
+		t   = time.Unix(s.Timestamp, 0)
+		now = time.Unix(utime, 0)
+	)
+
+	return !t.After(now.Add(MaxClockSkew)) && t.Add(maxage).After(now)
+}
+
+// CheckSuccessor returns an error if next cannot replace s, that is, if it is
+// a rollback to an older version or a different relay list with the same
+// version. Re-signing the same relay list with a newer timestamp without
+// changing the version is allowed.
+func (s *Snapshot) CheckSuccessor(next *Snapshot) error {
+	switch {
+	case next.Version < s.Version:
+		return fmt.Errorf(
+			"relay list snapshot rollback: version %d is older than %d",
+			next.Version, s.Version,
+		)
+	case next.Timestamp < s.Timestamp:
+		return fmt.Errorf(
+			"relay list snapshot rollback: timestamp %d is older than %d",
+			next.Timestamp, s.Timestamp,
+		)
+	case next.Version == s.Version:
+		h0, err := s.Relays.Hash()
+
+		if err != nil {
+			return err
+		}
+
+		h1, err := next.Relays.Hash()
+
+		if err != nil {
+			return err
+		}
+
+		if !bytes.Equal(h0, h1) {
+			return fmt.Errorf(
+				"relay list snapshot version %d was seen with different contents",
+				next.Version,
+			)
+		}
+	}
+
+	return nil
+}
+
+// Accept checks that next is validly signed by pk, fresh at utime given
+// maxage and can replace s (which can be nil if there is no previous
+// snapshot).
+func (s *Snapshot) Accept(next *Snapshot, pk ed25519.PublicKey, utime int64, maxage time.Duration) error {
+	if err := next.VerifyBy(pk); err != nil {
+		return err
+	}
+
+	if !next.IsFreshAt(utime, maxage) {
+		return fmt.Errorf(
+			"relay list snapshot from %s is stale",
+			time.Unix(next.Timestamp, 0).UTC().Format(time.RFC3339),
+		)
+	}
+
+	if s != nil {
+		return s.CheckSuccessor(next)
+	}
+
+	return nil
+}
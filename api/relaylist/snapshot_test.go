@@ -0,0 +1,138 @@
+// Copyright (c) 2022 Wireleap
+
+package relaylist
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/blang/semver"
+	"github.com/wireleap/common/api/relayentry"
+	"github.com/wireleap/common/api/signer"
+	"github.com/wireleap/common/api/texturl"
+)
+
+func entry(role, addr, v string) *relayentry.T {
+	sv := semver.MustParse(v)
+	return &relayentry.T{
+		Role:     role,
+		Addr:     texturl.URLMustParse(addr),
+		Versions: relayentry.Versions{Software: &sv},
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	pk, sk, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := signer.New(sk)
+	rl := T{
+		"wireleap://a:443": entry("fronting", "wireleap://a:443", "0.1.0"),
+		"wireleap://b:443": entry("backing", "wireleap://b:443", "0.1.0"),
+	}
+	s0 := NewSnapshot(1, rl)
+
+	if err = s0.Sign(s); err != nil {
+		t.Fatal(err)
+	}
+
+	// survives a JSON roundtrip
+	b, err := json.Marshal(s0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s1 := &Snapshot{}
+	if err = json.Unmarshal(b, s1); err != nil {
+		t.Fatal(err)
+	}
+	if err = s1.VerifyBy(pk); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().Unix()
+
+	if err = (*Snapshot)(nil).Accept(s1, pk, now, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	// stale
+	if err = (*Snapshot)(nil).Accept(s1, pk, now+7200, time.Hour); err == nil {
+		t.Fatal("stale snapshot accepted")
+	}
+
+	// tampered
+	s1.Relays["wireleap://c:443"] = entry("backing", "wireleap://c:443", "0.1.0")
+	if err = s1.Verify(); err == nil {
+		t.Fatal("tampered snapshot passed as valid")
+	}
+
+	// wrong signer
+	pk2, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s0.VerifyBy(pk2); err == nil {
+		t.Fatal("snapshot signed by wrong key passed as valid")
+	}
+
+	// rollback
+	s2 := NewSnapshot(2, rl)
+	s2.Timestamp = s0.Timestamp
+	if err = s2.Sign(s); err != nil {
+		t.Fatal(err)
+	}
+	if err = s0.Accept(s2, pk, now, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err = s2.Accept(s0, pk, now, time.Hour); err == nil {
+		t.Fatal("rolled back snapshot accepted")
+	}
+
+	// same version, different contents
+	s3 := NewSnapshot(2, T{})
+	s3.Timestamp = s2.Timestamp
+	if err = s3.Sign(s); err != nil {
+		t.Fatal(err)
+	}
+	if err = s2.Accept(s3, pk, now, time.Hour); err == nil {
+		t.Fatal("conflicting snapshot accepted")
+	}
+}
+
+func TestCompare(t *testing.T) {
+	prev := T{
+		"a": entry("fronting", "wireleap://a:443", "0.1.0"),
+		"b": entry("entropic", "wireleap://b:443", "0.1.0"),
+		"c": entry("backing", "wireleap://c:443", "0.1.0"),
+	}
+	next := T{
+		"b": entry("backing", "wireleap://b:443", "0.1.0"),
+		"c": entry("backing", "wireleap://c:443", "0.2.0"),
+		"d": entry("backing", "wireleap://d:443", "0.1.0"),
+	}
+
+	d := Compare(prev, next)
+
+	if len(d.Added) != 1 || d.Added[0] != next["d"] {
+		t.Fatalf("unexpected added relays: %v", d.Added)
+	}
+	if len(d.Removed) != 1 || d.Removed[0] != prev["a"] {
+		t.Fatalf("unexpected removed relays: %v", d.Removed)
+	}
+	if len(d.Changed) != 2 {
+		t.Fatalf("unexpected changed relays: %v", d.Changed)
+	}
+	if c := d.Changed[0]; !c.RoleChanged || c.VersionsChanged {
+		t.Fatalf("unexpected change for b: %+v", c)
+	}
+	if c := d.Changed[1]; c.RoleChanged || !c.VersionsChanged {
+		t.Fatalf("unexpected change for c: %+v", c)
+	}
+	if !Compare(prev, prev).Empty() {
+		t.Fatal("relay list differs from itself")
+	}
+}
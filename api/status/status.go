@@ -8,6 +8,7 @@ import (
 	"errors"
 	"io"
 	"net/http"
+	"strings"
 )
 
 // T is an error-compatible type for reporting errors to the API client
@@ -84,6 +85,16 @@ var (
 		Code: http.StatusNotImplemented,
 		Desc: "feature not implemented yet",
 	}
+
+	ErrTooManyRequests = &T{
+		Code: http.StatusTooManyRequests,
+		Desc: "rate limit exceeded",
+	}
+
+	ErrTooLarge = &T{
+		Code: http.StatusRequestEntityTooLarge,
+		Desc: "request body too large",
+	}
 )
 
 func (t *T) Is(maybe error) bool {
@@ -140,6 +151,7 @@ const (
 	CauseContractPubkeyMismatch   Cause = "contract public key mismatch"
 	CausePaymentSystemUnreachable Cause = "payment system is unreachable or down, please try again later"
 	CauseBadEnrollmentKey         Cause = "enrollment key is incorrect"
+	CauseQuotaExceeded            Cause = "traffic quota exceeded"
 )
 
 var (
@@ -160,6 +172,7 @@ var (
 	ErrContractPubkeyMismatch   = ErrRequest.Wrap(CauseContractPubkeyMismatch)
 	ErrPaymentSystemUnreachable = ErrGateway.Wrap(CausePaymentSystemUnreachable)
 	ErrBadEnrollmentKey         = ErrRequest.Wrap(CauseBadEnrollmentKey)
+	ErrQuotaExceeded            = ErrTooManyRequests.Wrap(CauseQuotaExceeded)
 )
 
 func IsCircuitError(maybe error) bool {
@@ -180,7 +193,9 @@ func (t *T) WriteTo(w io.Writer) (int, error) {
 
 const Header = "wl-status"
 
-func (t *T) ToHeader(h http.Header) { h.Set(Header, t.Error()) }
+// ToHeader sets the status header in h to t. The trailing newline of the
+// JSON encoding is trimmed since it is not allowed in header values.
+func (t *T) ToHeader(h http.Header) { h.Set(Header, strings.TrimSuffix(t.Error(), "\n")) }
 
 func FromHeader(h http.Header) (*T, error) {
 	s := h.Get(Header)
@@ -0,0 +1,199 @@
+// Copyright (c) 2022 Wireleap
+
+// Package strictjson provides JSON decoding which rejects input the lenient
+// encoding/json defaults accept: unknown fields, duplicate object keys
+// (compared case-insensitively, as field names are) and data trailing the
+// value. Errors are returned as status.ErrRequest with a cause describing the
+// problem, so they can be written to API clients as-is.
+package strictjson
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/wireleap/common/api/status"
+)
+
+// Unmarshal decodes the JSON value in b into v strictly.
+func Unmarshal(b []byte, v interface{}) error {
+	if err := checkDuplicates(b); err != nil {
+		return status.ErrRequest.Wrap(err)
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+
+	if err := dec.Decode(v); err != nil {
+		return status.ErrRequest.Wrap(describe(err))
+	}
+
+	// anything but whitespace after the value is an error
+	if _, err := dec.Token(); err != io.EOF {
+		return status.ErrRequest.Wrap(fmt.Errorf(
+			"unexpected data after JSON value at offset %d", dec.InputOffset(),
+		))
+	}
+
+	return nil
+}
+
+// Decode reads r until EOF and decodes the JSON value read into v strictly.
+func Decode(r io.Reader, v interface{}) error {
+	b, err := ioutil.ReadAll(r)
+
+	if err != nil {
+		return status.ErrRequest.Wrap(fmt.Errorf("could not read JSON: %w", err))
+	}
+
+	return Unmarshal(b, v)
+}
+
+// describe returns a more precise error than the one returned by the
+// decoder where possible.
+func describe(err error) error {
+	var (
+		se *json.SyntaxError
+		te *json.UnmarshalTypeError
+	)
+
+	switch {
+	case errors.As(err, &se):
+		return fmt.Errorf("invalid JSON at offset %d: %s", se.Offset, se)
+	case errors.As(err, &te):
+		if te.Field != "" {
+			return fmt.Errorf("invalid value for field %q: expected %s, got JSON %s", te.Field, te.Type, te.Value)
+		}
+
+		return fmt.Errorf("invalid value: expected %s, got JSON %s", te.Type, te.Value)
+	case err == io.EOF:
+		return errors.New("empty JSON input")
+	case err == io.ErrUnexpectedEOF:
+		return errors.New("truncated JSON input")
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		return fmt.Errorf("unknown field %s", strings.TrimPrefix(err.Error(), "json: unknown field "))
+	}
+
+	return err
+}
+
+// frame is an object or array being walked by checkDuplicates.
+type frame struct {
+	path   string
+	keys   map[string]bool
+	index  int
+	inKey  bool
+	curKey string
+}
+
+// child returns the path of the next value in f.
+func (f *frame) child() string {
+	if f.keys != nil {
+		return f.path + "." + f.curKey
+	}
+
+	return f.path + "[" + strconv.Itoa(f.index) + "]"
+}
+
+// done marks the current value of f as complete.
+func (f *frame) done() {
+	if f.keys != nil {
+		f.inKey = true
+	} else {
+		f.index++
+	}
+}
+
+// fold returns the case-folded form of the object key k, such that keys
+// which encoding/json considers equal when matching field names fold to the
+// same string.
+func fold(k string) string { return strings.ToLower(strings.ToUpper(k)) }
+
+// checkDuplicates returns an error naming the path of the first duplicate
+// object key in b. Syntax errors are left to the actual decoding.
+func checkDuplicates(b []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+
+	var stack []*frame
+
+	// pop removes the innermost frame and returns whether the top-level
+	// value is complete
+	pop := func() bool {
+		stack = stack[:len(stack)-1]
+
+		if len(stack) == 0 {
+			return true
+		}
+
+		stack[len(stack)-1].done()
+		return false
+	}
+
+	for {
+		tok, err := dec.Token()
+
+		if err != nil {
+			return nil
+		}
+
+		var top *frame
+
+		if len(stack) > 0 {
+			top = stack[len(stack)-1]
+		}
+
+		switch {
+		case top != nil && top.keys != nil && top.inKey:
+			if tok == json.Delim('}') {
+				if pop() {
+					return nil
+				}
+
+				break
+			}
+
+			k, _ := tok.(string)
+
+			// encoding/json matches field names case-insensitively, so
+			// keys differing only in case would overwrite each other
+			fk := fold(k)
+
+			if top.keys[fk] {
+				return fmt.Errorf("duplicate key %q in object at %s", k, top.path)
+			}
+
+			top.keys[fk] = true
+			top.curKey = k
+			top.inKey = false
+		case tok == json.Delim(']'):
+			if pop() {
+				return nil
+			}
+		default:
+			path := "$"
+
+			if top != nil {
+				path = top.child()
+			}
+
+			switch tok {
+			case json.Delim('{'):
+				stack = append(stack, &frame{path: path, keys: map[string]bool{}, inKey: true})
+			case json.Delim('['):
+				stack = append(stack, &frame{path: path})
+			default:
+				if top == nil {
+					return nil
+				}
+
+				top.done()
+			}
+		}
+	}
+}
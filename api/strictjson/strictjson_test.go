@@ -0,0 +1,66 @@
+// Copyright (c) 2022 Wireleap
+
+package strictjson
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/wireleap/common/api/status"
+)
+
+type inner struct {
+	X int `json:"x"`
+}
+
+type outer struct {
+	A  string  `json:"a"`
+	In []inner `json:"in"`
+}
+
+func TestUnmarshal(t *testing.T) {
+	var v outer
+
+	if err := Unmarshal([]byte(`{"a":"b","in":[{"x":1},{"x":2}]} `), &v); err != nil {
+		t.Fatal(err)
+	}
+
+	if v.A != "b" || len(v.In) != 2 || v.In[1].X != 2 {
+		t.Fatalf("unexpected result %+v", v)
+	}
+
+	for _, c := range []struct{ in, cause string }{
+		{`{"a":"b","c":1}`, `unknown field "c"`},
+		{`{"a":"b","a":"c"}`, `duplicate key "a" in object at $`},
+		{`{"in":[{"x":1},{"x":1,"x":2}]}`, `duplicate key "x" in object at $.in[1]`},
+		{`{"a":"b","A":"c"}`, `duplicate key "A" in object at $`},
+		{`{"in":[{"x":1,"X":2}]}`, `duplicate key "X" in object at $.in[0]`},
+		{`{"a":"b"} {}`, "unexpected data after JSON value"},
+		{`{"a":1}`, `invalid value for field "a"`},
+		{`{"a":`, "truncated JSON input"},
+		{``, "empty JSON input"},
+		{`{"a" "b"}`, "invalid JSON at offset"},
+	} {
+		err := Unmarshal([]byte(c.in), &outer{})
+
+		var st *status.T
+
+		if !errors.As(err, &st) || st.Code != status.ErrRequest.Code {
+			t.Errorf("%s: expected status.ErrRequest, got %v", c.in, err)
+			continue
+		}
+
+		if !strings.Contains(string(st.Cause), c.cause) {
+			t.Errorf("%s: expected cause containing %q, got %q", c.in, c.cause, st.Cause)
+		}
+	}
+}
+
+func TestDecode(t *testing.T) {
+	var v outer
+
+	if err := Decode(strings.NewReader(`{"a":"b"}`), &v); err != nil || v.A != "b" {
+		t.Fatalf("unexpected result %+v, %v", v, err)
+	}
+}
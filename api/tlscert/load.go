@@ -0,0 +1,111 @@
+// Copyright (c) 2022 Wireleap
+
+package tlscert
+
+import (
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Validity errors.
+var (
+	ErrExpired     = errors.New("certificate has expired")
+	ErrNotYetValid = errors.New("certificate is not yet valid")
+)
+
+// CheckValidity checks whether cert is valid at time t and returns
+// ErrExpired or ErrNotYetValid (wrapped) if not.
+func CheckValidity(cert *x509.Certificate, t time.Time) error {
+	switch {
+	case t.Before(cert.NotBefore):
+		return fmt.Errorf("%w: valid from %s", ErrNotYetValid, cert.NotBefore.Format(time.RFC3339))
+	case t.After(cert.NotAfter):
+		return fmt.Errorf("%w: valid until %s", ErrExpired, cert.NotAfter.Format(time.RFC3339))
+	}
+
+	return nil
+}
+
+// leaf returns the parsed leaf certificate of c.
+func leaf(c *tls.Certificate) (*x509.Certificate, error) {
+	if c.Leaf != nil {
+		return c.Leaf, nil
+	}
+
+	if len(c.Certificate) == 0 {
+		return nil, fmt.Errorf("no certificates found")
+	}
+
+	return x509.ParseCertificate(c.Certificate[0])
+}
+
+// Load loads the PEM certificate and private key pair stored at certPath and
+// keyPath, checking that they match and that the certificate is currently
+// valid. The returned certificate has its Leaf field set.
+func Load(certPath, keyPath string) (tls.Certificate, error) {
+	c, err := tls.LoadX509KeyPair(certPath, keyPath)
+
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("could not load certificate %s: %w", certPath, err)
+	}
+
+	if c.Leaf, err = leaf(&c); err != nil {
+		return tls.Certificate{}, fmt.Errorf("could not parse certificate %s: %w", certPath, err)
+	}
+
+	if err = CheckValidity(c.Leaf, time.Now()); err != nil {
+		return tls.Certificate{}, fmt.Errorf("invalid certificate %s: %w", certPath, err)
+	}
+
+	return c, nil
+}
+
+// ExpiresWithin returns whether the certificate c expires within d from now
+// (or has expired already).
+func ExpiresWithin(c *tls.Certificate, d time.Duration) (bool, error) {
+	l, err := leaf(c)
+
+	if err != nil {
+		return false, err
+	}
+
+	return time.Now().Add(d).After(l.NotAfter), nil
+}
+
+// Renew generates a new certificate for privkey at certPath and keyPath using
+// GenerateWith if there is no valid certificate pair there or if the stored
+// certificate expires within before or is not for privkey. It returns
+// whether a new certificate was generated.
+func Renew(certPath, keyPath string, privkey crypto.Signer, o Options, before time.Duration) (renewed bool, err error) {
+	c, err := Load(certPath, keyPath)
+
+	switch {
+	case err == nil:
+		var expiring bool
+
+		if expiring, err = ExpiresWithin(&c, before); err != nil {
+			return false, err
+		}
+
+		pub, ok := c.Leaf.PublicKey.(interface{ Equal(crypto.PublicKey) bool })
+
+		if !expiring && ok && pub.Equal(privkey.Public()) {
+			return false, nil
+		}
+	case errors.Is(err, os.ErrNotExist), errors.Is(err, ErrExpired), errors.Is(err, ErrNotYetValid):
+	default:
+		// do not overwrite files which could not be loaded for other reasons
+		return false, err
+	}
+
+	if err = GenerateWith(certPath, keyPath, privkey, o); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
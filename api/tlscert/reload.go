@@ -0,0 +1,140 @@
+// Copyright (c) 2022 Wireleap
+
+package tlscert
+
+import (
+	"crypto/tls"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultCheckInterval is the default interval between checks for changed
+// certificate files in Reloader.
+const DefaultCheckInterval = time.Minute
+
+// Reloader serves a certificate pair from files via GetCertificate and
+// reloads it when the files change, so that certificates can be rotated
+// without restarting servers.
+type Reloader struct {
+	// CertPath and KeyPath are the paths of the certificate pair.
+	CertPath, KeyPath string
+	// CheckInterval is the minimum interval between checks of the files for
+	// changes. If zero, DefaultCheckInterval is used.
+	CheckInterval time.Duration
+	// ErrorLog is called with errors encountered while reloading, if set.
+	// The previous certificate keeps being served in that case.
+	ErrorLog func(error)
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modtime time.Time
+	checked time.Time
+}
+
+// NewReloader creates a new Reloader for the certificate pair at certPath
+// and keyPath, which is loaded immediately.
+func NewReloader(certPath, keyPath string) (*Reloader, error) {
+	r := &Reloader{CertPath: certPath, KeyPath: keyPath}
+
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// modtimes returns the latest modification time of the certificate pair
+// files.
+func (r *Reloader) modtimes() (time.Time, error) {
+	var t time.Time
+
+	for _, p := range []string{r.CertPath, r.KeyPath} {
+		fi, err := os.Stat(p)
+
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		if fi.ModTime().After(t) {
+			t = fi.ModTime()
+		}
+	}
+
+	return t, nil
+}
+
+// Reload loads the certificate pair unconditionally. If it fails, the
+// previously loaded certificate is kept.
+func (r *Reloader) Reload() error {
+	mt, err := r.modtimes()
+
+	if err != nil {
+		return err
+	}
+
+	c, err := Load(r.CertPath, r.KeyPath)
+
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	r.cert, r.modtime, r.checked = &c, mt, time.Now()
+	r.mu.Unlock()
+	return nil
+}
+
+// maybeReload reloads the certificate pair if the check interval has passed
+// and the files have changed since they were last loaded.
+func (r *Reloader) maybeReload() {
+	interval := r.CheckInterval
+
+	if interval == 0 {
+		interval = DefaultCheckInterval
+	}
+
+	r.mu.Lock()
+
+	if time.Since(r.checked) < interval {
+		r.mu.Unlock()
+		return
+	}
+
+	r.checked = time.Now()
+	last := r.modtime
+	r.mu.Unlock()
+
+	mt, err := r.modtimes()
+
+	if err == nil && mt.Equal(last) {
+		return
+	}
+
+	if err == nil {
+		err = r.Reload()
+	}
+
+	if err != nil && r.ErrorLog != nil {
+		r.ErrorLog(err)
+	}
+}
+
+// Certificate returns the currently loaded certificate.
+func (r *Reloader) Certificate() *tls.Certificate {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert
+}
+
+// GetCertificate is a function for tls.Config.GetCertificate serving the
+// current certificate.
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.maybeReload()
+	return r.Certificate(), nil
+}
+
+// TLSConfig returns a TLS server configuration using r for certificates.
+func (r *Reloader) TLSConfig() *tls.Config {
+	return &tls.Config{GetCertificate: r.GetCertificate, MinVersion: tls.VersionTLS13}
+}
@@ -5,78 +5,222 @@
 package tlscert
 
 import (
+	"crypto"
+	"crypto/ecdsa"
 	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
+	"errors"
+	"fmt"
 	"log"
 	"math/big"
+	"net"
 	"os"
+	"path/filepath"
 	"time"
 )
 
-// Generate generates a PEM TLS certificate and private key based on the ed25519 private key privkey. The certifate is stored at certPath and the key is stored at keyPath.
-func Generate(certPath, keyPath string, privkey ed25519.PrivateKey) error {
+// DefaultValidity is the validity period of generated certificates if none is
+// given.
+const DefaultValidity = 100 * (365 * (24 * time.Hour))
+
+// Algorithm is a private key algorithm supported by GenerateKey.
+type Algorithm string
+
+// Supported key algorithms.
+const (
+	Ed25519   Algorithm = "ed25519"
+	ECDSAP256 Algorithm = "ecdsa-p256"
+	RSA2048   Algorithm = "rsa-2048"
+)
+
+// GenerateKey generates a new private key using the algorithm a.
+func GenerateKey(a Algorithm) (crypto.Signer, error) {
+	switch a {
+	case Ed25519:
+		_, pk, err := ed25519.GenerateKey(rand.Reader)
+		return pk, err
+	case ECDSAP256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case RSA2048:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	default:
+		return nil, fmt.Errorf("unsupported key algorithm %q", a)
+	}
+}
+
+// Options are the options for generating certificates.
+type Options struct {
+	// DNSNames are the DNS subject alternative names of the certificate. If
+	// neither DNSNames nor IPAddresses are given, "wireleap.com" is used.
+	DNSNames []string
+	// IPAddresses are the IP subject alternative names of the certificate.
+	IPAddresses []net.IP
+	// Validity is the validity period of the certificate starting now. If
+	// zero, DefaultValidity is used.
+	Validity time.Duration
+}
+
+// create creates a DER-encoded self-signed TLS certificate and PKCS #8 private
+// key based on the private key privkey.
+func create(privkey crypto.Signer, o Options) (derBytes, privBytes []byte, err error) {
 	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
 	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
 
 	if err != nil {
-		return err
+		return
+	}
+
+	if o.Validity == 0 {
+		o.Validity = DefaultValidity
+	}
+
+	if len(o.DNSNames) == 0 && len(o.IPAddresses) == 0 {
+		o.DNSNames = []string{"wireleap.com"}
 	}
 
+	usage := x509.KeyUsageDigitalSignature
+
+	if _, ok := privkey.(*rsa.PrivateKey); ok {
+		usage |= x509.KeyUsageKeyEncipherment
+	}
+
+	now := time.Now()
 	template := x509.Certificate{
 		SerialNumber: serialNumber,
 		Subject: pkix.Name{
 			Organization: []string{"Wireleap"},
 		},
-		NotBefore:             time.Now(),
-		NotAfter:              time.Now().Add(100 * (365 * (24 * time.Hour))),
-		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		NotBefore:             now,
+		NotAfter:              now.Add(o.Validity),
+		KeyUsage:              usage,
 		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
 		BasicConstraintsValid: true,
-		DNSNames:              []string{"wireleap.com"},
+		DNSNames:              o.DNSNames,
+		IPAddresses:           o.IPAddresses,
 	}
 
-	derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, privkey.Public(), privkey)
+	derBytes, err = x509.CreateCertificate(rand.Reader, &template, &template, privkey.Public(), privkey)
 
 	if err != nil {
-		return err
+		return
 	}
 
-	privBytes, err := x509.MarshalPKCS8PrivateKey(privkey)
+	privBytes, err = x509.MarshalPKCS8PrivateKey(privkey)
+	return
+}
+
+// Certificate generates an in-memory TLS certificate the same way as
+// Generate.
+func Certificate(privkey ed25519.PrivateKey) (tls.Certificate, error) {
+	return New(privkey, Options{})
+}
+
+// New generates an in-memory self-signed TLS certificate for the ed25519,
+// ECDSA or RSA private key privkey.
+func New(privkey crypto.Signer, o Options) (tls.Certificate, error) {
+	derBytes, _, err := create(privkey, o)
 
 	if err != nil {
-		return err
+		return tls.Certificate{}, err
 	}
 
-	certOut, err := os.Create(certPath)
+	leaf, err := x509.ParseCertificate(derBytes)
 
 	if err != nil {
-		return err
+		return tls.Certificate{}, err
 	}
 
-	log.Println("Writing ed25519 certificate to", certPath)
+	return tls.Certificate{Certificate: [][]byte{derBytes}, PrivateKey: privkey, Leaf: leaf}, nil
+}
 
-	err = pem.Encode(certOut, &pem.Block{Type: "CERTIFICATE", Bytes: derBytes})
+// Generate generates a PEM TLS certificate and private key based on the ed25519 private key privkey. The certifate is stored at certPath and the key is stored at keyPath.
+func Generate(certPath, keyPath string, privkey ed25519.PrivateKey) error {
+	return GenerateWith(certPath, keyPath, privkey, Options{})
+}
+
+// GenerateWith is like Generate, but accepts ed25519, ECDSA and RSA private
+// keys and generation options. Both files are written atomically, so that a
+// concurrent Load never sees partially written files.
+func GenerateWith(certPath, keyPath string, privkey crypto.Signer, o Options) error {
+	derBytes, privBytes, err := create(privkey, o)
 
 	if err != nil {
 		return err
 	}
 
-	keyOut, err := os.OpenFile(keyPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	log.Println("Writing certificate to", certPath)
 
-	if err != nil {
+	if err = writePEM(certPath, "CERTIFICATE", derBytes, 0644); err != nil {
 		return err
 	}
 
-	log.Println("Writing ed25519 certificate key to", keyPath)
+	log.Println("Writing certificate key to", keyPath)
+	return writePEM(keyPath, "PRIVATE KEY", privBytes, 0600)
+}
 
-	err = pem.Encode(keyOut, &pem.Block{Type: "PRIVATE KEY", Bytes: privBytes})
+// writePEM atomically writes b as a PEM block of type typ to the file at path
+// with permissions perm.
+func writePEM(path, typ string, b []byte, perm os.FileMode) (err error) {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
 
 	if err != nil {
 		return err
 	}
 
-	return nil
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	if err = f.Chmod(perm); err != nil {
+		return err
+	}
+
+	if err = pem.Encode(f, &pem.Block{Type: typ, Bytes: b}); err != nil {
+		return err
+	}
+
+	if err = f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+// ErrPubkeyMismatch is returned by the function returned by VerifyPubkey if
+// the peer certificate does not match the expected public key.
+var ErrPubkeyMismatch = errors.New("peer certificate public key mismatch")
+
+// VerifyPubkey returns a function for tls.Config.VerifyPeerCertificate which
+// accepts only leaf certificates for the ed25519 public key pubkey, such as
+// those created by Generate or Certificate. Chains and hostnames are not
+// checked, so it should be used with InsecureSkipVerify set.
+func VerifyPubkey(pubkey ed25519.PublicKey) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return fmt.Errorf("no peer certificate presented")
+		}
+
+		cert, err := x509.ParseCertificate(rawCerts[0])
+
+		if err != nil {
+			return fmt.Errorf("could not parse peer certificate: %w", err)
+		}
+
+		pk, ok := cert.PublicKey.(ed25519.PublicKey)
+
+		if !ok || !pk.Equal(pubkey) {
+			return ErrPubkeyMismatch
+		}
+
+		return CheckValidity(cert, time.Now())
+	}
 }
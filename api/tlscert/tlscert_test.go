@@ -5,9 +5,12 @@ package tlscert
 import (
 	"crypto/ed25519"
 	"crypto/tls"
+	"errors"
+	"net"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 )
 
 func TestGenerate(t *testing.T) {
@@ -39,3 +42,203 @@ func TestGenerate(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestVerifyPubkey(t *testing.T) {
+	pub, pk, err := ed25519.GenerateKey(nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other, _, err := ed25519.GenerateKey(nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := Certificate(pk)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = VerifyPubkey(pub)(cert.Certificate, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = VerifyPubkey(other)(cert.Certificate, nil); !errors.Is(err, ErrPubkeyMismatch) {
+		t.Fatalf("expected pubkey mismatch, got %v", err)
+	}
+
+	if err = VerifyPubkey(pub)(nil, nil); err == nil {
+		t.Fatal("expected error without certificates")
+	}
+}
+
+func TestGenerateWith(t *testing.T) {
+	dir := t.TempDir()
+
+	for _, a := range []Algorithm{Ed25519, ECDSAP256, RSA2048} {
+		pk, err := GenerateKey(a)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cert := filepath.Join(dir, string(a)+".crt")
+		key := filepath.Join(dir, string(a)+".key")
+		o := Options{
+			DNSNames:    []string{"relay.example.com"},
+			IPAddresses: []net.IP{net.ParseIP("192.0.2.1")},
+			Validity:    time.Hour,
+		}
+
+		if err = GenerateWith(cert, key, pk, o); err != nil {
+			t.Fatal(err)
+		}
+
+		c, err := Load(cert, key)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err = c.Leaf.VerifyHostname("relay.example.com"); err != nil {
+			t.Error(err)
+		}
+
+		if err = c.Leaf.VerifyHostname("192.0.2.1"); err != nil {
+			t.Error(err)
+		}
+
+		if d := c.Leaf.NotAfter.Sub(c.Leaf.NotBefore); d != time.Hour {
+			t.Errorf("%s: expected validity of 1h, got %s", a, d)
+		}
+
+		if fi, err := os.Stat(key); err != nil || fi.Mode().Perm() != 0600 {
+			t.Errorf("%s: unexpected key file mode: %v, %v", a, fi.Mode(), err)
+		}
+	}
+
+	if _, err := GenerateKey("dsa"); err == nil {
+		t.Error("expected error for unsupported algorithm")
+	}
+}
+
+func TestLoadExpired(t *testing.T) {
+	dir := t.TempDir()
+	cert := filepath.Join(dir, "cert.pem")
+	key := filepath.Join(dir, "key.pem")
+	pk, err := GenerateKey(ECDSAP256)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = GenerateWith(cert, key, pk, Options{Validity: time.Nanosecond}); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Millisecond)
+
+	if _, err = Load(cert, key); !errors.Is(err, ErrExpired) {
+		t.Fatalf("expected expired error, got %v", err)
+	}
+
+	renewed, err := Renew(cert, key, pk, Options{Validity: time.Hour}, time.Minute)
+
+	if err != nil || !renewed {
+		t.Fatalf("expected renewal, got %v, %v", renewed, err)
+	}
+
+	// valid and not expiring soon
+	if renewed, err = Renew(cert, key, pk, Options{Validity: time.Hour}, time.Minute); err != nil || renewed {
+		t.Fatalf("expected no renewal, got %v, %v", renewed, err)
+	}
+
+	// expiring within the renewal period
+	if renewed, err = Renew(cert, key, pk, Options{Validity: time.Hour}, 2*time.Hour); err != nil || !renewed {
+		t.Fatalf("expected renewal, got %v, %v", renewed, err)
+	}
+
+	// different key
+	pk2, err := GenerateKey(Ed25519)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if renewed, err = Renew(cert, key, pk2, Options{Validity: time.Hour}, time.Minute); err != nil || !renewed {
+		t.Fatalf("expected renewal, got %v, %v", renewed, err)
+	}
+
+	// missing files
+	if renewed, err = Renew(filepath.Join(dir, "new.pem"), filepath.Join(dir, "new.key"), pk, Options{}, time.Minute); err != nil || !renewed {
+		t.Fatalf("expected renewal, got %v, %v", renewed, err)
+	}
+}
+
+func TestReloader(t *testing.T) {
+	dir := t.TempDir()
+	cert := filepath.Join(dir, "cert.pem")
+	key := filepath.Join(dir, "key.pem")
+	pk, err := GenerateKey(Ed25519)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = GenerateWith(cert, key, pk, Options{DNSNames: []string{"old.example.com"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewReloader(cert, key)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r.CheckInterval = time.Millisecond
+
+	var errs []error
+	r.ErrorLog = func(err error) { errs = append(errs, err) }
+
+	name := func() string {
+		c, err := r.GetCertificate(nil)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return c.Leaf.DNSNames[0]
+	}
+
+	if n := name(); n != "old.example.com" {
+		t.Fatalf("unexpected certificate for %s", n)
+	}
+
+	// broken files keep the old certificate
+	if err = os.WriteFile(cert, []byte("garbage"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	future := time.Now().Add(time.Second)
+	os.Chtimes(cert, future, future)
+	time.Sleep(2 * time.Millisecond)
+
+	if n := name(); n != "old.example.com" || len(errs) != 1 {
+		t.Fatalf("unexpected certificate for %s with errors %v", n, errs)
+	}
+
+	if err = GenerateWith(cert, key, pk, Options{DNSNames: []string{"new.example.com"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	future = future.Add(time.Second)
+	os.Chtimes(cert, future, future)
+	time.Sleep(2 * time.Millisecond)
+
+	if n := name(); n != "new.example.com" {
+		t.Fatalf("expected reloaded certificate, got one for %s", n)
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright (c) 2022 Wireleap
+
+package pingcmd
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/wireleap/common/api/client"
+	"github.com/wireleap/common/api/consume"
+	"github.com/wireleap/common/api/texturl"
+	"github.com/wireleap/common/cli"
+	"github.com/wireleap/common/cli/fsdir"
+	"github.com/wireleap/common/wlnet/probe"
+	"github.com/wireleap/common/wlnet/transport"
+)
+
+// Cmd returns the ping subcommand which pings all relays of a service
+// contract. The contract URL is given as argument or, if absent, obtained
+// from scf (which can be nil).
+func Cmd(arg0 string, scf func(fsdir.T) (*texturl.URL, error)) *cli.Subcmd {
+	fs := flag.NewFlagSet("ping", flag.ExitOnError)
+	timeout := fs.Duration("timeout", 10*time.Second, "Timeout for a single ping")
+	count := fs.Int("c", 1, "Number of pings per relay")
+
+	r := &cli.Subcmd{
+		FlagSet: fs,
+		Desc:    "Ping all relays of a service contract",
+		Sections: []cli.Section{{
+			Title: "Exit codes",
+			Entries: []cli.Entry{
+				{Key: "0", Value: "all relays replied"},
+				{Key: "1", Value: "some relays did not reply"},
+				{Key: "2", Value: "could not get the relay list"},
+			},
+		}},
+	}
+	r.Run = func(fm fsdir.T) {
+		var (
+			sc  *texturl.URL
+			err error
+		)
+
+		switch {
+		case fs.NArg() == 1:
+			var u *url.URL
+			if u, err = url.Parse(fs.Arg(0)); err == nil {
+				sc = &texturl.URL{URL: *u}
+			}
+		case fs.NArg() == 0 && scf != nil:
+			sc, err = scf(fm)
+		default:
+			log.Fatalf("which contract to ping? usage: `%s ping https://contract.example`", arg0)
+		}
+
+		if err == nil && sc == nil {
+			err = fmt.Errorf("no contract configured")
+		}
+
+		if err != nil {
+			log.Printf("could not get contract URL: %s", err)
+			os.Exit(2)
+		}
+
+		rl, err := consume.ContractRelays(client.New(nil), sc)
+
+		if err != nil {
+			log.Printf("could not get relays of %s: %s", sc, err)
+			os.Exit(2)
+		}
+
+		p := probe.New(
+			transport.New(transport.Options{Timeout: *timeout}),
+			probe.Options{Timeout: *timeout},
+		)
+
+		for i := 0; i < *count; i++ {
+			p.PingAll(context.Background(), rl)
+		}
+
+		ks := []string{}
+		for k := range rl {
+			ks = append(ks, k)
+		}
+		sort.Strings(ks)
+
+		var (
+			w      = tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+			status = 0
+		)
+
+		fmt.Fprintln(w, "ROLE\tADDRESS\tLATENCY\tFAILURES\tSTATUS")
+
+		for _, k := range ks {
+			h, _ := p.Health(rl[k])
+			res, lat := "OK", h.Latency.Round(time.Millisecond).String()
+
+			if h.LastErr != nil {
+				res, status = h.LastErr.Error(), 1
+			}
+
+			if h.Latency == 0 {
+				lat = "-"
+			}
+
+			fmt.Fprintf(
+				w, "%s\t%s\t%s\t%.0f%%\t%s\n",
+				rl[k].Role, rl[k].Addr, lat, h.FailRate*100, res,
+			)
+		}
+
+		w.Flush()
+		os.Exit(status)
+	}
+	return r
+}
@@ -10,7 +10,6 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -19,6 +18,7 @@ import (
 
 	"github.com/blang/semver"
 	"github.com/wireleap/common/cli/fsdir"
+	"github.com/wireleap/common/logger"
 	"golang.org/x/crypto/openpgp"
 	"golang.org/x/crypto/openpgp/clearsign"
 )
@@ -36,6 +36,10 @@ type Config struct {
 	interactive bool
 
 	skipversion *semver.Version
+
+	// Logger is the logger used for upgrades. If nil, logger.Default is
+	// used.
+	Logger logger.Logger
 }
 
 func NewConfig(fm fsdir.T, arg0 string, interactive bool) *Config {
@@ -59,7 +63,7 @@ func (u *Config) SkippedVersion() (v *semver.Version) {
 }
 
 func (u *Config) SkipVersion(v semver.Version) error {
-	log.Printf("Skipping version %s", v)
+	logger.OrDefault(u.Logger).Info("skipping version", "version", v)
 	return u.fm.SetIndented(v, SKIP_FILENAME)
 }
 
@@ -250,6 +254,7 @@ func (u *Config) Upgrade(ex Executor, v0, v1 semver.Version) (err error) {
 		Root:   u.fm,
 		SrcBin: newbinpath, DstBin: u.binpath,
 		SrcVer: v0, DstVer: v1,
+		Logger: u.Logger,
 	})
 }
 
@@ -4,13 +4,13 @@ package upgrade
 
 import (
 	"fmt"
-	"log"
 	"os"
 	"os/exec"
 
 	"github.com/blang/semver"
 	"github.com/wireleap/common/cli/fsdir"
 	"github.com/wireleap/common/cli/process"
+	"github.com/wireleap/common/logger"
 )
 
 func run(args ...string) (err error) {
@@ -28,26 +28,30 @@ type ExecutorArgs struct {
 	SrcBin, DstBin string
 	// Source and destination versions.
 	SrcVer, DstVer semver.Version
+	// Logger is the logger used by the executor. If nil, logger.Default is
+	// used.
+	Logger logger.Logger
 }
 
 type Executor func(ExecutorArgs) error
 
 func ExecutorSimple(ea ExecutorArgs) (err error) {
-	log.Printf("Running simple upgrade to %s...", ea.DstVer)
-	log.Printf("stopping %s if running...", ea.SrcBin)
+	l := logger.OrDefault(ea.Logger)
+	l.Info("running simple upgrade", "version", ea.DstVer)
+	l.Info("stopping binary if running", "binary", ea.SrcBin)
 	var (
 		pid     int
 		pidfile = ea.SrcBin + ".pid"
 		oldbin  = ea.DstBin + ".prev"
 	)
 	if err = ea.Root.Get(&pid, pidfile); err == nil && process.Exists(pid) {
-		log.Printf("found old %s, pid %d", ea.DstBin, pid)
+		l.Info("found old binary running", "binary", ea.DstBin, "pid", pid)
 		if err = run(ea.SrcBin, "stop"); err != nil {
 			err = fmt.Errorf("stopping old binary returned error: %s", err)
 			return
 		}
 	}
-	log.Printf("replacing %s with %s...", ea.DstBin, ea.SrcBin)
+	l.Info("replacing binary", "old", ea.DstBin, "new", ea.SrcBin)
 	if err = os.Rename(ea.DstBin, oldbin); err != nil {
 		err = fmt.Errorf("renaming %s -> %s failed: %w", ea.DstBin, oldbin, err)
 		return
@@ -65,7 +69,7 @@ func ExecutorSimple(ea ExecutorArgs) (err error) {
 func ExecutorSupervised(ea ExecutorArgs) (err error) {
 	// launch upgrade supervisor
 	// if all goes well this binary will actually be terminated before this will return
-	log.Printf("Running supervised upgrade to %s...", ea.DstVer)
+	logger.OrDefault(ea.Logger).Info("running supervised upgrade", "version", ea.DstVer)
 	cmd := exec.Command(ea.SrcBin, "supervise-upgrade", ea.SrcVer.String())
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
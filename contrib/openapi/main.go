@@ -0,0 +1,218 @@
+// Copyright (c) 2022 Wireleap
+
+// The openapi command writes OpenAPI descriptions of the service contract,
+// directory and payout APIs to the directory given by the -o flag. It is
+// run by go generate in the api package.
+//
+// The routes are taken from the routers of the testkit fakes, so that the
+// descriptions cannot drift from the served routes: every served route must
+// be described below and every described route must be served.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/wireleap/common/api/auth"
+	"github.com/wireleap/common/api/contractinfo"
+	"github.com/wireleap/common/api/dirinfo"
+	"github.com/wireleap/common/api/interfaces/clientcontract"
+	"github.com/wireleap/common/api/interfaces/clientdir"
+	"github.com/wireleap/common/api/interfaces/relaycontract"
+	"github.com/wireleap/common/api/openapi"
+	"github.com/wireleap/common/api/pof"
+	"github.com/wireleap/common/api/provide"
+	"github.com/wireleap/common/api/relayentry"
+	"github.com/wireleap/common/api/relaylist"
+	"github.com/wireleap/common/api/servicekey"
+	"github.com/wireleap/common/api/sharetoken"
+	"github.com/wireleap/common/api/status"
+	"github.com/wireleap/common/api/withdrawal"
+	"github.com/wireleap/common/api/withdrawalrequest"
+	"github.com/wireleap/common/testkit"
+)
+
+// testkitOnly are the routes served by the testkit fakes which are not part
+// of the API of the real services and are therefore not described.
+var testkitOnly = map[string]bool{
+	"GET /relays/snapshot": true,
+}
+
+// service is an API to describe.
+type service struct {
+	title, version string
+	// routes are the served routes.
+	routes []provide.RouteInfo
+	// ops describe the routes by method and pattern.
+	ops map[string]openapi.Op
+}
+
+// generate returns a generator of the description of s, or an error if
+// the served and described routes differ.
+func generate(s service) (*openapi.Generator, error) {
+	var (
+		ris  []provide.RouteInfo
+		seen = map[string]bool{}
+	)
+
+	for _, ri := range s.routes {
+		var ms []string
+
+		for _, m := range ri.Methods {
+			k := m + " " + ri.Pattern
+
+			if testkitOnly[k] {
+				continue
+			}
+
+			if _, ok := s.ops[k]; !ok {
+				return nil, fmt.Errorf("%s: route %s is not described", s.title, k)
+			}
+
+			seen[k] = true
+			ms = append(ms, m)
+		}
+
+		if len(ms) > 0 {
+			ris = append(ris, provide.RouteInfo{Pattern: ri.Pattern, Methods: ms})
+		}
+	}
+
+	for k := range s.ops {
+		if !seen[k] {
+			return nil, fmt.Errorf("%s: described route %s is not served", s.title, k)
+		}
+	}
+
+	g := openapi.New(s.title, s.version)
+	g.AddRoutes(ris, s.ops)
+	return g, nil
+}
+
+// services returns the APIs to describe by output file name.
+func services() (map[string]service, error) {
+	d, err := testkit.NewDirectory(nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	p := testkit.NewPayout(nil)
+	c, err := testkit.NewContract(nil, d, p)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]service{
+		"contract.json": {
+			title:   "Wireleap service contract API",
+			version: clientcontract.VERSION_STRING,
+			routes:  c.Routes(),
+			ops: map[string]openapi.Op{
+				"GET /info": {
+					Summary:  "Get the public service contract information",
+					Response: contractinfo.T{},
+				},
+				"POST /servicekey/activate": {
+					Summary:  "Activate a servicekey with a proof of funding",
+					Request:  pof.SKActivationRequest{},
+					Response: servicekey.Contract{},
+				},
+				"POST /sharetoken/submit": {
+					Summary:  "Submit a sharetoken for settlement",
+					Request:  sharetoken.T{},
+					Response: status.T{},
+					Auth:     []string{auth.Relay},
+				},
+			},
+		},
+		"directory.json": {
+			title:   "Wireleap directory API",
+			version: clientdir.VERSION_STRING,
+			routes:  d.Routes(),
+			ops: map[string]openapi.Op{
+				"GET /info": {
+					Summary:  "Get the public directory information",
+					Response: dirinfo.T{},
+				},
+				"GET /relays": {
+					Summary:  "Get the list of enrolled relays",
+					Response: relaylist.T{},
+				},
+				"POST /relays": {
+					Summary:  "Enroll a relay",
+					Request:  relayentry.T{},
+					Response: status.T{},
+					Auth:     []string{auth.Relay},
+				},
+			},
+		},
+		"payout.json": {
+			title:   "Wireleap payout API",
+			version: relaycontract.VERSION_STRING,
+			routes:  p.Routes(),
+			ops: map[string]openapi.Op{
+				"POST /withdrawals": {
+					Summary:  "Request a withdrawal of the relay balance",
+					Request:  withdrawalrequest.T{},
+					Response: withdrawal.T{},
+				},
+				"GET /withdrawals/{id}": {
+					Summary:  "Get the state of a withdrawal",
+					Response: withdrawal.T{},
+				},
+			},
+		},
+	}, nil
+}
+
+// documents returns the encoded descriptions by output file name.
+func documents() (map[string][]byte, error) {
+	ss, err := services()
+
+	if err != nil {
+		return nil, fmt.Errorf("could not create testkit fakes: %w", err)
+	}
+
+	docs := map[string][]byte{}
+
+	for name, s := range ss {
+		g, err := generate(s)
+
+		if err != nil {
+			return nil, err
+		}
+
+		b, err := json.MarshalIndent(g.Document(), "", "  ")
+
+		if err != nil {
+			return nil, fmt.Errorf("could not marshal %s: %w", name, err)
+		}
+
+		docs[name] = append(b, '\n')
+	}
+
+	return docs, nil
+}
+
+func main() {
+	out := flag.String("o", ".", "output directory")
+	flag.Parse()
+
+	docs, err := documents()
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for name, b := range docs {
+		if err = os.WriteFile(filepath.Join(*out, name), b, 0644); err != nil {
+			log.Fatalf("could not write %s: %s", name, err)
+		}
+	}
+}
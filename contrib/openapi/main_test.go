@@ -0,0 +1,56 @@
+// Copyright (c) 2022 Wireleap
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/wireleap/common/api/openapi"
+	"github.com/wireleap/common/api/provide"
+)
+
+func TestDocuments(t *testing.T) {
+	docs, err := documents()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, b := range docs {
+		b2, err := ioutil.ReadFile(filepath.Join("..", "..", "api", "openapi", name))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(b, b2) {
+			t.Errorf("%s is stale, run go generate in the api package", name)
+		}
+
+		if bytes.Contains(b, []byte("/relays/snapshot")) {
+			t.Errorf("%s describes a testkit-only route", name)
+		}
+	}
+}
+
+func TestGenerateDrift(t *testing.T) {
+	ris := []provide.RouteInfo{{Pattern: "/a", Methods: []string{"GET", "POST"}}}
+
+	for _, ops := range []map[string]openapi.Op{
+		{"GET /a": {}},
+		{"GET /a": {}, "POST /a": {}, "GET /b": {}},
+	} {
+		if _, err := generate(service{title: "test", routes: ris, ops: ops}); err == nil ||
+			!strings.Contains(err.Error(), "test: ") {
+			t.Errorf("%v: expected drift error, got %v", ops, err)
+		}
+	}
+
+	if _, err := generate(service{routes: ris, ops: map[string]openapi.Op{"GET /a": {}, "POST /a": {}}}); err != nil {
+		t.Errorf("unexpected error %s", err)
+	}
+}
@@ -0,0 +1,251 @@
+// Copyright (c) 2022 Wireleap
+
+// Package logger provides a small leveled, structured logging interface
+// along with text and JSON implementations and an adapter for the standard
+// library logger.
+package logger
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a log message.
+type Level int
+
+// Log levels in increasing order of severity.
+const (
+	DebugLevel Level = iota
+	InfoLevel
+	WarnLevel
+	ErrorLevel
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < DebugLevel || l > ErrorLevel {
+		return "level(" + strconv.Itoa(int(l)) + ")"
+	}
+
+	return levelNames[l]
+}
+
+// ParseLevel parses a level name as returned by Level.String.
+func ParseLevel(s string) (Level, error) {
+	for i, n := range levelNames {
+		if strings.EqualFold(s, n) {
+			return Level(i), nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown log level %q", s)
+}
+
+// Logger is a leveled, structured logger. Messages are accompanied by
+// alternating keys and values, keys being strings.
+type Logger interface {
+	Debug(msg string, kvs ...interface{})
+	Info(msg string, kvs ...interface{})
+	Warn(msg string, kvs ...interface{})
+	Error(msg string, kvs ...interface{})
+	// With returns a Logger adding kvs to every message.
+	With(kvs ...interface{}) Logger
+}
+
+// Func is a function implementing Logger.
+type Func func(lvl Level, msg string, kvs []interface{})
+
+func (f Func) Debug(msg string, kvs ...interface{}) { f(DebugLevel, msg, kvs) }
+func (f Func) Info(msg string, kvs ...interface{})  { f(InfoLevel, msg, kvs) }
+func (f Func) Warn(msg string, kvs ...interface{})  { f(WarnLevel, msg, kvs) }
+func (f Func) Error(msg string, kvs ...interface{}) { f(ErrorLevel, msg, kvs) }
+
+func (f Func) With(kvs ...interface{}) Logger {
+	kvs = kvs[:len(kvs):len(kvs)]
+
+	return Func(func(lvl Level, msg string, kvs2 []interface{}) {
+		f(lvl, msg, append(kvs, kvs2...))
+	})
+}
+
+// Std logs the messages followed by their key-value pairs, formatted as
+// key=value, using the standard library logger, which is the output of this
+// module before structured logging was introduced.
+var Std Logger = Func(func(_ Level, msg string, kvs []interface{}) {
+	var b bytes.Buffer
+
+	b.WriteString(msg)
+	writeKVs(&b, kvs)
+	log.Print(b.String())
+})
+
+// Discard discards all messages.
+var Discard Logger = Func(func(Level, string, []interface{}) {})
+
+// Default is the logger used when none is configured.
+var Default = Std
+
+// OrDefault returns l if it is not nil and Default otherwise.
+func OrDefault(l Logger) Logger {
+	if l == nil {
+		return Default
+	}
+
+	return l
+}
+
+type ctxKey struct{}
+
+// NewContext returns a copy of ctx carrying l.
+func NewContext(ctx context.Context, l Logger) context.Context {
+	return context.WithValue(ctx, ctxKey{}, l)
+}
+
+// FromContext returns the logger carried by ctx or Default if there is none.
+func FromContext(ctx context.Context) Logger {
+	if l, ok := ctx.Value(ctxKey{}).(Logger); ok {
+		return l
+	}
+
+	return Default
+}
+
+// Options are the options of a logger created by New.
+type Options struct {
+	// Level is the minimum level of messages logged.
+	Level Level
+	// JSON enables output of messages as JSON objects, one per line,
+	// instead of text.
+	JSON bool
+	// Now returns the time of messages. If nil, time.Now is used.
+	Now func() time.Time
+}
+
+// New creates a new logger writing messages of at least the configured
+// level to w.
+func New(w io.Writer, o Options) Logger {
+	var mu sync.Mutex
+
+	if o.Now == nil {
+		o.Now = time.Now
+	}
+
+	return Func(func(lvl Level, msg string, kvs []interface{}) {
+		if lvl < o.Level {
+			return
+		}
+
+		var b []byte
+
+		if o.JSON {
+			b = formatJSON(o.Now(), lvl, msg, kvs)
+		} else {
+			b = formatText(o.Now(), lvl, msg, kvs)
+		}
+
+		mu.Lock()
+		w.Write(b)
+		mu.Unlock()
+	})
+}
+
+// pairs calls f for every key and value in kvs. A trailing key without a
+// value is passed as the value of the key "!BADKEY".
+func pairs(kvs []interface{}, f func(k string, v interface{})) {
+	for i := 0; i < len(kvs); i += 2 {
+		if i+1 == len(kvs) {
+			f("!BADKEY", kvs[i])
+			break
+		}
+
+		k, ok := kvs[i].(string)
+
+		if !ok {
+			k = fmt.Sprint(kvs[i])
+		}
+
+		f(k, kvs[i+1])
+	}
+}
+
+// value returns the loggable representation of v.
+func value(v interface{}) interface{} {
+	switch x := v.(type) {
+	case error:
+		return x.Error()
+	case fmt.Stringer:
+		return x.String()
+	case time.Duration:
+		return x.String()
+	}
+
+	return v
+}
+
+func formatText(t time.Time, lvl Level, msg string, kvs []interface{}) []byte {
+	var b bytes.Buffer
+
+	b.WriteString(t.Format(time.RFC3339))
+	b.WriteByte(' ')
+	b.WriteString(strings.ToUpper(lvl.String()))
+	b.WriteByte(' ')
+	b.WriteString(msg)
+	writeKVs(&b, kvs)
+	b.WriteByte('\n')
+	return b.Bytes()
+}
+
+// writeKVs writes the pairs of kvs to b as space-prefixed key=value fields,
+// quoting values when needed.
+func writeKVs(b *bytes.Buffer, kvs []interface{}) {
+	pairs(kvs, func(k string, v interface{}) {
+		s := fmt.Sprint(value(v))
+
+		if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+			s = strconv.Quote(s)
+		}
+
+		b.WriteByte(' ')
+		b.WriteString(k)
+		b.WriteByte('=')
+		b.WriteString(s)
+	})
+}
+
+func formatJSON(t time.Time, lvl Level, msg string, kvs []interface{}) []byte {
+	var b bytes.Buffer
+
+	field := func(k string, v interface{}) {
+		kb, _ := json.Marshal(k)
+		vb, err := json.Marshal(v)
+
+		if err != nil {
+			vb, _ = json.Marshal(fmt.Sprint(v))
+		}
+
+		if b.Len() > 1 {
+			b.WriteByte(',')
+		}
+
+		b.Write(kb)
+		b.WriteByte(':')
+		b.Write(vb)
+	}
+
+	b.WriteByte('{')
+	field("time", t.Format(time.RFC3339Nano))
+	field("level", lvl.String())
+	field("msg", msg)
+	pairs(kvs, func(k string, v interface{}) { field(k, value(v)) })
+	b.WriteString("}\n")
+	return b.Bytes()
+}
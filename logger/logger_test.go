@@ -0,0 +1,120 @@
+// Copyright (c) 2022 Wireleap
+
+package logger
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"testing"
+	"time"
+)
+
+var testTime = time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC)
+
+func testNow() time.Time { return testTime }
+
+func TestText(t *testing.T) {
+	var b bytes.Buffer
+
+	l := New(&b, Options{Level: InfoLevel, Now: testNow})
+	l.Debug("hidden", "k", "v")
+	l.Info("hello", "n", 1, "s", "two words", "err", errors.New("bad"))
+	l.With("a", "b").Warn("with", "d", time.Second, "odd")
+
+	want := "2022-01-02T03:04:05Z INFO hello n=1 s=\"two words\" err=bad\n" +
+		"2022-01-02T03:04:05Z WARN with a=b d=1s !BADKEY=odd\n"
+
+	if b.String() != want {
+		t.Errorf("got %q, want %q", b.String(), want)
+	}
+}
+
+func TestStd(t *testing.T) {
+	var b bytes.Buffer
+
+	log.SetOutput(&b)
+	log.SetFlags(0)
+	defer func() {
+		log.SetOutput(os.Stderr)
+		log.SetFlags(log.LstdFlags)
+	}()
+
+	Std.With("component", "relay").Warn("splice error", "error", errors.New("bad conn"), "pid", 42)
+
+	want := "splice error component=relay error=\"bad conn\" pid=42\n"
+
+	if b.String() != want {
+		t.Errorf("got %q, want %q", b.String(), want)
+	}
+}
+
+func TestJSON(t *testing.T) {
+	var b bytes.Buffer
+
+	l := New(&b, Options{Level: WarnLevel, JSON: true, Now: testNow})
+	l.Info("hidden")
+	l.With("component", "relay").Error("failed", "error", errors.New("bad"), "code", 502)
+
+	var m map[string]interface{}
+
+	if err := json.Unmarshal(b.Bytes(), &m); err != nil {
+		t.Fatalf("could not unmarshal %q: %s", b.String(), err)
+	}
+
+	want := map[string]interface{}{
+		"time":      "2022-01-02T03:04:05Z",
+		"level":     "error",
+		"msg":       "failed",
+		"component": "relay",
+		"error":     "bad",
+		"code":      float64(502),
+	}
+
+	if len(m) != len(want) {
+		t.Fatalf("got %v, want %v", m, want)
+	}
+
+	for k, v := range want {
+		if m[k] != v {
+			t.Errorf("%s: got %v, want %v", k, m[k], v)
+		}
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	for _, l := range []Level{DebugLevel, InfoLevel, WarnLevel, ErrorLevel} {
+		if l2, err := ParseLevel(l.String()); err != nil || l2 != l {
+			t.Errorf("ParseLevel(%q) = %v, %v", l.String(), l2, err)
+		}
+	}
+
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Error("expected error for unknown level")
+	}
+}
+
+func TestContext(t *testing.T) {
+	if FromContext(context.Background()) == nil {
+		t.Error("expected Default without logger in context")
+	}
+
+	var got []interface{}
+
+	l := Func(func(_ Level, msg string, kvs []interface{}) { got = append(kvs, msg) })
+	FromContext(NewContext(context.Background(), l.With("x", 1))).Info("m", "y", 2)
+
+	if len(got) != 5 || got[0] != "x" || got[3] != 2 || got[4] != "m" {
+		t.Errorf("unexpected fields %v", got)
+	}
+
+	got = nil
+	OrDefault(l).Info("direct")
+
+	if len(got) != 1 || got[0] != "direct" || OrDefault(nil) == nil {
+		t.Error("OrDefault returned the wrong logger")
+	}
+}
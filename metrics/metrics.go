@@ -0,0 +1,335 @@
+// Copyright (c) 2022 Wireleap
+
+// Package metrics implements a minimal metrics registry with counters,
+// gauges and histograms which can be exposed in the Prometheus text format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefBuckets are the default histogram buckets, suitable for latencies in
+// seconds.
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// ContentType is the content type of the text exposition format.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Registry is a set of metrics.
+type Registry struct {
+	mu sync.Mutex
+	vs map[string]*vec
+}
+
+// NewRegistry creates a new empty Registry.
+func NewRegistry() *Registry { return &Registry{vs: map[string]*vec{}} }
+
+// Default is the registry used by the instrumented packages of this module.
+var Default = NewRegistry()
+
+// series is a single labeled time series of a metric.
+type series struct {
+	lvs    []string
+	value  float64
+	counts []uint64
+	count  uint64
+}
+
+// vec is a metric with all its labeled series.
+type vec struct {
+	name, help, typ string
+	labels          []string
+	buckets         []float64
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+// register returns the metric with the given name, creating it if needed. It
+// panics if a different metric with the same name exists already.
+func (r *Registry) register(name, help, typ string, buckets []float64, labels []string) *vec {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if v, ok := r.vs[name]; ok {
+		if v.typ != typ || strings.Join(v.labels, ",") != strings.Join(labels, ",") {
+			panic(fmt.Sprintf("metric %s registered twice with different types or labels", name))
+		}
+
+		return v
+	}
+
+	v := &vec{
+		name:    name,
+		help:    help,
+		typ:     typ,
+		labels:  labels,
+		buckets: buckets,
+		series:  map[string]*series{},
+	}
+	r.vs[name] = v
+	return v
+}
+
+// get returns the series for the label values lvs, creating it if needed.
+// The caller must hold v.mu.
+func (v *vec) get(lvs []string) *series {
+	if len(lvs) != len(v.labels) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", v.name, len(v.labels), len(lvs)))
+	}
+
+	k := strings.Join(lvs, "\xff")
+	s, ok := v.series[k]
+
+	if !ok {
+		s = &series{lvs: append([]string(nil), lvs...)}
+
+		if v.buckets != nil {
+			s.counts = make([]uint64, len(v.buckets))
+		}
+
+		v.series[k] = s
+	}
+
+	return s
+}
+
+// lookup returns the series for the label values lvs without creating it.
+func (v *vec) lookup(lvs []string) series {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if s, ok := v.series[strings.Join(lvs, "\xff")]; ok {
+		return *s
+	}
+
+	return series{}
+}
+
+// value returns the value of the series for lvs.
+func (v *vec) value(lvs []string) float64 { return v.lookup(lvs).value }
+
+// Counter is a monotonically increasing metric.
+type Counter struct{ v *vec }
+
+// Counter returns the counter with the given name, help text and label
+// names, creating it if needed.
+func (r *Registry) Counter(name, help string, labels ...string) *Counter {
+	return &Counter{r.register(name, help, "counter", nil, labels)}
+}
+
+// Add adds d, which must not be negative, to the series of c with the label
+// values lvs.
+func (c *Counter) Add(d float64, lvs ...string) {
+	if d < 0 {
+		panic(fmt.Sprintf("counter %s cannot decrease", c.v.name))
+	}
+
+	c.v.mu.Lock()
+	c.v.get(lvs).value += d
+	c.v.mu.Unlock()
+}
+
+// Inc increments the series of c with the label values lvs.
+func (c *Counter) Inc(lvs ...string) { c.Add(1, lvs...) }
+
+// Value returns the value of the series of c with the label values lvs.
+func (c *Counter) Value(lvs ...string) float64 { return c.v.value(lvs) }
+
+// Gauge is a metric which can go up and down.
+type Gauge struct{ v *vec }
+
+// Gauge returns the gauge with the given name, help text and label names,
+// creating it if needed.
+func (r *Registry) Gauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{r.register(name, help, "gauge", nil, labels)}
+}
+
+// Set sets the series of g with the label values lvs to x.
+func (g *Gauge) Set(x float64, lvs ...string) {
+	g.v.mu.Lock()
+	g.v.get(lvs).value = x
+	g.v.mu.Unlock()
+}
+
+// Add adds d to the series of g with the label values lvs.
+func (g *Gauge) Add(d float64, lvs ...string) {
+	g.v.mu.Lock()
+	g.v.get(lvs).value += d
+	g.v.mu.Unlock()
+}
+
+// Inc increments the series of g with the label values lvs.
+func (g *Gauge) Inc(lvs ...string) { g.Add(1, lvs...) }
+
+// Dec decrements the series of g with the label values lvs.
+func (g *Gauge) Dec(lvs ...string) { g.Add(-1, lvs...) }
+
+// Value returns the value of the series of g with the label values lvs.
+func (g *Gauge) Value(lvs ...string) float64 { return g.v.value(lvs) }
+
+// Histogram is a metric counting observations in buckets.
+type Histogram struct{ v *vec }
+
+// Histogram returns the histogram with the given name, help text, bucket
+// upper bounds and label names, creating it if needed. If buckets is nil,
+// DefBuckets is used.
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if buckets == nil {
+		buckets = DefBuckets
+	}
+
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	return &Histogram{r.register(name, help, "histogram", buckets, labels)}
+}
+
+// Observe records the observation x in the series of h with the label values
+// lvs.
+func (h *Histogram) Observe(x float64, lvs ...string) {
+	h.v.mu.Lock()
+	defer h.v.mu.Unlock()
+
+	s := h.v.get(lvs)
+	s.count++
+	s.value += x
+
+	// buckets are cumulative
+	for i, b := range h.v.buckets {
+		if x <= b {
+			s.counts[i]++
+		}
+	}
+}
+
+// Count returns the number of observations in the series of h with the label
+// values lvs.
+func (h *Histogram) Count(lvs ...string) uint64 { return h.v.lookup(lvs).count }
+
+// Sum returns the sum of observations in the series of h with the label
+// values lvs.
+func (h *Histogram) Sum(lvs ...string) float64 { return h.v.value(lvs) }
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(f, 'g', -1, 64)
+	}
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+// labelString formats the label names ls with the values lvs and the extra
+// label name and value pair in extra, if any.
+func labelString(ls, lvs []string, extra ...string) string {
+	if len(ls) == 0 && len(extra) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, 0, len(ls)+1)
+
+	for i, l := range ls {
+		pairs = append(pairs, l+`="`+labelEscaper.Replace(lvs[i])+`"`)
+	}
+
+	if len(extra) == 2 {
+		pairs = append(pairs, extra[0]+`="`+labelEscaper.Replace(extra[1])+`"`)
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// write writes v in the text exposition format to w.
+func (v *vec) write(w *bufio.Writer) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", v.name, helpEscaper.Replace(v.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", v.name, v.typ)
+
+	keys := make([]string, 0, len(v.series))
+
+	for k := range v.series {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		s := v.series[k]
+
+		if v.typ != "histogram" {
+			fmt.Fprintf(w, "%s%s %s\n", v.name, labelString(v.labels, s.lvs), formatFloat(s.value))
+			continue
+		}
+
+		for i, b := range v.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, labelString(v.labels, s.lvs, "le", formatFloat(b)), s.counts[i])
+		}
+
+		fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, labelString(v.labels, s.lvs, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", v.name, labelString(v.labels, s.lvs), formatFloat(s.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", v.name, labelString(v.labels, s.lvs), s.count)
+	}
+}
+
+// countWriter counts the bytes written to the underlying writer.
+type countWriter struct {
+	io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.Writer.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// WriteTo writes all metrics of r sorted by name to w in the Prometheus text
+// exposition format.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	vs := make([]*vec, 0, len(r.vs))
+
+	for _, v := range r.vs {
+		vs = append(vs, v)
+	}
+
+	r.mu.Unlock()
+	sort.Slice(vs, func(i, j int) bool { return vs[i].name < vs[j].name })
+
+	var (
+		cw = &countWriter{Writer: w}
+		bw = bufio.NewWriter(cw)
+	)
+
+	for _, v := range vs {
+		v.write(bw)
+	}
+
+	err := bw.Flush()
+	return cw.n, err
+}
+
+// ServeHTTP serves the metrics of r in the text exposition format.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", ContentType)
+	r.WriteTo(w)
+}
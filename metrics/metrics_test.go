@@ -0,0 +1,114 @@
+// Copyright (c) 2022 Wireleap
+
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestExposition(t *testing.T) {
+	r := NewRegistry()
+	c := r.Counter("test_requests_total", "Total requests.", "route", "code")
+	g := r.Gauge("test_active", "Active things.\nSecond line.")
+	h := r.Histogram("test_duration_seconds", "Durations.", []float64{1, 0.1}, "route")
+
+	c.Inc("/a", "200")
+	c.Add(2, "/a", "200")
+	c.Inc(`/b"\`, "500")
+	g.Inc()
+	g.Inc()
+	g.Dec()
+	h.Observe(0.05, "/a")
+	h.Observe(0.5, "/a")
+	h.Observe(5, "/a")
+
+	// same metric is returned when registering again
+	if v := r.Counter("test_requests_total", "", "route", "code").Value("/a", "200"); v != 3 {
+		t.Fatalf("expected 3, got %v", v)
+	}
+	if v := g.Value(); v != 1 {
+		t.Fatalf("expected 1, got %v", v)
+	}
+	if n, s := h.Count("/a"), h.Sum("/a"); n != 3 || s != 5.55 {
+		t.Fatalf("expected 3 observations summing to 5.55, got %d and %v", n, s)
+	}
+
+	var b strings.Builder
+	if _, err := r.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP test_active Active things.\nSecond line.
+# TYPE test_active gauge
+test_active 1
+# HELP test_duration_seconds Durations.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{route="/a",le="0.1"} 1
+test_duration_seconds_bucket{route="/a",le="1"} 2
+test_duration_seconds_bucket{route="/a",le="+Inf"} 3
+test_duration_seconds_sum{route="/a"} 5.55
+test_duration_seconds_count{route="/a"} 3
+# HELP test_requests_total Total requests.
+# TYPE test_requests_total counter
+test_requests_total{route="/a",code="200"} 3
+test_requests_total{route="/b\"\\",code="500"} 1
+`
+	if got := b.String(); got != want {
+		t.Fatalf("unexpected exposition:\n%s\nwant:\n%s", got, want)
+	}
+
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rr.Header().Get("Content-Type"); ct != ContentType || rr.Body.String() != want {
+		t.Fatalf("unexpected response with content type %q:\n%s", ct, rr.Body.String())
+	}
+}
+
+func TestMisuse(t *testing.T) {
+	r := NewRegistry()
+	c := r.Counter("test_total", "Test.", "a")
+
+	for name, f := range map[string]func(){
+		"wrong label count":  func() { c.Inc() },
+		"negative increment": func() { c.Add(-1, "x") },
+		"type conflict":      func() { r.Gauge("test_total", "Test.", "a") },
+		"label conflict":     func() { r.Counter("test_total", "Test.", "b") },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s: expected panic", name)
+				}
+			}()
+			f()
+		}()
+	}
+}
+
+func TestConcurrent(t *testing.T) {
+	r := NewRegistry()
+	c := r.Counter("test_total", "Test.")
+	h := r.Histogram("test_seconds", "Test.", nil)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				c.Inc()
+				h.Observe(0.01)
+				if j%100 == 0 {
+					r.WriteTo(&strings.Builder{})
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if v, n := c.Value(), h.Count(); v != 8000 || n != 8000 {
+		t.Fatalf("expected 8000, got %v and %d", v, n)
+	}
+}
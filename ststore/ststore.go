@@ -13,6 +13,7 @@ import (
 
 	"github.com/wireleap/common/api/sharetoken"
 	"github.com/wireleap/common/cli/fsdir"
+	"github.com/wireleap/common/logger"
 )
 
 const pathSeparator = string(os.PathSeparator)
@@ -33,12 +34,19 @@ type T struct {
 	mu   sync.RWMutex
 	sts  st3map
 	keyf KeyFunc
+	log  logger.Logger
 }
 
 // New initializes a sharetoken store in the directory under the path given by
 // the dir argument.
 func New(dir string, keyf KeyFunc) (t *T, err error) {
-	t = &T{keyf: keyf, sts: st3map{}}
+	return NewWithLogger(dir, keyf, nil)
+}
+
+// NewWithLogger is like New, but uses l to log problems with stored
+// sharetokens. If l is nil, logger.Default is used.
+func NewWithLogger(dir string, keyf KeyFunc, l logger.Logger) (t *T, err error) {
+	t = &T{keyf: keyf, sts: st3map{}, log: logger.OrDefault(l)}
 	t.m, err = fsdir.New(dir)
 
 	if err != nil {
@@ -87,7 +95,7 @@ func New(dir string, keyf KeyFunc) (t *T, err error) {
 		err = t.m.Get(st, p_path...)
 
 		if err != nil {
-			// ToDo: log error
+			t.log.Warn("moving malformed sharetoken out of the way", "path", path, "error", err)
 			// Halt only if file can't be moved
 			return t.m.Rename(p_path, MalformedPath(p_path...))
 		}
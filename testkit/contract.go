@@ -0,0 +1,254 @@
+// Copyright (c) 2022 Wireleap
+
+package testkit
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/wireleap/common/api/auth"
+	"github.com/wireleap/common/api/contractinfo"
+	"github.com/wireleap/common/api/duration"
+	"github.com/wireleap/common/api/jsonb"
+	"github.com/wireleap/common/api/pof"
+	"github.com/wireleap/common/api/provide"
+	"github.com/wireleap/common/api/servicekey"
+	"github.com/wireleap/common/api/sharetoken"
+	"github.com/wireleap/common/api/signer"
+	"github.com/wireleap/common/api/status"
+	"github.com/wireleap/common/api/texturl"
+)
+
+// PofType is the proof of funding type accepted by the fake contract.
+const PofType = "dummy"
+
+// Contract is a fake service contract. Servicekeys are activated by POSTing
+// a pof.SKActivationRequest to /servicekey/activate and relays submit
+// sharetokens by POSTing them to /sharetoken/submit.
+type Contract struct {
+	Faults
+
+	// Signer signs the responses and servicekeys of the contract.
+	Signer signer.Signer
+	// PofSigner signs the proofs of funding accepted by the contract.
+	PofSigner signer.Signer
+	// Info is served on /info. It must not be modified while the contract
+	// is in use.
+	Info *contractinfo.T
+	// Now returns the current time. If nil, time.Now is used.
+	Now func() time.Time
+
+	rt *provide.Router
+
+	mu   sync.Mutex
+	pofs map[string]bool
+	sts  []*sharetoken.T
+}
+
+// NewContract creates a new fake contract reachable at endpoint with newly
+// generated keys. Its info document refers to the directory d and the
+// payout service p, both of which can be nil.
+func NewContract(endpoint *texturl.URL, d *Directory, p *Payout) (*Contract, error) {
+	_, sk, err := ed25519.GenerateKey(nil)
+
+	if err != nil {
+		return nil, fmt.Errorf("could not generate contract key: %w", err)
+	}
+
+	_, psk, err := ed25519.GenerateKey(nil)
+
+	if err != nil {
+		return nil, fmt.Errorf("could not generate pof key: %w", err)
+	}
+
+	c := &Contract{
+		Signer:    signer.New(sk),
+		PofSigner: signer.New(psk),
+		rt:        provide.NewRouter(),
+		pofs:      map[string]bool{},
+	}
+
+	c.Info = &contractinfo.T{
+		Pubkey:   jsonb.PK(c.Signer.Public()),
+		Endpoint: endpoint,
+		Pofs:     []*contractinfo.Pof{{Type: PofType, Pubkey: jsonb.PK(c.PofSigner.Public())}},
+		Servicekey: contractinfo.Servicekey{
+			Currency: "usd",
+			Value:    big.NewRat(1, 1),
+			Duration: duration.T(time.Hour),
+		},
+		Settlement: contractinfo.Settlement{SubmissionWindow: duration.T(time.Hour)},
+	}
+
+	if d != nil {
+		c.Info.Directory = contractinfo.Directory{Endpoint: d.Info.Endpoint, PublicKey: d.Info.PublicKey}
+	}
+
+	if p != nil {
+		c.Info.Payout = contractinfo.Payout{Endpoint: p.Endpoint, Type: PayoutType}
+	}
+
+	c.rt.Handle("/info", provide.Routes{
+		http.MethodGet: jsonHandler(func() interface{} { return c.Info }),
+	}, c.fail, func(h http.Handler) http.Handler { return provide.SignGate(h, c.Signer, auth.Contract) })
+	c.rt.Handle("/servicekey/activate", provide.Routes{
+		http.MethodPost: http.HandlerFunc(c.activate),
+	}, c.fail)
+	c.rt.Handle("/sharetoken/submit", provide.Routes{
+		http.MethodPost: http.HandlerFunc(c.submit),
+	}, c.fail, provide.Auth(auth.Relay))
+
+	return c, nil
+}
+
+func (c *Contract) ServeHTTP(w http.ResponseWriter, r *http.Request) { c.rt.ServeHTTP(w, r) }
+
+// Routes returns the routes served by the fake contract.
+func (c *Contract) Routes() []provide.RouteInfo { return c.rt.Routes() }
+
+func (c *Contract) now() time.Time {
+	if c.Now != nil {
+		return c.Now()
+	}
+
+	return time.Now()
+}
+
+// NewPof issues a new proof of funding accepted by the contract, valid for
+// an hour.
+func (c *Contract) NewPof() (*pof.T, error) {
+	return pof.New(c.PofSigner, PofType, 3600)
+}
+
+// sign returns the contract data of a servicekey activated now.
+func (c *Contract) sign() *servicekey.Contract {
+	open := c.now().Add(time.Duration(c.Info.Servicekey.Duration))
+
+	sc := &servicekey.Contract{
+		SettlementOpen:  open.Unix(),
+		SettlementClose: open.Add(time.Duration(c.Info.Settlement.SubmissionWindow)).Unix(),
+	}
+	sc.Sign(c.Signer)
+	return sc
+}
+
+// NewServicekey returns a new servicekey activated by the contract without
+// going through the activation endpoint.
+func (c *Contract) NewServicekey() (*servicekey.T, error) {
+	_, sk, err := ed25519.GenerateKey(nil)
+
+	if err != nil {
+		return nil, fmt.Errorf("could not generate servicekey: %w", err)
+	}
+
+	k := servicekey.New(sk)
+	k.Contract = c.sign()
+	return k, nil
+}
+
+// Sharetokens returns the sharetokens accepted so far.
+func (c *Contract) Sharetokens() []*sharetoken.T {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]*sharetoken.T(nil), c.sts...)
+}
+
+// verifyPof checks that p is a valid proof of funding which has not been
+// used yet and marks it as used.
+func (c *Contract) verifyPof(p *pof.T) error {
+	switch {
+	case p == nil:
+		return status.ErrRequest.Wrap(fmt.Errorf("proof of funding is missing"))
+	case p.Type != PofType:
+		return status.ErrRequest.Wrap(fmt.Errorf("unsupported proof of funding type %s", p.Type))
+	case !ed25519.Verify(c.PofSigner.Public(), []byte(p.Digest()), p.Signature):
+		return status.ErrInvalidSig
+	case p.IsExpiredAt(c.now().Unix()):
+		return status.ErrExpiredPof
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.pofs[p.Nonce] {
+		return status.ErrSneakyPof
+	}
+
+	c.pofs[p.Nonce] = true
+	return nil
+}
+
+func (c *Contract) activate(w http.ResponseWriter, r *http.Request) {
+	var req pof.SKActivationRequest
+
+	if !readJSON(w, r, &req) {
+		return
+	}
+
+	if len(req.Pubkey) != ed25519.PublicKeySize {
+		status.ErrRequest.Wrap(fmt.Errorf("servicekey public key is missing or invalid")).WriteTo(w)
+		return
+	}
+
+	if err := c.verifyPof(req.Pof); err != nil {
+		err.(*status.T).WriteTo(w)
+		return
+	}
+
+	writeJSON(w, c.sign())
+}
+
+func (c *Contract) submit(w http.ResponseWriter, r *http.Request) {
+	var st sharetoken.T
+
+	if !readJSON(w, r, &st) {
+		return
+	}
+
+	if st.Contract == nil {
+		status.ErrSTRejected.Wrap(fmt.Errorf("sharetoken contract data is missing")).WriteTo(w)
+		return
+	}
+
+	if err := st.Verify(); err != nil {
+		status.ErrSTRejected.Wrap(err).WriteTo(w)
+		return
+	}
+
+	if err := auth.SignedBy(r.Header, auth.Relay, st.RelayPubkey.T()); err != nil {
+		status.ErrForbidden.Wrap(err).WriteTo(w)
+		return
+	}
+
+	now := c.now().Unix()
+
+	switch {
+	case !bytes.Equal(st.Contract.PublicKey, c.Signer.Public()):
+		status.ErrContractPubkeyMismatch.WriteTo(w)
+		return
+	case now < st.Contract.SettlementOpen:
+		status.ErrSettlementNotOpen.WriteTo(w)
+		return
+	case now >= st.Contract.SettlementClose:
+		status.ErrSettlementClosed.WriteTo(w)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, st2 := range c.sts {
+		if bytes.Equal(st2.Signature, st.Signature) {
+			status.ErrSTRejected.Wrap(fmt.Errorf("sharetoken was submitted already")).WriteTo(w)
+			return
+		}
+	}
+
+	c.sts = append(c.sts, &st)
+	status.OK.WriteTo(w)
+}
@@ -0,0 +1,156 @@
+// Copyright (c) 2022 Wireleap
+
+package testkit
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/wireleap/common/api/auth"
+	"github.com/wireleap/common/api/dirinfo"
+	"github.com/wireleap/common/api/jsonb"
+	"github.com/wireleap/common/api/pow"
+	"github.com/wireleap/common/api/provide"
+	"github.com/wireleap/common/api/relayentry"
+	"github.com/wireleap/common/api/relaylist"
+	"github.com/wireleap/common/api/signer"
+	"github.com/wireleap/common/api/status"
+	"github.com/wireleap/common/api/texturl"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Directory is a fake directory. Relays enroll by POSTing their signed
+// relayentry.T to /relays, completing the challenge handshake of
+// relaydir.EnrollHandshake if PoW is set.
+type Directory struct {
+	Faults
+
+	// Signer signs the responses of the directory.
+	Signer signer.Signer
+	// Info is served on /info. It must not be modified while the
+	// directory is in use.
+	Info *dirinfo.T
+	// PoW issues the enrollment challenges. If nil, relays are enrolled
+	// without a challenge.
+	PoW *pow.Issuer
+
+	rt *provide.Router
+
+	mu      sync.Mutex
+	relays  relaylist.T
+	version int64
+}
+
+// NewDirectory creates a new fake directory reachable at endpoint with a
+// newly generated key, issuing cheap enrollment challenges for all built-in
+// proof-of-work algorithms.
+func NewDirectory(endpoint *texturl.URL) (*Directory, error) {
+	_, sk, err := ed25519.GenerateKey(nil)
+
+	if err != nil {
+		return nil, fmt.Errorf("could not generate directory key: %w", err)
+	}
+
+	d := &Directory{
+		Signer: signer.New(sk),
+		PoW: pow.NewIssuer(
+			pow.Hashcash{Bits: 8},
+			pow.Argon2id{Time: 1, Memory: 64, Threads: 1},
+			pow.Bcrypt{Cost: bcrypt.MinCost},
+		),
+		Info: &dirinfo.T{
+			PublicKey: jsonb.PK(sk.Public().(ed25519.PublicKey)),
+			Version:   "0.0.0",
+			Endpoint:  endpoint,
+		},
+		rt:     provide.NewRouter(),
+		relays: relaylist.T{},
+	}
+
+	sign := func(h http.Handler) http.Handler { return provide.SignGate(h, d.Signer, auth.Directory) }
+
+	d.rt.Handle("/info", provide.Routes{
+		http.MethodGet: jsonHandler(func() interface{} { return d.Info }),
+	}, d.fail, sign)
+	d.rt.Handle("/relays", provide.Routes{
+		http.MethodGet:  jsonHandler(func() interface{} { return d.Relays() }),
+		http.MethodPost: provide.AuthGate(http.HandlerFunc(d.enroll), auth.Relay),
+	}, d.fail, sign)
+	d.rt.Handle("/relays/snapshot", provide.Routes{
+		http.MethodGet: http.HandlerFunc(d.snapshot),
+	}, d.fail, sign)
+
+	return d, nil
+}
+
+func (d *Directory) ServeHTTP(w http.ResponseWriter, r *http.Request) { d.rt.ServeHTTP(w, r) }
+
+// Routes returns the routes served by the fake directory.
+func (d *Directory) Routes() []provide.RouteInfo { return d.rt.Routes() }
+
+// Relays returns a copy of the list of enrolled relays.
+func (d *Directory) Relays() relaylist.T {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.copyRelays()
+}
+
+// copyRelays returns a copy of the list of enrolled relays. d.mu must be
+// held.
+func (d *Directory) copyRelays() relaylist.T {
+	rl := relaylist.T{}
+
+	for k, v := range d.relays {
+		rl[k] = v
+	}
+
+	return rl
+}
+
+// AddRelay enrolls the relay e directly.
+func (d *Directory) AddRelay(e *relayentry.T) {
+	d.mu.Lock()
+	d.relays[e.Addr.String()] = e
+	d.version++
+	d.mu.Unlock()
+}
+
+func (d *Directory) enroll(w http.ResponseWriter, r *http.Request) {
+	var e relayentry.T
+
+	if !readJSON(w, r, &e) {
+		return
+	}
+
+	if err := e.Validate(); err != nil {
+		status.ErrRequest.Wrap(err).WriteTo(w)
+		return
+	}
+
+	if err := auth.SignedBy(r.Header, auth.Relay, e.Pubkey.T()); err != nil {
+		status.ErrForbidden.Wrap(err).WriteTo(w)
+		return
+	}
+
+	if d.PoW != nil && !d.PoW.Handle(w, r) {
+		return
+	}
+
+	d.AddRelay(&e)
+	status.OK.WriteTo(w)
+}
+
+func (d *Directory) snapshot(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	s := relaylist.NewSnapshot(d.version, d.copyRelays())
+	d.mu.Unlock()
+
+	if err := s.Sign(d.Signer); err != nil {
+		status.ErrInternal.Wrap(err).WriteTo(w)
+		return
+	}
+
+	writeJSON(w, s)
+}
@@ -0,0 +1,332 @@
+// Copyright (c) 2022 Wireleap
+
+package testkit
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/wireleap/common/api/jsonb"
+	"github.com/wireleap/common/api/relayentry"
+	"github.com/wireleap/common/api/sharetoken"
+	"github.com/wireleap/common/api/texturl"
+	"github.com/wireleap/common/api/tlscert"
+	"github.com/wireleap/common/wlnet"
+	"github.com/wireleap/common/wlnet/relay"
+	"github.com/wireleap/common/wlnet/transport"
+)
+
+// DefaultRoles are the roles of the relays of a Network by default, in
+// circuit order.
+var DefaultRoles = []string{"fronting", "entropic", "backing"}
+
+// DefaultBufSize is the buffer size of the relays of a Network by default.
+const DefaultBufSize = 4096
+
+// NetworkOptions are the options of NewNetwork.
+type NetworkOptions struct {
+	// Roles are the roles of the relays to start, in circuit order. If
+	// nil, DefaultRoles is used.
+	Roles []string
+	// Relay are the options every relay is started with. BufSize
+	// defaults to DefaultBufSize, ErrorOrigin to the role of the relay,
+	// AllowLoopback is always set and HandleST is called after the
+	// sharetoken has been checked.
+	Relay relay.Options
+	// Timeout is the timeout of the transports. If zero, 5 seconds are
+	// used.
+	Timeout time.Duration
+}
+
+// Relay is a relay of a Network.
+type Relay struct {
+	// Entry is the relay entry of the relay as enrolled in the directory.
+	Entry *relayentry.T
+	// Server is the running relay server.
+	Server *relay.Server
+
+	mu  sync.Mutex
+	sts []*sharetoken.T
+}
+
+// Sharetokens returns the sharetokens accepted by r so far.
+func (r *Relay) Sharetokens() []*sharetoken.T {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*sharetoken.T(nil), r.sts...)
+}
+
+// Network is a local Wireleap network for end-to-end tests: relays with
+// generated keys and certificates listening on loopback, the fake contract
+// and directory they are enrolled in and TCP and UDP echo targets.
+type Network struct {
+	// Contract is the fake contract of the network.
+	Contract *Contract
+	// Directory is the fake directory of the network.
+	Directory *Directory
+	// API serves the contract on contract.test and the directory on
+	// dir.test, for use with client.NewMock.
+	API http.Handler
+	// Relays are the relays of the network in circuit order.
+	Relays []*Relay
+	// Transport is a client transport verifying relay certificates against
+	// relay public keys.
+	Transport *transport.T
+	// TCPEcho and UDPEcho are the addresses of the echo targets.
+	TCPEcho, UDPEcho *url.URL
+
+	closers []func()
+}
+
+// NewNetwork starts a new local network as configured by o. It must be
+// closed after use.
+func NewNetwork(o NetworkOptions) (n *Network, err error) {
+	if o.Roles == nil {
+		o.Roles = DefaultRoles
+	}
+
+	if o.Timeout == 0 {
+		o.Timeout = 5 * time.Second
+	}
+
+	n = &Network{}
+
+	defer func() {
+		if err != nil {
+			n.Close()
+			n = nil
+		}
+	}()
+
+	if n.Directory, err = NewDirectory(texturl.URLMustParse("https://dir.test")); err != nil {
+		return
+	}
+
+	if n.Contract, err = NewContract(texturl.URLMustParse("https://contract.test"), n.Directory, nil); err != nil {
+		return
+	}
+
+	n.API = Hosts(map[string]http.Handler{"contract.test": n.Contract, "dir.test": n.Directory})
+	n.Transport = transport.New(transport.Options{PinPubkeys: true, Timeout: o.Timeout})
+
+	for _, role := range o.Roles {
+		var r *Relay
+
+		if r, err = n.startRelay(role, o); err != nil {
+			return
+		}
+
+		n.Relays = append(n.Relays, r)
+		n.Directory.AddRelay(r.Entry)
+	}
+
+	if n.TCPEcho, err = n.startTCPEcho(); err != nil {
+		return
+	}
+
+	n.UDPEcho, err = n.startUDPEcho()
+	return
+}
+
+// checkST checks that st was issued for the relay with the public key pk by
+// a servicekey of the network contract which has not expired yet.
+func (n *Network) checkST(st *sharetoken.T, pk ed25519.PublicKey) error {
+	switch {
+	case st == nil:
+		return fmt.Errorf("sharetoken is missing")
+	case st.Contract == nil:
+		return fmt.Errorf("sharetoken contract data is missing")
+	case !bytes.Equal(st.Contract.PublicKey, n.Contract.Signer.Public()):
+		return fmt.Errorf("sharetoken is for another contract")
+	case !bytes.Equal(st.RelayPubkey, pk):
+		return fmt.Errorf("sharetoken is for another relay")
+	case st.IsExpiredAt(n.Contract.now().Unix()):
+		return fmt.Errorf("sharetoken servicekey has expired")
+	}
+
+	return st.Verify()
+}
+
+func (n *Network) startRelay(role string, o NetworkOptions) (*Relay, error) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+
+	if err != nil {
+		return nil, fmt.Errorf("could not generate relay key: %w", err)
+	}
+
+	cert, err := tlscert.Certificate(priv)
+
+	if err != nil {
+		return nil, fmt.Errorf("could not generate relay certificate: %w", err)
+	}
+
+	r := &Relay{}
+	ro := o.Relay
+	ro.AllowLoopback = true
+
+	if ro.BufSize == 0 {
+		ro.BufSize = DefaultBufSize
+	}
+
+	if ro.ErrorOrigin == "" {
+		ro.ErrorOrigin = role
+	}
+
+	ro.HandleST = func(st *sharetoken.T) error {
+		if err := n.checkST(st, pub); err != nil {
+			return err
+		}
+
+		if o.Relay.HandleST != nil {
+			if err := o.Relay.HandleST(st); err != nil {
+				return err
+			}
+		}
+
+		r.mu.Lock()
+		r.sts = append(r.sts, st)
+		r.mu.Unlock()
+		return nil
+	}
+
+	tt := transport.New(transport.Options{Certs: []tls.Certificate{cert}, Timeout: o.Timeout})
+
+	if r.Server, err = relay.New(tt, ro).Listen("127.0.0.1:0"); err != nil {
+		return nil, fmt.Errorf("could not start %s relay: %w", role, err)
+	}
+
+	n.closers = append(n.closers, func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		r.Server.Shutdown(ctx)
+	})
+
+	r.Entry = &relayentry.T{
+		Role:   role,
+		Addr:   texturl.URLMustParse("wireleap://" + r.Server.Addr),
+		Pubkey: jsonb.PK(pub),
+	}
+	return r, nil
+}
+
+func (n *Network) startTCPEcho() (*url.URL, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		return nil, fmt.Errorf("could not start TCP echo target: %w", err)
+	}
+
+	n.closers = append(n.closers, func() { l.Close() })
+
+	go func() {
+		for {
+			c, err := l.Accept()
+
+			if err != nil {
+				return
+			}
+
+			go func() { io.Copy(c, c); c.Close() }()
+		}
+	}()
+
+	return &url.URL{Scheme: "target", Host: l.Addr().String()}, nil
+}
+
+func (n *Network) startUDPEcho() (*url.URL, error) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+
+	if err != nil {
+		return nil, fmt.Errorf("could not start UDP echo target: %w", err)
+	}
+
+	n.closers = append(n.closers, func() { pc.Close() })
+
+	go func() {
+		b := make([]byte, 65535)
+
+		for {
+			k, addr, err := pc.ReadFrom(b)
+
+			if err != nil {
+				return
+			}
+
+			pc.WriteTo(b[:k], addr)
+		}
+	}()
+
+	return &url.URL{Scheme: "target", Host: pc.LocalAddr().String()}, nil
+}
+
+// Hops returns the relay entries of the relays of n in circuit order.
+func (n *Network) Hops() []*relayentry.T {
+	hops := make([]*relayentry.T, len(n.Relays))
+
+	for i, r := range n.Relays {
+		hops[i] = r.Entry
+	}
+
+	return hops
+}
+
+// Sharetokens returns new sharetokens for every relay of n, issued using a
+// new servicekey activated by the network contract.
+func (n *Network) Sharetokens() ([]*sharetoken.T, error) {
+	sk, err := n.Contract.NewServicekey()
+
+	if err != nil {
+		return nil, err
+	}
+
+	sts := make([]*sharetoken.T, len(n.Relays))
+
+	for i, r := range n.Relays {
+		if sts[i], err = sharetoken.New(sk, r.Entry.Pubkey.T()); err != nil {
+			return nil, err
+		}
+	}
+
+	return sts, nil
+}
+
+// Dial dials target through a circuit of all relays of n with new
+// sharetokens. UDP circuits are wrapped using wlnet.NewDatagramConn.
+func (n *Network) Dial(ctx context.Context, protocol string, target *url.URL) (net.Conn, error) {
+	sts, err := n.Sharetokens()
+
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := n.Transport.DialCircuit(ctx, protocol, n.Hops(), target, sts)
+
+	if err != nil {
+		return nil, err
+	}
+
+	switch protocol {
+	case "udp", "udp4", "udp6":
+		return wlnet.NewDatagramConn(c), nil
+	}
+
+	return c, nil
+}
+
+// Close stops the relays and echo targets of n.
+func (n *Network) Close() {
+	for i := len(n.closers) - 1; i >= 0; i-- {
+		n.closers[i]()
+	}
+
+	n.closers = nil
+}
@@ -0,0 +1,149 @@
+// Copyright (c) 2022 Wireleap
+
+package testkit
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/wireleap/common/api/provide"
+	"github.com/wireleap/common/api/status"
+	"github.com/wireleap/common/api/texturl"
+	"github.com/wireleap/common/api/withdrawal"
+	"github.com/wireleap/common/api/withdrawalrequest"
+)
+
+// PayoutType is the payout type of the fake payout service.
+const PayoutType = "dummy"
+
+// Payout is a fake payout service. Withdrawals are requested by POSTing a
+// withdrawalrequest.T to /withdrawals and stay pending until Settle is
+// called, their state being available on /withdrawals/{id}.
+type Payout struct {
+	Faults
+
+	// Endpoint is the URL the payout service is reachable at.
+	Endpoint *texturl.URL
+	// Now returns the current time. If nil, time.Now is used.
+	Now func() time.Time
+
+	rt *provide.Router
+
+	mu  sync.Mutex
+	ws  map[string]*withdrawal.T
+	seq int
+}
+
+// NewPayout creates a new fake payout service reachable at endpoint.
+func NewPayout(endpoint *texturl.URL) *Payout {
+	p := &Payout{Endpoint: endpoint, rt: provide.NewRouter(), ws: map[string]*withdrawal.T{}}
+
+	p.rt.Handle("/withdrawals", provide.Routes{
+		http.MethodPost: http.HandlerFunc(p.withdraw),
+	}, p.fail)
+	p.rt.Handle("/withdrawals/{id}", provide.Routes{
+		http.MethodGet: http.HandlerFunc(p.get),
+	}, p.fail)
+
+	return p
+}
+
+func (p *Payout) ServeHTTP(w http.ResponseWriter, r *http.Request) { p.rt.ServeHTTP(w, r) }
+
+// Routes returns the routes served by the fake payout service.
+func (p *Payout) Routes() []provide.RouteInfo { return p.rt.Routes() }
+
+func (p *Payout) now() int64 {
+	if p.Now != nil {
+		return p.Now().Unix()
+	}
+
+	return time.Now().Unix()
+}
+
+// Withdrawal returns a copy of the withdrawal with the given id, or nil if
+// there is none.
+func (p *Payout) Withdrawal(id string) *withdrawal.T {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	wd, ok := p.ws[id]
+
+	if !ok {
+		return nil
+	}
+
+	c := *wd
+	return &c
+}
+
+// Settle completes the pending withdrawal with the given id if ok is true
+// and fails it otherwise.
+func (p *Payout) Settle(id string, ok bool) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	wd, found := p.ws[id]
+
+	switch {
+	case !found:
+		return fmt.Errorf("no withdrawal with id %s", id)
+	case wd.State != "pending":
+		return fmt.Errorf("withdrawal %s is %s already", id, wd.State)
+	}
+
+	wd.State = "failed"
+
+	if ok {
+		wd.State = "complete"
+	}
+
+	wd.StateChanged = p.now()
+	return nil
+}
+
+func (p *Payout) withdraw(w http.ResponseWriter, r *http.Request) {
+	var wr withdrawalrequest.T
+
+	if !readJSON(w, r, &wr) {
+		return
+	}
+
+	if err := wr.Validate(); err != nil {
+		status.ErrRequest.Wrap(err).WriteTo(w)
+		return
+	}
+
+	if wr.Type != PayoutType {
+		status.ErrRequest.Wrap(fmt.Errorf("unsupported withdrawal type %s", wr.Type)).WriteTo(w)
+		return
+	}
+
+	p.mu.Lock()
+	p.seq++
+	wd := &withdrawal.T{
+		ID:           "withdrawal-" + strconv.Itoa(p.seq),
+		State:        "pending",
+		StateChanged: p.now(),
+		WR:           &wr,
+	}
+	p.ws[wd.ID] = wd
+	c := *wd
+	p.mu.Unlock()
+
+	writeJSON(w, &c)
+}
+
+func (p *Payout) get(w http.ResponseWriter, r *http.Request) {
+	wd := p.Withdrawal(provide.Param(r, "id"))
+
+	if wd == nil {
+		status.ErrNotFound.WriteTo(w)
+		return
+	}
+
+	writeJSON(w, wd)
+}
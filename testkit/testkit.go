@@ -0,0 +1,125 @@
+// Copyright (c) 2022 Wireleap
+
+// Package testkit provides in-process fake service contract, directory and
+// payout services for testing code which uses the Wireleap API. The fakes
+// are http.Handlers which can be passed to client.NewMock or served by
+// httptest.Server, and failures can be injected into each of their routes.
+package testkit
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+
+	"github.com/wireleap/common/api/provide"
+	"github.com/wireleap/common/api/status"
+	"github.com/wireleap/common/api/strictjson"
+)
+
+// fault is an injected failure.
+type fault struct {
+	st *status.T
+	// n is the number of requests left to fail, negative for all
+	n int
+}
+
+// Faults injects failures into the routes of a fake service. Routes are
+// named by method and pattern separated by a space, such as "GET /info".
+type Faults struct {
+	mu sync.Mutex
+	m  map[string]*fault
+}
+
+// Fail makes all requests to route fail with st until Clear is called.
+func (f *Faults) Fail(route string, st *status.T) { f.FailN(route, -1, st) }
+
+// FailN makes the next n requests to route fail with st.
+func (f *Faults) FailN(route string, n int, st *status.T) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.m == nil {
+		f.m = map[string]*fault{}
+	}
+
+	f.m[route] = &fault{st: st, n: n}
+}
+
+// Clear removes the failure injected into route.
+func (f *Faults) Clear(route string) {
+	f.mu.Lock()
+	delete(f.m, route)
+	f.mu.Unlock()
+}
+
+// take returns the status a request to route should fail with, if any.
+func (f *Faults) take(route string) *status.T {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	ft := f.m[route]
+
+	if ft == nil {
+		return nil
+	}
+
+	if ft.n > 0 {
+		if ft.n--; ft.n == 0 {
+			delete(f.m, route)
+		}
+	}
+
+	return ft.st
+}
+
+// fail is a provide.Gate failing requests with the failures injected into
+// their route by f. It is meant to be the outermost gate of a route.
+func (f *Faults) fail(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if st := f.take(r.Method + " " + provide.Pattern(r)); st != nil {
+			st.WriteTo(w)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// Hosts dispatches requests to the handlers in m by the host (including the
+// port, if any) of the request, so that several fake services can be used
+// with a single client.NewMock.
+func Hosts(m map[string]http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := m[r.Host]
+
+		if h == nil {
+			status.ErrNotFound.WriteTo(w)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// writeJSON writes v as a JSON response.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// jsonHandler returns a handler responding with the JSON encoding of the
+// value returned by f.
+func jsonHandler(f func() interface{}) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { writeJSON(w, f()) })
+}
+
+// readJSON decodes the body of r into v, writing the error to w if that
+// fails.
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := strictjson.Decode(r.Body, v); err != nil {
+		err.(*status.T).WriteTo(w)
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,296 @@
+// Copyright (c) 2022 Wireleap
+
+package testkit
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/wireleap/common/api/client"
+	"github.com/wireleap/common/api/consume"
+	"github.com/wireleap/common/api/interfaces/relaycontract"
+	"github.com/wireleap/common/api/interfaces/relaydir"
+	"github.com/wireleap/common/api/jsonb"
+	"github.com/wireleap/common/api/pof"
+	"github.com/wireleap/common/api/relayentry"
+	"github.com/wireleap/common/api/servicekey"
+	"github.com/wireleap/common/api/sharetoken"
+	"github.com/wireleap/common/api/signer"
+	"github.com/wireleap/common/api/status"
+	"github.com/wireleap/common/api/texturl"
+	"github.com/wireleap/common/api/withdrawal"
+	"github.com/wireleap/common/api/withdrawalrequest"
+)
+
+type fakes struct {
+	c *Contract
+	d *Directory
+	p *Payout
+	h http.Handler
+}
+
+func newFakes(t *testing.T) *fakes {
+	d, err := NewDirectory(texturl.URLMustParse("https://dir.test"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := NewPayout(texturl.URLMustParse("https://payout.test"))
+	c, err := NewContract(texturl.URLMustParse("https://contract.test"), d, p)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &fakes{c: c, d: d, p: p, h: Hosts(map[string]http.Handler{
+		"contract.test": c,
+		"dir.test":      d,
+		"payout.test":   p,
+	})}
+}
+
+func TestInfo(t *testing.T) {
+	f := newFakes(t)
+	cl := client.NewMock(nil, f.h)
+	cl.RetryOpt.Tries = 1
+	sc := f.c.Info.Endpoint
+
+	f.c.FailN("GET /info", 1, status.ErrInternal)
+
+	if _, err := consume.ContractInfo(cl, sc); !errors.Is(err, status.ErrInternal) {
+		t.Fatalf("expected injected failure, got %v", err)
+	}
+
+	if _, err := consume.ContractInfo(cl, sc); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := consume.DirectoryInfo(cl, sc); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEnrollment(t *testing.T) {
+	f := newFakes(t)
+	pk, sk, err := ed25519.GenerateKey(nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cl := client.NewMock(signer.New(sk), f.h, relaydir.T)
+	cl.RetryOpt.Tries = 1
+
+	req, err := cl.NewRequest(http.MethodPost, "https://dir.test/relays", &relayentry.T{
+		Role:   "backing",
+		Addr:   texturl.URLMustParse("wireleap://relay.test:443"),
+		Pubkey: jsonb.PK(pk),
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = relaydir.EnrollHandshake(cl, req); err != nil {
+		t.Fatal(err)
+	}
+
+	rl, err := consume.ContractRelays(cl, f.c.Info.Endpoint)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rl) != 1 {
+		t.Fatalf("expected 1 enrolled relay, got %d", len(rl))
+	}
+
+	snap, err := consume.ContractRelaySnapshot(cl, f.c.Info.Endpoint, nil, time.Minute)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if snap.Version != 1 || len(snap.Relays) != 1 {
+		t.Fatalf("unexpected snapshot %+v", snap)
+	}
+}
+
+func TestServicekeyAndSharetokens(t *testing.T) {
+	f := newFakes(t)
+	cl := client.NewMock(nil, f.h)
+	cl.RetryOpt.Tries = 1
+
+	p, err := f.c.NewPof()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, ssk, err := ed25519.GenerateKey(nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sk := servicekey.New(ssk)
+	req := &pof.SKActivationRequest{Pubkey: sk.PublicKey, Pof: p}
+
+	if err = cl.Perform(http.MethodPost, "https://contract.test/servicekey/activate", req, sk.Contract); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = sk.Contract.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	err = cl.Perform(http.MethodPost, "https://contract.test/servicekey/activate", req, nil)
+
+	if !errors.Is(err, status.ErrSneakyPof) {
+		t.Fatalf("expected reused pof to be refused, got %v", err)
+	}
+
+	rpk, rsk, err := ed25519.GenerateKey(nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	st, err := sharetoken.New(sk, rpk)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rcl := client.NewMock(signer.New(rsk), f.h, relaycontract.T)
+	rcl.RetryOpt.Tries = 1
+	submit := "https://contract.test/sharetoken/submit"
+
+	if err = rcl.Perform(http.MethodPost, submit, st, nil); !errors.Is(err, status.ErrSettlementNotOpen) {
+		t.Fatalf("expected early submission to be refused, got %v", err)
+	}
+
+	f.c.Now = func() time.Time { return time.Now().Add(90 * time.Minute) }
+
+	if err = rcl.Perform(http.MethodPost, submit, st, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = rcl.Perform(http.MethodPost, submit, st, nil); err == nil {
+		t.Fatal("expected duplicate submission to be refused")
+	}
+
+	if n := len(f.c.Sharetokens()); n != 1 {
+		t.Fatalf("expected 1 accepted sharetoken, got %d", n)
+	}
+}
+
+func TestPayout(t *testing.T) {
+	f := newFakes(t)
+	cl := client.NewMock(nil, f.h)
+	cl.RetryOpt.Tries = 1
+
+	var wd withdrawal.T
+
+	err := cl.Perform(http.MethodPost, "https://payout.test/withdrawals", &withdrawalrequest.T{
+		Amount:      100,
+		Type:        PayoutType,
+		Destination: "acct_test",
+	}, &wd)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = wd.Validate(); err != nil || wd.State != "pending" {
+		t.Fatalf("unexpected withdrawal %+v: %v", wd, err)
+	}
+
+	if err = f.p.Settle(wd.ID, true); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = cl.Perform(http.MethodGet, "https://payout.test/withdrawals/"+wd.ID, nil, &wd); err != nil {
+		t.Fatal(err)
+	}
+
+	if wd.State != "complete" || wd.Amount != 100 {
+		t.Fatalf("unexpected withdrawal %+v", wd)
+	}
+
+	if err = cl.Perform(http.MethodGet, "https://payout.test/withdrawals/nope", nil, nil); !errors.Is(err, status.ErrNotFound) {
+		t.Fatalf("expected not found, got %v", err)
+	}
+}
+
+func TestNetwork(t *testing.T) {
+	n, err := NewNetwork(NetworkOptions{})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer n.Close()
+
+	for _, c := range []struct {
+		protocol string
+		target   *url.URL
+	}{
+		{"tcp", n.TCPEcho},
+		{"udp", n.UDPEcho},
+	} {
+		conn, err := n.Dial(context.Background(), c.protocol, c.target)
+
+		if err != nil {
+			t.Fatalf("%s: %s", c.protocol, err)
+		}
+
+		p0 := []byte("hello " + c.protocol)
+
+		if _, err = conn.Write(p0); err != nil {
+			t.Fatalf("%s: %s", c.protocol, err)
+		}
+
+		p1 := make([]byte, 64)
+		k, err := conn.Read(p1)
+
+		if err != nil || string(p1[:k]) != string(p0) {
+			t.Fatalf("%s: expected echo %q, got %q: %v", c.protocol, p0, p1[:k], err)
+		}
+
+		conn.Close()
+	}
+
+	for _, r := range n.Relays {
+		if k := len(r.Sharetokens()); k != 2 {
+			t.Errorf("%s relay: expected 2 sharetokens, got %d", r.Entry.Role, k)
+		}
+	}
+
+	// expired servicekeys are refused by the relays
+	n.Contract.Now = func() time.Time { return time.Now().Add(-2 * time.Hour) }
+	sts, err := n.Sharetokens()
+	n.Contract.Now = nil
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := n.Transport.DialCircuit(context.Background(), "tcp", n.Hops(), n.TCPEcho, sts)
+
+	if err == nil {
+		c.Write([]byte("x"))
+		_, err = c.Read(make([]byte, 1))
+		c.Close()
+	}
+
+	if err == nil {
+		t.Fatal("expected circuit with expired sharetokens to fail")
+	}
+}
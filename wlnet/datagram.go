@@ -0,0 +1,235 @@
+// Copyright (c) 2022 Wireleap
+
+package wlnet
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MaxDatagramSize is the maximum size of a single datagram payload which can
+// be framed for transport over a stream.
+const MaxDatagramSize = 0xffff
+
+// ErrIdleTimeout is returned by SpliceDatagram when no datagrams were
+// exchanged for longer than the idle timeout.
+var ErrIdleTimeout error = idleTimeout{}
+
+type idleTimeout struct{}
+
+func (idleTimeout) Error() string   { return "datagram flow idle timeout" }
+func (idleTimeout) Timeout() bool   { return true }
+func (idleTimeout) Temporary() bool { return false }
+
+// WriteDatagram writes p to w as a single datagram frame: a 2-byte big-endian
+// length followed by the payload. The frame is written in one call so that
+// concurrent writers do not interleave frames.
+func WriteDatagram(w io.Writer, p []byte) error {
+	if len(p) > MaxDatagramSize {
+		return fmt.Errorf("datagram of %d bytes exceeds maximum size of %d", len(p), MaxDatagramSize)
+	}
+
+	b := make([]byte, 2+len(p))
+	binary.BigEndian.PutUint16(b, uint16(len(p)))
+	copy(b[2:], p)
+
+	_, err := w.Write(b)
+	return err
+}
+
+// ReadDatagram reads a single datagram frame from r into buf and returns the
+// length of the payload. If the payload does not fit into buf it is discarded
+// and io.ErrShortBuffer is returned.
+func ReadDatagram(r io.Reader, buf []byte) (int, error) {
+	var hdr [2]byte
+
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, err
+	}
+
+	n := int(binary.BigEndian.Uint16(hdr[:]))
+
+	if n > len(buf) {
+		if _, err := io.CopyN(io.Discard, r, int64(n)); err != nil {
+			return 0, unexpected(err)
+		}
+
+		return 0, io.ErrShortBuffer
+	}
+
+	if _, err := io.ReadFull(r, buf[:n]); err != nil {
+		return 0, unexpected(err)
+	}
+
+	return n, nil
+}
+
+// unexpected converts EOFs in the middle of a frame to io.ErrUnexpectedEOF.
+func unexpected(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+
+	return err
+}
+
+// DatagramConn is a net.Conn which preserves datagram boundaries over an
+// underlying stream connection using datagram framing. Every Write sends a
+// single datagram and every Read returns a single datagram.
+type DatagramConn struct {
+	net.Conn
+
+	rmu sync.Mutex
+	wmu sync.Mutex
+}
+
+// NewDatagramConn wraps the stream connection c in a DatagramConn.
+func NewDatagramConn(c net.Conn) *DatagramConn { return &DatagramConn{Conn: c} }
+
+// Read reads a single datagram into p.
+func (c *DatagramConn) Read(p []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+
+	return ReadDatagram(c.Conn, p)
+}
+
+// Write writes p as a single datagram.
+func (c *DatagramConn) Write(p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if err := WriteDatagram(c.Conn, p); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// SpliceDatagram splices the framed stream src and the datagram connection
+// dst together, preserving datagram boundaries. Every frame read from src is
+// sent as one datagram on dst and every datagram received on dst is written
+// as one frame to src. If no datagrams are exchanged in either direction for
+// idle, the flow is torn down and ErrIdleTimeout is returned. maxtime and ctx
+// work the same as in Splice. Returns the traffic stats of the flow counting
+// datagram payloads only.
+func SpliceDatagram(ctx context.Context, src io.ReadWriteCloser, dst net.Conn, maxtime, idle time.Duration) (stats Stats, err error) {
+	var up, down Direction
+
+	stats.Start = time.Now()
+
+	if maxtime != time.Second*0 {
+		dst.SetDeadline(time.Now().Add(maxtime))
+
+		if c, ok := src.(net.Conn); ok {
+			c.SetDeadline(time.Now().Add(maxtime))
+		} else {
+			t := time.AfterFunc(maxtime, func() { src.Close() })
+			defer t.Stop()
+		}
+	}
+
+	var (
+		ec   = make(chan error, 3)
+		last = stats.Start.UnixNano()
+		seen = func() { atomic.StoreInt64(&last, time.Now().UnixNano()) }
+		stop = make(chan struct{})
+	)
+
+	defer close(stop)
+
+	// src -> dst
+	go func() {
+		var (
+			buf = make([]byte, MaxDatagramSize)
+			w   = counter{Writer: dst, start: stats.Start, d: &up}
+		)
+
+		for {
+			n, err := ReadDatagram(src, buf)
+
+			if errors.Is(err, io.ErrShortBuffer) {
+				continue
+			}
+
+			if err != nil {
+				ec <- err
+				return
+			}
+
+			seen()
+
+			if _, err = w.Write(buf[:n]); err != nil {
+				ec <- err
+				return
+			}
+		}
+	}()
+
+	// dst -> src
+	go func() {
+		buf := make([]byte, MaxDatagramSize)
+
+		for {
+			n, err := dst.Read(buf)
+
+			if err != nil {
+				ec <- err
+				return
+			}
+
+			seen()
+
+			if err = WriteDatagram(src, buf[:n]); err != nil {
+				ec <- err
+				return
+			}
+
+			down.add(n, stats.Start)
+		}
+	}()
+
+	if idle != time.Second*0 {
+		go func() {
+			t := time.NewTicker(idle / 4)
+			defer t.Stop()
+
+			for {
+				select {
+				case <-stop:
+					return
+				case <-t.C:
+					if time.Since(time.Unix(0, atomic.LoadInt64(&last))) > idle {
+						ec <- ErrIdleTimeout
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	select {
+	case err = <-ec:
+	case <-ctx.Done():
+		err = nil
+	}
+
+	dst.Close()
+	src.Close()
+
+	if errors.Is(err, io.EOF) {
+		err = nil
+	}
+
+	// the copying goroutines may still be finishing, so load atomically
+	stats.Up, stats.Down = up.load(), down.load()
+	stats.Duration = time.Since(stats.Start)
+	return
+}
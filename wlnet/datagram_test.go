@@ -0,0 +1,137 @@
+// Copyright (c) 2022 Wireleap
+
+package wlnet
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDatagramFraming(t *testing.T) {
+	var (
+		b  bytes.Buffer
+		ps = [][]byte{test, {}, bytes.Repeat([]byte{'x'}, MaxDatagramSize)}
+	)
+
+	for _, p := range ps {
+		if err := WriteDatagram(&b, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := WriteDatagram(&b, make([]byte, MaxDatagramSize+1)); err == nil {
+		t.Fatal("oversized datagram written")
+	}
+
+	buf := make([]byte, MaxDatagramSize)
+
+	for _, p := range ps {
+		n, err := ReadDatagram(&b, buf)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(buf[:n], p) {
+			t.Fatalf("datagram mismatch: expected %d bytes, got %d", len(p), n)
+		}
+	}
+
+	if _, err := ReadDatagram(&b, buf); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+
+	// short buffer discards the datagram but keeps the stream usable
+	WriteDatagram(&b, test)
+	WriteDatagram(&b, test[:2])
+
+	if _, err := ReadDatagram(&b, buf[:2]); err != io.ErrShortBuffer {
+		t.Fatalf("expected short buffer error, got %v", err)
+	}
+
+	if n, err := ReadDatagram(&b, buf[:2]); err != nil || n != 2 {
+		t.Fatalf("expected 2 byte datagram, got %d bytes, %v", n, err)
+	}
+
+	// truncated frame
+	b.Write([]byte{0, 5, 'a'})
+
+	if _, err := ReadDatagram(&b, buf); err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected unexpected EOF, got %v", err)
+	}
+}
+
+func TestSpliceDatagram(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	// echo datagrams back one by one
+	go func() {
+		buf := make([]byte, MaxDatagramSize)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	uc, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c1, c2 := net.Pipe()
+	var (
+		ec = make(chan error, 1)
+		sc = make(chan Stats, 1)
+	)
+	go func() {
+		stats, err := SpliceDatagram(context.Background(), c2, uc, 0, 200*time.Millisecond)
+		sc <- stats
+		ec <- err
+	}()
+
+	dc := NewDatagramConn(c1)
+
+	for _, p := range [][]byte{test, test[:3], test[5:]} {
+		if _, err = dc.Write(p); err != nil {
+			t.Fatal(err)
+		}
+
+		buf := make([]byte, 64)
+		n, err := dc.Read(buf)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(buf[:n], p) {
+			t.Fatalf("datagram boundaries not preserved: sent %q, got %q", p, buf[:n])
+		}
+	}
+
+	select {
+	case err = <-ec:
+		if !errors.Is(err, ErrIdleTimeout) || !os.IsTimeout(err) {
+			t.Fatalf("expected idle timeout, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("idle flow was not torn down")
+	}
+
+	n := int64(len(test) + 3 + len(test) - 5)
+	if stats := <-sc; stats.Up.Bytes != n || stats.Down.Bytes != n {
+		t.Fatalf("expected %d bytes each way, got %+v", n, stats)
+	}
+}
@@ -0,0 +1,334 @@
+// Copyright (c) 2022 Wireleap
+
+// Package egress implements policies restricting which addresses relays are
+// allowed to connect to.
+package egress
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/wireleap/common/api/sharetoken"
+	"github.com/wireleap/common/api/status"
+)
+
+// Rules is the configuration of an egress policy. Networks are given in CIDR
+// notation or as single IP addresses, ports as single ports or inclusive
+// ranges like "8000-8100".
+type Rules struct {
+	// AllowNets, if not empty, restricts connections to these networks.
+	// Networks listed here are allowed even if they are private.
+	AllowNets []string `json:"allow_nets,omitempty"`
+	// DenyNets are networks connections are never allowed to.
+	DenyNets []string `json:"deny_nets,omitempty"`
+	// AllowPorts, if not empty, restricts connections to these ports.
+	AllowPorts []string `json:"allow_ports,omitempty"`
+	// DenyPorts are ports connections are never allowed to.
+	DenyPorts []string `json:"deny_ports,omitempty"`
+	// AllowPrivate disables the default denial of loopback, private,
+	// link-local, multicast and otherwise special-purpose networks.
+	AllowPrivate bool `json:"allow_private,omitempty"`
+}
+
+// PrivateNets are the networks denied by default.
+var PrivateNets = mustParseNets(
+	"0.0.0.0/8",          // "this" network
+	"10.0.0.0/8",         // RFC1918
+	"100.64.0.0/10",      // carrier-grade NAT
+	"127.0.0.0/8",        // loopback
+	"169.254.0.0/16",     // link-local, cloud metadata
+	"172.16.0.0/12",      // RFC1918
+	"192.0.0.0/24",       // IETF protocol assignments
+	"192.168.0.0/16",     // RFC1918
+	"198.18.0.0/15",      // benchmarking
+	"224.0.0.0/4",        // multicast
+	"240.0.0.0/4",        // reserved, broadcast
+	"::/128",             // unspecified
+	"::1/128",            // loopback
+	"64:ff9b::/96",       // NAT64
+	"fc00::/7",           // unique local
+	"fe80::/10",          // link-local
+	"ff00::/8",           // multicast
+	"2001:db8::/32",      // documentation
+	"2002::/16",          // 6to4, can embed any IPv4 address
+	"::/96",              // IPv4-compatible, deprecated
+	"100::/64",           // discard
+	"2001::/32",          // Teredo, can embed any IPv4 address
+	"192.88.99.0/24",     // 6to4 relay anycast
+	"255.255.255.255/32", // broadcast
+)
+
+func mustParseNets(ss ...string) []*net.IPNet {
+	ns, err := parseNets(ss)
+
+	if err != nil {
+		panic(err)
+	}
+
+	return ns
+}
+
+func parseNets(ss []string) (ns []*net.IPNet, err error) {
+	for _, s := range ss {
+		if !strings.ContainsRune(s, '/') {
+			ip := net.ParseIP(s)
+
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", s)
+			}
+
+			bits := 128
+
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+
+			ns = append(ns, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(s)
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q: %w", s, err)
+		}
+
+		ns = append(ns, n)
+	}
+
+	return
+}
+
+// portRange is an inclusive range of ports.
+type portRange struct{ lo, hi int }
+
+func parsePorts(ss []string) (ps []portRange, err error) {
+	for _, s := range ss {
+		var (
+			lo, hi = s, s
+			r      portRange
+		)
+
+		if i := strings.IndexByte(s, '-'); i >= 0 {
+			lo, hi = s[:i], s[i+1:]
+		}
+
+		if r.lo, err = strconv.Atoi(lo); err == nil {
+			r.hi, err = strconv.Atoi(hi)
+		}
+
+		if err != nil || r.lo < 0 || r.hi > 65535 || r.lo > r.hi {
+			return nil, fmt.Errorf("invalid port range %q", s)
+		}
+
+		ps = append(ps, r)
+	}
+
+	return
+}
+
+func inNets(ip net.IP, ns []*net.IPNet) bool {
+	for _, n := range ns {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func inPorts(port int, ps []portRange) bool {
+	for _, r := range ps {
+		if port >= r.lo && port <= r.hi {
+			return true
+		}
+	}
+
+	return false
+}
+
+// T is an egress policy.
+type T struct {
+	// LookupIP is used to resolve hostnames. If nil, net.DefaultResolver
+	// is used.
+	LookupIP func(ctx context.Context, network, host string) ([]net.IP, error)
+
+	allowNets, denyNets   []*net.IPNet
+	allowPorts, denyPorts []portRange
+	allowPrivate          bool
+}
+
+// New creates a new egress policy from r.
+func New(r Rules) (t *T, err error) {
+	t = &T{allowPrivate: r.AllowPrivate}
+
+	if t.allowNets, err = parseNets(r.AllowNets); err != nil {
+		return nil, err
+	}
+
+	if t.denyNets, err = parseNets(r.DenyNets); err != nil {
+		return nil, err
+	}
+
+	if t.allowPorts, err = parsePorts(r.AllowPorts); err != nil {
+		return nil, err
+	}
+
+	if t.denyPorts, err = parsePorts(r.DenyPorts); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// WithLookup returns a copy of t which resolves hostnames using lookup.
+func (t *T) WithLookup(lookup func(ctx context.Context, network, host string) ([]net.IP, error)) *T {
+	t2 := *t
+	t2.LookupIP = lookup
+	return &t2
+}
+
+// denied returns the status error for a connection to ip:port denied for
+// the reason why.
+func denied(ip net.IP, port int, why string) error {
+	return &status.T{
+		Code: http.StatusForbidden,
+		Desc: fmt.Sprintf("egress to %s denied by policy: %s", net.JoinHostPort(ip.String(), strconv.Itoa(port)), why),
+	}
+}
+
+// CheckIP checks whether the policy allows connecting to ip on port and
+// returns a status error with code 403 if not.
+func (t *T) CheckIP(ip net.IP, port int) error {
+	// IPv4-mapped IPv6 addresses are checked as IPv4
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	switch {
+	case inPorts(port, t.denyPorts):
+		return denied(ip, port, "port is denied")
+	case len(t.allowPorts) > 0 && !inPorts(port, t.allowPorts):
+		return denied(ip, port, "port is not allowed")
+	case inNets(ip, t.denyNets):
+		return denied(ip, port, "address is denied")
+	case inNets(ip, t.allowNets):
+		return nil
+	case len(t.allowNets) > 0:
+		return denied(ip, port, "address is not allowed")
+	case !t.allowPrivate && inNets(ip, PrivateNets):
+		return denied(ip, port, "address is private or reserved")
+	}
+
+	return nil
+}
+
+// Resolve resolves the host in hostport for the given network ("tcp",
+// "udp4" etc.) and returns the first resolved address allowed by the policy
+// as "ip:port", which should then be dialed instead of hostport so that the
+// checked address cannot change between checking and dialing. If no address
+// is allowed, the error for the first one is returned.
+func (t *T) Resolve(ctx context.Context, network, hostport string) (string, error) {
+	host, ps, err := net.SplitHostPort(hostport)
+
+	if err != nil {
+		return "", &status.T{Code: http.StatusBadRequest, Desc: err.Error()}
+	}
+
+	port, err := strconv.Atoi(ps)
+
+	if err != nil || port < 0 || port > 65535 {
+		return "", &status.T{Code: http.StatusBadRequest, Desc: fmt.Sprintf("invalid port %q", ps)}
+	}
+
+	var ips []net.IP
+
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		lookup := t.LookupIP
+
+		if lookup == nil {
+			lookup = net.DefaultResolver.LookupIP
+		}
+
+		if ips, err = lookup(ctx, ipNetwork(network), host); err != nil {
+			return "", &status.T{
+				Code: http.StatusBadGateway,
+				Desc: fmt.Sprintf("could not resolve %s: %s", host, err),
+			}
+		}
+	}
+
+	var first error
+
+	for _, ip := range ips {
+		if (network == "tcp4" || network == "udp4") && ip.To4() == nil {
+			continue
+		}
+
+		if (network == "tcp6" || network == "udp6") && ip.To4() != nil {
+			continue
+		}
+
+		err := t.CheckIP(ip, port)
+
+		if err == nil {
+			return net.JoinHostPort(ip.String(), ps), nil
+		}
+
+		if first == nil {
+			first = err
+		}
+	}
+
+	if first == nil {
+		first = &status.T{
+			Code: http.StatusBadGateway,
+			Desc: fmt.Sprintf("no suitable address found for %s", host),
+		}
+	}
+
+	return "", first
+}
+
+// ipNetwork returns the net.Resolver.LookupIP network for a dial network.
+func ipNetwork(network string) string {
+	switch {
+	case strings.HasSuffix(network, "4"):
+		return "ip4"
+	case strings.HasSuffix(network, "6"):
+		return "ip6"
+	default:
+		return "ip"
+	}
+}
+
+// Set is a default egress policy with optional per-contract overrides.
+type Set struct {
+	// Default is the policy used for connections without a per-contract
+	// policy.
+	Default *T
+	// Contracts maps service contract public keys to their policies.
+	Contracts map[string]*T
+}
+
+// For returns the policy to use for connections established with st, which
+// can be nil.
+func (s *Set) For(st *sharetoken.T) *T {
+	if s == nil {
+		return nil
+	}
+
+	if st != nil && st.Contract != nil {
+		if t, ok := s.Contracts[st.Contract.PublicKey.String()]; ok {
+			return t
+		}
+	}
+
+	return s.Default
+}
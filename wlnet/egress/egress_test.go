@@ -0,0 +1,133 @@
+// Copyright (c) 2022 Wireleap
+
+package egress
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/wireleap/common/api/servicekey"
+	"github.com/wireleap/common/api/sharetoken"
+	"github.com/wireleap/common/api/status"
+)
+
+func TestCheckIP(t *testing.T) {
+	def, err := New(Rules{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	custom, err := New(Rules{
+		AllowNets:  []string{"10.1.0.0/16", "203.0.113.7"},
+		DenyNets:   []string{"10.1.2.0/24"},
+		AllowPorts: []string{"80", "8000-8100"},
+		DenyPorts:  []string{"8080"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		p       *T
+		ip      string
+		port    int
+		allowed bool
+	}{
+		{def, "93.184.216.34", 443, true},
+		{def, "2606:2800:220:1::1", 443, true},
+		{def, "127.0.0.1", 80, false},
+		{def, "10.0.0.1", 80, false},
+		{def, "172.20.1.1", 80, false},
+		{def, "192.168.1.1", 80, false},
+		{def, "169.254.169.254", 80, false},
+		{def, "::1", 80, false},
+		{def, "::ffff:127.0.0.1", 80, false},
+		{def, "::ffff:169.254.169.254", 80, false},
+		{def, "fe80::1", 80, false},
+		{def, "fd00::1", 80, false},
+		{def, "0.0.0.0", 80, false},
+		{custom, "10.1.1.1", 80, true},
+		{custom, "10.1.1.1", 8050, true},
+		{custom, "10.1.1.1", 8080, false},
+		{custom, "10.1.1.1", 443, false},
+		{custom, "10.1.2.1", 80, false},
+		{custom, "203.0.113.7", 80, true},
+		{custom, "93.184.216.34", 80, false},
+	} {
+		err := c.p.CheckIP(net.ParseIP(c.ip), c.port)
+		if c.allowed && err != nil {
+			t.Errorf("%s:%d denied: %s", c.ip, c.port, err)
+		}
+		st := &status.T{}
+		if !c.allowed && (!errors.As(err, &st) || st.Code != http.StatusForbidden) {
+			t.Errorf("%s:%d not denied: %v", c.ip, c.port, err)
+		}
+	}
+
+	for _, r := range []Rules{
+		{AllowNets: []string{"10.0.0.0/33"}},
+		{DenyNets: []string{"not an ip"}},
+		{AllowPorts: []string{"100-10"}},
+		{DenyPorts: []string{"70000"}},
+	} {
+		if _, err = New(r); err == nil {
+			t.Errorf("invalid rules %+v accepted", r)
+		}
+	}
+}
+
+func TestResolve(t *testing.T) {
+	p, err := New(Rules{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.LookupIP = func(_ context.Context, _, host string) ([]net.IP, error) {
+		switch host {
+		case "rebind.example":
+			return []net.IP{net.ParseIP("127.0.0.1")}, nil
+		case "mixed.example":
+			return []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("93.184.216.34"), net.ParseIP("2606:2800:220:1::1")}, nil
+		}
+		return nil, errors.New("no such host")
+	}
+
+	// hostnames resolving to private addresses are denied
+	if _, err = p.Resolve(context.Background(), "tcp", "rebind.example:80"); err == nil {
+		t.Fatal("hostname resolving to loopback allowed")
+	}
+
+	// the first allowed address is pinned
+	addr, err := p.Resolve(context.Background(), "tcp", "mixed.example:443")
+	if err != nil || addr != "93.184.216.34:443" {
+		t.Fatalf("unexpected pinned address %s, %v", addr, err)
+	}
+	addr, err = p.Resolve(context.Background(), "tcp6", "mixed.example:443")
+	if err != nil || addr != "[2606:2800:220:1::1]:443" {
+		t.Fatalf("unexpected pinned IPv6 address %s, %v", addr, err)
+	}
+
+	st := &status.T{}
+	if _, err = p.Resolve(context.Background(), "tcp", "nx.example:80"); !errors.As(err, &st) || st.Code != http.StatusBadGateway {
+		t.Fatalf("expected resolution error, got %v", err)
+	}
+}
+
+func TestSet(t *testing.T) {
+	def, _ := New(Rules{})
+	lax, _ := New(Rules{AllowPrivate: true})
+
+	st := &sharetoken.T{Contract: &servicekey.Contract{PublicKey: make([]byte, 32)}}
+	s := &Set{Default: def, Contracts: map[string]*T{st.Contract.PublicKey.String(): lax}}
+
+	if s.For(st) != lax {
+		t.Fatal("per-contract policy not used")
+	}
+	if s.For(&sharetoken.T{}) != def || s.For(nil) != def {
+		t.Fatal("default policy not used")
+	}
+	if (*Set)(nil).For(st) != nil {
+		t.Fatal("nil set returned a policy")
+	}
+}
@@ -36,6 +36,13 @@ type T struct {
 // New creates a new T given a http.Roundtripper and a remote URL string to
 // connect to via h/2 as well as any headers that are needed.
 func New(t http.RoundTripper, remote string, headers map[string]string) (c *T, err error) {
+	return NewContext(context.Background(), t, remote, headers)
+}
+
+// NewContext is like New, but the request is aborted if ctx is done before
+// the response headers are received. Once they are, ctx does not affect the
+// connection anymore.
+func NewContext(ctx context.Context, t http.RoundTripper, remote string, headers map[string]string) (c *T, err error) {
 	c = &T{}
 
 	var (
@@ -44,8 +51,8 @@ func New(t http.RoundTripper, remote string, headers map[string]string) (c *T, e
 	)
 
 	pr, c.WriteCloser = io.Pipe()
-	ctx, cancel := context.WithCancel(context.Background())
-	req, err = http.NewRequestWithContext(ctx, http.MethodPut, remote, pr)
+	rctx, cancel := context.WithCancel(context.Background())
+	req, err = http.NewRequestWithContext(rctx, http.MethodPut, remote, pr)
 	if err != nil {
 		cancel()
 		return
@@ -67,33 +74,45 @@ func New(t http.RoundTripper, remote string, headers map[string]string) (c *T, e
 			c.ReadCloser = res.Body
 		} else {
 			c.cancel()
+			c.er = err
 		}
-		c.e <- err
+		// closed instead of sent to so that waiting for the result never
+		// blocks the request goroutine
 		close(c.e)
 	}()
 
+	if ctx.Done() != nil {
+		go func() {
+			select {
+			case <-ctx.Done():
+				cancel()
+			case <-c.e:
+			}
+		}()
+	}
+
 	return
 }
 
+// check waits for the initial request to complete and returns its error.
 func (c *T) check() error {
-	if err, ok := <-c.e; ok {
-		if err == nil {
-			return nil
-		} else {
-			c.mu.Lock()
-			c.er = err
-			c.mu.Unlock()
-			return err
-		}
-	} else {
-		return c.er
-	}
+	<-c.e
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.er
 }
 
 // Write writes the given data to a pipe the other end of which is read as the
 // sent request body.
 func (c *T) Write(p []byte) (int, error) {
-	return c.WriteCloser.Write(p)
+	n, err := c.WriteCloser.Write(p)
+	if err == io.ErrClosedPipe {
+		// the request body is closed if the request fails, report why
+		if rerr := c.check(); rerr != nil {
+			err = rerr
+		}
+	}
+	return n, err
 }
 
 // Read makes the initial request if needed, after which it reads from the
@@ -105,8 +124,12 @@ func (c *T) Read(p []byte) (int, error) {
 	n, err := c.ReadCloser.Read(p)
 	if err != nil {
 		// wl-encoded error?
-		if c.resp != nil && c.resp.Trailer != nil {
+		if c.resp != nil {
 			sth := c.resp.Trailer.Get(status.Header)
+			if sth == "" {
+				// errors before the splice starts are sent in headers
+				sth = c.resp.Header.Get(status.Header)
+			}
 			if sth != "" {
 				var st status.T
 				if err = json.Unmarshal([]byte(sth), &st); err != nil {
@@ -152,6 +175,12 @@ func (c *T) Close() error {
 	return nil
 }
 
+// CloseWrite closes the sent request body only, signaling EOF to the remote
+// end while the response body can still be read.
+func (c *T) CloseWrite() error {
+	return c.WriteCloser.Close()
+}
+
 // TODO?
 func (c *T) SetReadDeadline(t time.Time) error  { return c.SetDeadline(t) }
 func (c *T) SetWriteDeadline(t time.Time) error { return c.SetDeadline(t) }
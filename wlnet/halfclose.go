@@ -0,0 +1,113 @@
+// Copyright (c) 2022 Wireleap
+
+package wlnet
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// CloseWriter is implemented by connections which can be half-closed, that
+// is, signal EOF to the peer while still reading from it.
+type CloseWriter interface {
+	CloseWrite() error
+}
+
+// SpliceHalfClose splices src and dst together like Splice, but when one
+// direction reaches EOF, the EOF is propagated by half-closing the receiving
+// end and the other direction keeps going until it ends as well. If the
+// remaining direction goes without data for longer than idle (if not zero),
+// both ends are torn down and ErrIdleTimeout is returned. If the receiving
+// end does not implement CloseWriter, or on errors, both ends are torn down
+// immediately as in Splice. maxtime and ctx work the same as in Splice.
+func SpliceHalfClose(ctx context.Context, src, dst io.ReadWriteCloser, maxtime, idle time.Duration, bufsize int) (stats Stats, err error) {
+	var up, down Direction
+
+	stats.Start = time.Now()
+	limit(maxtime, src, dst)
+
+	type result struct {
+		to  io.ReadWriteCloser
+		err error
+	}
+
+	var (
+		rc   = make(chan result, 2)
+		pipe = func(from, to io.ReadWriteCloser, d *Direction) {
+			_, err := io.CopyBuffer(counter{Writer: to, start: stats.Start, d: d}, from, make([]byte, bufsize))
+			rc <- result{to, err}
+		}
+	)
+
+	go pipe(src, dst, &up)
+	go pipe(dst, src, &down)
+
+	var (
+		done    int
+		halfAt  time.Time
+		idlec   <-chan time.Time
+		stopped bool
+	)
+
+	if idle != time.Second*0 {
+		t := time.NewTicker(idle / 4)
+		defer t.Stop()
+		idlec = t.C
+	}
+
+	for done < 2 && !stopped {
+		select {
+		case r := <-rc:
+			done++
+
+			if r.err != nil {
+				err = r.err
+				stopped = true
+				break
+			}
+
+			if done == 2 {
+				break
+			}
+
+			if cw, ok := r.to.(CloseWriter); ok && cw.CloseWrite() == nil {
+				halfAt = time.Now()
+			} else {
+				stopped = true
+			}
+		case <-idlec:
+			if halfAt.IsZero() {
+				continue
+			}
+
+			// last activity of the direction still going
+			last := halfAt
+
+			for _, d := range []*Direction{&up, &down} {
+				if t := stats.Start.Add(d.load().Duration); t.After(last) {
+					last = t
+				}
+			}
+
+			if time.Since(last) > idle {
+				err = ErrIdleTimeout
+				stopped = true
+			}
+		case <-ctx.Done():
+			stopped = true
+		}
+	}
+
+	dst.Close()
+	src.Close()
+
+	// wait for stream termination
+	for ; done < 2; done++ {
+		<-rc
+	}
+
+	stats.Up, stats.Down = up, down
+	stats.Duration = time.Since(stats.Start)
+	return
+}
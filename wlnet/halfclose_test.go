@@ -0,0 +1,102 @@
+// Copyright (c) 2022 Wireleap
+
+package wlnet
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// tcpPair returns both ends of a loopback TCP connection.
+func tcpPair(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	c1, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c2, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { c1.Close(); c2.Close() })
+	return c1.(*net.TCPConn), c2.(*net.TCPConn)
+}
+
+func TestSpliceHalfClose(t *testing.T) {
+	client, a := tcpPair(t)
+	b, target := tcpPair(t)
+	ec := make(chan error, 1)
+
+	go func() {
+		_, err := SpliceHalfClose(context.Background(), a, b, 0, time.Second, bufsize)
+		ec <- err
+	}()
+
+	// request followed by EOF, response only after the EOF
+	client.Write(test)
+	client.CloseWrite()
+
+	req, err := io.ReadAll(target)
+	if err != nil || string(req) != string(test) {
+		t.Fatalf("target got %q, %v", req, err)
+	}
+	target.Write(test[:5])
+	target.Close()
+
+	res, err := io.ReadAll(client)
+	if err != nil || string(res) != string(test[:5]) {
+		t.Fatalf("client got %q, %v", res, err)
+	}
+	if err = <-ec; err != nil {
+		t.Fatal(err)
+	}
+
+	// remote which never responds after the EOF
+	client, a = tcpPair(t)
+	b, _ = tcpPair(t)
+
+	go func() {
+		_, err := SpliceHalfClose(context.Background(), a, b, 0, 100*time.Millisecond, bufsize)
+		ec <- err
+	}()
+
+	client.CloseWrite()
+
+	select {
+	case err = <-ec:
+		if !errors.Is(err, ErrIdleTimeout) {
+			t.Fatalf("expected idle timeout, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("half-closed connection was not torn down")
+	}
+
+	// cancellation
+	ctx, cancel := context.WithCancel(context.Background())
+	_, a = tcpPair(t)
+	b, _ = tcpPair(t)
+
+	go func() {
+		_, err := SpliceHalfClose(ctx, a, b, 0, 0, bufsize)
+		ec <- err
+	}()
+
+	cancel()
+
+	select {
+	case <-ec:
+	case <-time.After(5 * time.Second):
+		t.Fatal("splice was not cancelled")
+	}
+}
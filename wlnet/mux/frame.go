@@ -0,0 +1,74 @@
+// Copyright (c) 2022 Wireleap
+
+package mux
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Frame types.
+const (
+	// FrameOpen opens a new stream. Its payload is the JSON-encoded
+	// wlnet.Init describing the stream target. An empty FrameOpen sent in
+	// reply acknowledges that the stream was opened.
+	FrameOpen byte = iota + 1
+	// FrameData carries stream data.
+	FrameData
+	// FrameClose closes a stream. Its payload is an optional error message,
+	// usually a JSON-encoded status.T.
+	FrameClose
+	// FrameWindow grants the peer additional send window for a stream. Its
+	// payload is the 4-byte big-endian window increment.
+	FrameWindow
+)
+
+// headerSize is the size of a frame header: type (1 byte), stream id (4
+// bytes) and payload length (2 bytes).
+const headerSize = 7
+
+// MaxPayload is the maximum frame payload size.
+const MaxPayload = 0xffff
+
+// frame is a single mux protocol frame.
+type frame struct {
+	typ     byte
+	id      uint32
+	payload []byte
+}
+
+// writeFrame writes f to w in one call.
+func writeFrame(w io.Writer, f frame) error {
+	if len(f.payload) > MaxPayload {
+		return fmt.Errorf("mux frame payload of %d bytes exceeds maximum of %d", len(f.payload), MaxPayload)
+	}
+
+	b := make([]byte, headerSize+len(f.payload))
+	b[0] = f.typ
+	binary.BigEndian.PutUint32(b[1:5], f.id)
+	binary.BigEndian.PutUint16(b[5:7], uint16(len(f.payload)))
+	copy(b[headerSize:], f.payload)
+
+	_, err := w.Write(b)
+	return err
+}
+
+// readFrame reads a single frame from r.
+func readFrame(r io.Reader) (f frame, err error) {
+	var hdr [headerSize]byte
+
+	if _, err = io.ReadFull(r, hdr[:]); err != nil {
+		return
+	}
+
+	f.typ = hdr[0]
+	f.id = binary.BigEndian.Uint32(hdr[1:5])
+	f.payload = make([]byte, binary.BigEndian.Uint16(hdr[5:7]))
+
+	if _, err = io.ReadFull(r, f.payload); err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+
+	return
+}
@@ -0,0 +1,299 @@
+// Copyright (c) 2022 Wireleap
+
+// Package mux implements multiplexing of many logical streams over a single
+// wireleap connection. Streams are opened, closed and flow-controlled
+// independently using frames sent over the underlying connection.
+package mux
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/wireleap/common/wlnet"
+)
+
+// Command is the wlnet.Init command requesting a multiplexed session.
+const Command = "MUX"
+
+// DefaultWindow is the default per-stream receive window in bytes.
+const DefaultWindow = 256 * 1024
+
+// DefaultBacklog is the default number of opened streams waiting to be
+// accepted.
+const DefaultBacklog = 64
+
+// ErrClosed is returned when using a closed session.
+var ErrClosed = errors.New("mux session closed")
+
+// Options are the options of a mux session.
+type Options struct {
+	// Server sets whether this is the accepting (relay) end of the session.
+	// The two ends of a session must differ in this setting so the ids of
+	// streams they open do not collide.
+	Server bool
+	// Window is the per-stream receive window in bytes. If zero,
+	// DefaultWindow is used.
+	Window uint32
+	// Backlog is the number of streams opened by the peer which can wait
+	// to be accepted. Streams opened past this number are refused. If zero,
+	// DefaultBacklog is used.
+	Backlog int
+}
+
+// T is a mux session.
+type T struct {
+	Options
+
+	c   io.ReadWriteCloser
+	wmu sync.Mutex
+
+	mu      sync.Mutex
+	streams map[uint32]*Stream
+	next    uint32
+	err     error
+
+	accept chan *Stream
+	done   chan struct{}
+	once   sync.Once
+}
+
+// New creates a new mux session over c and starts processing incoming
+// frames.
+func New(c io.ReadWriteCloser, o Options) *T {
+	if o.Window == 0 {
+		o.Window = DefaultWindow
+	}
+
+	if o.Backlog == 0 {
+		o.Backlog = DefaultBacklog
+	}
+
+	t := &T{
+		Options: o,
+		c:       c,
+		streams: map[uint32]*Stream{},
+		next:    1,
+		accept:  make(chan *Stream, o.Backlog),
+		done:    make(chan struct{}),
+	}
+
+	if o.Server {
+		t.next = 2
+	}
+
+	go t.recv()
+	return t
+}
+
+// Open opens a new stream to the target described by p and waits until the
+// peer acknowledges it or ctx is done.
+func (t *T) Open(ctx context.Context, p *wlnet.Init) (*Stream, error) {
+	b, err := json.Marshal(p)
+
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal mux stream init: %w", err)
+	}
+
+	t.mu.Lock()
+
+	if t.err != nil {
+		t.mu.Unlock()
+		return nil, t.err
+	}
+
+	ack := make(chan error, 1)
+	s := t.newStream(t.next)
+	s.ack = ack
+	t.streams[s.id] = s
+	t.next += 2
+	t.mu.Unlock()
+
+	if err = t.write(frame{FrameOpen, s.id, b}); err != nil {
+		t.remove(s.id)
+		return nil, err
+	}
+
+	select {
+	case err = <-ack:
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-t.done:
+		err = t.Err()
+	}
+
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Accept waits for the next stream opened by the peer. The stream must be
+// acknowledged with Stream.Ack or refused with Stream.CloseWithError.
+func (t *T) Accept() (*Stream, error) {
+	select {
+	case s := <-t.accept:
+		return s, nil
+	case <-t.done:
+		return nil, t.Err()
+	}
+}
+
+// Done returns a channel which is closed when the session ends.
+func (t *T) Done() <-chan struct{} { return t.done }
+
+// Err returns the error which ended the session, if any.
+func (t *T) Err() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.err
+}
+
+// NumStreams returns the number of currently open streams.
+func (t *T) NumStreams() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.streams)
+}
+
+// Close closes the session and all of its streams.
+func (t *T) Close() error {
+	t.fail(ErrClosed)
+	return nil
+}
+
+// fail ends the session with err.
+func (t *T) fail(err error) {
+	t.once.Do(func() {
+		t.mu.Lock()
+		t.err = err
+		ss := t.streams
+		t.streams = map[uint32]*Stream{}
+		t.mu.Unlock()
+
+		// close done only once in-flight writes are finished so that c is
+		// never written to after the session has ended
+		t.c.Close()
+		t.wmu.Lock()
+		close(t.done)
+		t.wmu.Unlock()
+
+		for _, s := range ss {
+			s.remoteClose(err)
+		}
+	})
+}
+
+// write writes f to the underlying connection.
+func (t *T) write(f frame) error {
+	t.wmu.Lock()
+
+	select {
+	case <-t.done:
+		t.wmu.Unlock()
+		return t.Err()
+	default:
+	}
+
+	err := writeFrame(t.c, f)
+	t.wmu.Unlock()
+
+	if err != nil {
+		t.fail(err)
+	}
+
+	return err
+}
+
+func (t *T) stream(id uint32) *Stream {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.streams[id]
+}
+
+func (t *T) remove(id uint32) {
+	t.mu.Lock()
+	delete(t.streams, id)
+	t.mu.Unlock()
+}
+
+// recv processes incoming frames until the connection fails.
+func (t *T) recv() {
+	for {
+		f, err := readFrame(t.c)
+
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				err = ErrClosed
+			}
+
+			t.fail(err)
+			return
+		}
+
+		if err = t.handle(f); err != nil {
+			t.fail(err)
+			return
+		}
+	}
+}
+
+// handle processes a single incoming frame.
+func (t *T) handle(f frame) error {
+	switch f.typ {
+	case FrameOpen:
+		if s := t.stream(f.id); s != nil {
+			return s.acked()
+		}
+
+		if f.id%2 == t.next%2 {
+			// late acknowledgement of a stream already closed locally
+			return nil
+		}
+
+		p := &wlnet.Init{}
+
+		if err := json.Unmarshal(f.payload, p); err != nil {
+			return fmt.Errorf("could not parse mux stream %d init: %w", f.id, err)
+		}
+
+		t.mu.Lock()
+		s := t.newStream(f.id)
+		s.Init = p
+		t.streams[f.id] = s
+		t.mu.Unlock()
+
+		select {
+		case t.accept <- s:
+		default:
+			s.CloseWithError(fmt.Errorf("mux accept backlog full"))
+		}
+	case FrameData:
+		if s := t.stream(f.id); s != nil {
+			return s.push(f.payload)
+		}
+	case FrameClose:
+		if s := t.stream(f.id); s != nil {
+			t.remove(f.id)
+			s.remoteClose(closeError(f.payload))
+		}
+	case FrameWindow:
+		if len(f.payload) != 4 {
+			return fmt.Errorf("invalid mux window frame for stream %d", f.id)
+		}
+
+		if s := t.stream(f.id); s != nil {
+			s.grow(binary.BigEndian.Uint32(f.payload))
+		}
+	default:
+		return fmt.Errorf("unknown mux frame type %d", f.typ)
+	}
+
+	return nil
+}
@@ -0,0 +1,153 @@
+// Copyright (c) 2022 Wireleap
+
+package mux
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wireleap/common/api/status"
+	"github.com/wireleap/common/api/texturl"
+	"github.com/wireleap/common/wlnet"
+)
+
+func pair(t *testing.T, o Options) (client, server *T) {
+	c1, c2 := net.Pipe()
+	client = New(c1, o)
+	o.Server = true
+	server = New(c2, o)
+	t.Cleanup(func() { client.Close(); server.Close() })
+	return
+}
+
+func target(host string) *wlnet.Init {
+	return &wlnet.Init{
+		Command:  "CONNECT",
+		Protocol: "tcp",
+		Remote:   texturl.URLMustParse("target://" + host),
+	}
+}
+
+// serve echoes all streams except those for host "refused".
+func serve(s *T) {
+	for {
+		st, err := s.Accept()
+		if err != nil {
+			return
+		}
+		if st.Init.Remote.Hostname() == "refused" {
+			st.CloseWithError(&status.T{Code: http.StatusBadGateway, Desc: "refused", Origin: "target"})
+			continue
+		}
+		st.Ack()
+		go func() { io.Copy(st, st); st.Close() }()
+	}
+}
+
+func TestMux(t *testing.T) {
+	client, server := pair(t, Options{Window: 1024})
+	go serve(server)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			s, err := client.Open(context.Background(), target(fmt.Sprintf("host%d:80", i)))
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer s.Close()
+			// larger than the window to exercise flow control
+			p0 := bytes.Repeat([]byte{byte(i)}, 10000+i)
+			go s.Write(p0)
+			p1 := make([]byte, len(p0))
+			if _, err = io.ReadFull(s, p1); err != nil {
+				errs <- err
+				return
+			}
+			if !bytes.Equal(p0, p1) {
+				errs <- fmt.Errorf("stream %d: echo mismatch", i)
+			}
+		}(i)
+	}
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	// refused stream carries the status error
+	_, err := client.Open(context.Background(), target("refused:80"))
+	st := &status.T{}
+	if !errors.As(err, &st) || st.Code != http.StatusBadGateway || st.Origin != "target" {
+		t.Fatalf("expected refusal status, got %v", err)
+	}
+
+	// streams are closed with the session
+	s, err := client.Open(context.Background(), target("last:80"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Close()
+	s.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = s.Read(make([]byte, 1)); err == nil || errors.Is(err, io.EOF) {
+		t.Fatalf("expected session error, got %v", err)
+	}
+	if _, err = client.Open(context.Background(), target("after:80")); err == nil {
+		t.Fatal("stream opened on closed session")
+	}
+}
+
+func TestStreamClose(t *testing.T) {
+	client, server := pair(t, Options{})
+
+	go func() {
+		for i := 0; ; i++ {
+			s, err := server.Accept()
+			if err != nil {
+				return
+			}
+			s.Ack()
+			if i == 0 {
+				s.Write([]byte("bye"))
+				s.Close()
+			}
+		}
+	}()
+
+	s, err := client.Open(context.Background(), target("host:80"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(s)
+	if err != nil || string(b) != "bye" {
+		t.Fatalf("expected buffered data then EOF, got %q, %v", b, err)
+	}
+	if _, err = s.Write([]byte("x")); err == nil {
+		t.Fatal("write to remotely closed stream succeeded")
+	}
+
+	// deadlines
+	s2, err := client.Open(context.Background(), target("host:80"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s2.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err = s2.Read(make([]byte, 1)); !os.IsTimeout(err) {
+		t.Fatalf("expected deadline error, got %v", err)
+	}
+}
@@ -0,0 +1,352 @@
+// Copyright (c) 2022 Wireleap
+
+package mux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/wireleap/common/api/status"
+	"github.com/wireleap/common/wlnet"
+)
+
+// Stream is a single logical stream of a mux session. It implements
+// net.Conn.
+type Stream struct {
+	// Init is the init payload the peer sent when opening this stream. It is
+	// nil for streams opened locally.
+	Init *wlnet.Init
+
+	t  *T
+	id uint32
+
+	mu       sync.Mutex
+	buf      bytes.Buffer
+	consumed uint32
+	swin     uint32
+	closed   bool
+	rclosed  bool
+	rerr     error
+	rdl, wdl time.Time
+
+	ack   chan error
+	rwake chan struct{}
+	wwake chan struct{}
+}
+
+// newStream creates a new stream with id. t.mu must be held.
+func (t *T) newStream(id uint32) *Stream {
+	return &Stream{
+		t:     t,
+		id:    id,
+		swin:  t.Window,
+		rwake: make(chan struct{}, 1),
+		wwake: make(chan struct{}, 1),
+	}
+}
+
+// ID returns the id of the stream within its session.
+func (s *Stream) ID() uint32 { return s.id }
+
+// Ack acknowledges a stream opened by the peer, signaling that its target
+// was reached.
+func (s *Stream) Ack() error { return s.t.write(frame{FrameOpen, s.id, nil}) }
+
+// acked handles the acknowledgement of a locally opened stream.
+func (s *Stream) acked() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.ack == nil {
+		return fmt.Errorf("mux stream %d opened twice", s.id)
+	}
+
+	s.ack <- nil
+	s.ack = nil
+	return nil
+}
+
+// wake signals c without blocking.
+func wake(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+// push appends incoming data to the receive buffer.
+func (s *Stream) push(p []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil
+	}
+
+	if uint64(s.buf.Len())+uint64(s.consumed)+uint64(len(p)) > uint64(s.t.Window) {
+		return fmt.Errorf("mux stream %d exceeded its receive window", s.id)
+	}
+
+	s.buf.Write(p)
+	wake(s.rwake)
+	return nil
+}
+
+// grow increases the send window by n.
+func (s *Stream) grow(n uint32) {
+	s.mu.Lock()
+	s.swin += n
+	s.mu.Unlock()
+	wake(s.wwake)
+}
+
+// remoteClose marks the stream as closed by the peer with err, which is
+// returned by reads once the receive buffer is drained.
+func (s *Stream) remoteClose(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.rclosed {
+		return
+	}
+
+	s.rclosed = true
+	s.rerr = err
+
+	if s.ack != nil {
+		if err == nil {
+			err = fmt.Errorf("mux stream %d refused", s.id)
+		}
+
+		s.ack <- err
+		s.ack = nil
+	}
+
+	wake(s.rwake)
+	wake(s.wwake)
+}
+
+// closeError parses the error in a close frame payload.
+func closeError(p []byte) error {
+	if len(p) == 0 {
+		return nil
+	}
+
+	st := &status.T{}
+
+	if err := json.Unmarshal(p, st); err == nil && st.Code != 0 {
+		return st
+	}
+
+	return errors.New(string(p))
+}
+
+// wait waits for c to be signaled until the deadline dl.
+func wait(c chan struct{}, dl time.Time) error {
+	if dl.IsZero() {
+		<-c
+		return nil
+	}
+
+	d := time.Until(dl)
+
+	if d <= 0 {
+		return os.ErrDeadlineExceeded
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-c:
+		return nil
+	case <-t.C:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+// Read reads data from the stream.
+func (s *Stream) Read(p []byte) (int, error) {
+	for {
+		s.mu.Lock()
+
+		switch {
+		case s.closed:
+			s.mu.Unlock()
+			return 0, io.ErrClosedPipe
+		case s.buf.Len() > 0:
+			n, _ := s.buf.Read(p)
+			s.consumed += uint32(n)
+
+			var inc uint32
+
+			// grant window in batches to avoid a frame per read
+			if s.consumed >= s.t.Window/2 && !s.rclosed {
+				inc, s.consumed = s.consumed, 0
+			}
+
+			s.mu.Unlock()
+
+			if inc > 0 {
+				b := make([]byte, 4)
+				binary.BigEndian.PutUint32(b, inc)
+				s.t.write(frame{FrameWindow, s.id, b})
+			}
+
+			return n, nil
+		case s.rclosed:
+			err := s.rerr
+			s.mu.Unlock()
+
+			if err == nil {
+				err = io.EOF
+			}
+
+			return 0, err
+		}
+
+		dl := s.rdl
+		s.mu.Unlock()
+
+		if err := wait(s.rwake, dl); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Write writes data to the stream, blocking while the send window is
+// exhausted.
+func (s *Stream) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		s.mu.Lock()
+
+		switch {
+		case s.closed:
+			s.mu.Unlock()
+			return n, io.ErrClosedPipe
+		case s.rclosed:
+			err = s.rerr
+			s.mu.Unlock()
+
+			if err == nil {
+				err = io.ErrClosedPipe
+			}
+
+			return n, err
+		case s.swin == 0:
+			dl := s.wdl
+			s.mu.Unlock()
+
+			if err = wait(s.wwake, dl); err != nil {
+				return n, err
+			}
+
+			continue
+		}
+
+		m := len(p)
+
+		if m > MaxPayload {
+			m = MaxPayload
+		}
+
+		if uint32(m) > s.swin {
+			m = int(s.swin)
+		}
+
+		s.swin -= uint32(m)
+		s.mu.Unlock()
+
+		if err = s.t.write(frame{FrameData, s.id, p[:m]}); err != nil {
+			return n, err
+		}
+
+		n += m
+		p = p[m:]
+	}
+
+	return n, nil
+}
+
+// Close closes the stream.
+func (s *Stream) Close() error { return s.CloseWithError(nil) }
+
+// CloseWithError closes the stream, sending err to the peer as the reason.
+// If err is a *status.T it is received as such by the peer.
+func (s *Stream) CloseWithError(err error) error {
+	s.mu.Lock()
+
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+
+	s.closed = true
+	notify := !s.rclosed
+	s.mu.Unlock()
+
+	s.t.remove(s.id)
+	wake(s.rwake)
+	wake(s.wwake)
+
+	if !notify {
+		return nil
+	}
+
+	var p []byte
+
+	if err != nil {
+		p = []byte(err.Error())
+
+		if len(p) > MaxPayload {
+			p = p[:MaxPayload]
+		}
+	}
+
+	return s.t.write(frame{FrameClose, s.id, bytes.TrimSuffix(p, []byte{'\n'})})
+}
+
+// SetDeadline sets both the read and write deadlines.
+func (s *Stream) SetDeadline(t time.Time) error {
+	s.mu.Lock()
+	s.rdl, s.wdl = t, t
+	s.mu.Unlock()
+	wake(s.rwake)
+	wake(s.wwake)
+	return nil
+}
+
+// SetReadDeadline sets the read deadline.
+func (s *Stream) SetReadDeadline(t time.Time) error {
+	s.mu.Lock()
+	s.rdl = t
+	s.mu.Unlock()
+	wake(s.rwake)
+	return nil
+}
+
+// SetWriteDeadline sets the write deadline.
+func (s *Stream) SetWriteDeadline(t time.Time) error {
+	s.mu.Lock()
+	s.wdl = t
+	s.mu.Unlock()
+	wake(s.wwake)
+	return nil
+}
+
+// addr is the net.Addr of mux streams.
+type addr uint32
+
+func (a addr) Network() string { return "mux" }
+func (a addr) String() string  { return fmt.Sprintf("mux:%d", uint32(a)) }
+
+func (s *Stream) LocalAddr() net.Addr  { return addr(s.id) }
+func (s *Stream) RemoteAddr() net.Addr { return addr(s.id) }
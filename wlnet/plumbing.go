@@ -6,11 +6,11 @@ import (
 	"context"
 	"errors"
 	"io"
-	"log"
 	"net"
 	"time"
 
 	"github.com/wireleap/common/api/status"
+	"github.com/wireleap/common/logger"
 )
 
 // retransmit(src, dst, ec, bufsize) reads from src and writes to dst using a
@@ -21,31 +21,41 @@ func retransmit(src io.Reader, dst io.Writer, ec chan error, bufsize int) {
 	ec <- err
 }
 
-// splice(ctx, src, dst, maxtime, bufsize) splices src and dst together
-// end-to-end by performing a retransmit() in both directions with buffer size
-// bufsize. If maxtime is not zero, connections are limited to this
-// time-to-live. Can be cancelled through ctx.
-func Splice(ctx context.Context, src, dst io.ReadWriteCloser, maxtime time.Duration, bufsize int) (err error) {
-	if maxtime != time.Second*0 {
-		dl := time.Now().Add(maxtime)
+// limit(maxtime, cs...) limits the lifetime of connections cs to maxtime if
+// it is not zero, using deadlines if supported and closing them otherwise.
+func limit(maxtime time.Duration, cs ...io.ReadWriteCloser) {
+	if maxtime == time.Second*0 {
+		return
+	}
 
-		if c, ok := src.(net.Conn); ok {
-			c.SetDeadline(dl)
-		} else {
-			time.AfterFunc(maxtime, func() { src.Close() })
-		}
+	dl := time.Now().Add(maxtime)
 
-		if c, ok := dst.(net.Conn); ok {
-			c.SetDeadline(dl)
+	for _, c := range cs {
+		if nc, ok := c.(net.Conn); ok {
+			nc.SetDeadline(dl)
 		} else {
-			time.AfterFunc(maxtime, func() { dst.Close() })
+			c := c
+			time.AfterFunc(maxtime, func() { c.Close() })
 		}
 	}
+}
+
+// splice(ctx, src, dst, maxtime, bufsize) splices src and dst together
+// end-to-end by performing a retransmit() in both directions with buffer size
+// bufsize. If maxtime is not zero, connections are limited to this
+// time-to-live. Can be cancelled through ctx. Errors are logged to the
+// logger of ctx. Returns the traffic stats of the spliced connection.
+func Splice(ctx context.Context, src, dst io.ReadWriteCloser, maxtime time.Duration, bufsize int) (stats Stats, err error) {
+	var up, down Direction
+
+	stats.Start = time.Now()
+
+	limit(maxtime, src, dst)
 
 	ec := make(chan error)
 
-	go retransmit(src, dst, ec, bufsize)
-	go retransmit(dst, src, ec, bufsize)
+	go retransmit(src, counter{Writer: dst, start: stats.Start, d: &up}, ec, bufsize)
+	go retransmit(dst, counter{Writer: src, start: stats.Start, d: &down}, ec, bufsize)
 
 	cancelled := false
 	select {
@@ -53,7 +63,7 @@ func Splice(ctx context.Context, src, dst io.ReadWriteCloser, maxtime time.Durat
 	case err = <-ec:
 		st := &status.T{}
 		if err != nil && errors.As(err, &st) {
-			log.Printf("splice error: %s", err)
+			logger.FromContext(ctx).Warn("splice error", "error", err)
 		}
 	// Cancel flow
 	case <-ctx.Done():
@@ -72,5 +82,7 @@ func Splice(ctx context.Context, src, dst io.ReadWriteCloser, maxtime time.Durat
 		<-ec
 	}
 
+	stats.Up, stats.Down = up, down
+	stats.Duration = time.Since(stats.Start)
 	return
 }
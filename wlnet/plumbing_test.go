@@ -5,6 +5,7 @@ package wlnet
 import (
 	"bytes"
 	"context"
+	"io"
 	"net"
 	"testing"
 	"time"
@@ -73,3 +74,45 @@ func TestSplice(t *testing.T) {
 		t.Errorf("bytes.Compare returned %d for b vs test", n)
 	}
 }
+
+func TestSpliceStats(t *testing.T) {
+	a1, a2 := net.Pipe()
+	b1, b2 := net.Pipe()
+	sc := make(chan Stats, 1)
+
+	go func() {
+		stats, _ := Splice(context.Background(), a2, b1, time.Second*0, bufsize)
+		sc <- stats
+	}()
+
+	b := make([]byte, 64)
+
+	for i := 0; i < 3; i++ {
+		if _, err := a1.Write(test); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := io.ReadFull(b2, b[:len(test)]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := b2.Write(test[:5]); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := io.ReadFull(a1, b[:5]); err != nil {
+		t.Fatal(err)
+	}
+
+	a1.Close()
+	stats := <-sc
+
+	if stats.Up.Bytes != int64(3*len(test)) || stats.Down.Bytes != 5 || stats.Total() != int64(3*len(test)+5) {
+		t.Fatalf("unexpected splice stats: %+v", stats)
+	}
+
+	if stats.Up.Duration > stats.Duration || stats.Down.Duration > stats.Duration {
+		t.Fatalf("direction durations exceed splice duration: %+v", stats)
+	}
+}
@@ -0,0 +1,17 @@
+// Copyright (c) 2022 Wireleap
+
+package probe
+
+import "github.com/wireleap/common/metrics"
+
+var (
+	pingLatency = metrics.Default.Histogram(
+		"wireleap_probe_ping_seconds",
+		"Latency of successful relay pings in seconds.",
+		nil,
+	)
+	pingErrors = metrics.Default.Counter(
+		"wireleap_probe_ping_errors_total",
+		"Total number of failed relay pings.",
+	)
+)
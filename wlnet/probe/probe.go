@@ -0,0 +1,272 @@
+// Copyright (c) 2022 Wireleap
+
+// Package probe implements relay health probing using the PING command of
+// the wireleap:// protocol.
+package probe
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/wireleap/common/api/interfaces/clientrelay"
+	"github.com/wireleap/common/api/relayentry"
+	"github.com/wireleap/common/api/relaylist"
+	"github.com/wireleap/common/api/status"
+	"github.com/wireleap/common/wlnet"
+	"github.com/wireleap/common/wlnet/transport"
+)
+
+// Options is a struct which contains options for initializing a T.
+type Options struct {
+	// Timeout is the maximum time for a single ping.
+	Timeout time.Duration
+	// Decay is the weight in (0, 1] of the latest ping result when updating
+	// the health of a relay. Lower values make the health change slower.
+	Decay float64
+	// Concurrency is the maximum number of concurrent pings done by
+	// PingAll.
+	Concurrency int
+	// RefLatency is the latency at which the latency component of the
+	// health score is 0.5.
+	RefLatency time.Duration
+}
+
+// DefaultOptions are the default prober options.
+var DefaultOptions = Options{
+	Timeout:     10 * time.Second,
+	Decay:       0.3,
+	Concurrency: 16,
+	RefLatency:  200 * time.Millisecond,
+}
+
+// Health describes the health of a single relay as observed by pings.
+type Health struct {
+	// Latency is the decaying average latency of successful pings.
+	Latency time.Duration
+	// FailRate is the decaying average rate of failed pings in [0, 1].
+	FailRate float64
+	// Probes is the total number of pings done.
+	Probes int
+	// LastProbe is the time of the last ping.
+	LastProbe time.Time
+	// LastErr is the error of the last ping, if any.
+	LastErr error
+
+	ref time.Duration
+}
+
+// Score returns the health score in [0, 1] where higher is better.
+func (h *Health) Score() float64 {
+	lat := 1.0
+
+	if h.Latency > 0 {
+		lat = float64(h.ref) / float64(h.ref+h.Latency)
+	}
+
+	return (1 - h.FailRate) * lat
+}
+
+// T is a relay prober. It keeps track of the health of relays keyed by their
+// address.
+type T struct {
+	tt   *transport.T
+	opts Options
+
+	mu sync.Mutex
+	hs map[string]*Health
+}
+
+// New creates a new prober which pings relays using tt.
+func New(tt *transport.T, o Options) *T {
+	if o.Decay <= 0 || o.Decay > 1 {
+		o.Decay = DefaultOptions.Decay
+	}
+
+	if o.Concurrency <= 0 {
+		o.Concurrency = DefaultOptions.Concurrency
+	}
+
+	if o.RefLatency <= 0 {
+		o.RefLatency = DefaultOptions.RefLatency
+	}
+
+	return &T{tt: tt, opts: o, hs: map[string]*Health{}}
+}
+
+// Ping sends a PING to the relay r and records the result. The result is not
+// recorded if r has no address.
+func (t *T) Ping(ctx context.Context, r *relayentry.T) (d time.Duration, err error) {
+	if t.opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.opts.Timeout)
+		defer cancel()
+	}
+
+	d, err = Ping(ctx, t.tt, r)
+
+	if r != nil && r.Addr != nil {
+		t.record(r, d, err)
+	}
+
+	if err == nil {
+		pingLatency.Observe(d.Seconds())
+	} else {
+		pingErrors.Inc()
+	}
+
+	return
+}
+
+// PingAll pings all relays in rl concurrently and returns the errors
+// encountered keyed by the relay list key.
+func (t *T) PingAll(ctx context.Context, rl relaylist.T) map[string]error {
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		sem  = make(chan struct{}, t.opts.Concurrency)
+		errs = map[string]error{}
+	)
+
+	for k, r := range rl {
+		wg.Add(1)
+		sem <- struct{}{}
+
+		go func(k string, r *relayentry.T) {
+			defer func() { <-sem; wg.Done() }()
+
+			if _, err := t.Ping(ctx, r); err != nil {
+				mu.Lock()
+				errs[k] = err
+				mu.Unlock()
+			}
+		}(k, r)
+	}
+
+	wg.Wait()
+	return errs
+}
+
+// Health returns a copy of the recorded health of the relay r and whether it
+// was ever pinged. Relays without an address are never pinged.
+func (t *T) Health(r *relayentry.T) (Health, bool) {
+	if r == nil || r.Addr == nil {
+		return Health{ref: t.opts.RefLatency}, false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	h, ok := t.hs[r.Addr.String()]
+
+	if !ok {
+		return Health{ref: t.opts.RefLatency}, false
+	}
+
+	return *h, true
+}
+
+// Weight returns the health score of r for use as circuit.Options.Weight.
+// Relays which were never pinged have the maximum score.
+func (t *T) Weight(r *relayentry.T) float64 {
+	h, _ := t.Health(r)
+	return h.Score()
+}
+
+// record updates the health of r with the ping result d, err.
+func (t *T) record(r *relayentry.T, d time.Duration, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	k := r.Addr.String()
+	h, ok := t.hs[k]
+
+	if !ok {
+		h = &Health{ref: t.opts.RefLatency}
+		t.hs[k] = h
+	}
+
+	var (
+		a    = t.opts.Decay
+		fail = 0.0
+	)
+
+	if err != nil {
+		fail = 1
+	} else if h.Latency == 0 {
+		h.Latency = d
+	} else {
+		h.Latency = time.Duration(a*float64(d) + (1-a)*float64(h.Latency))
+	}
+
+	if h.Probes == 0 {
+		h.FailRate = fail
+	} else {
+		h.FailRate = a*fail + (1-a)*h.FailRate
+	}
+
+	h.Probes++
+	h.LastProbe = time.Now()
+	h.LastErr = err
+}
+
+// Ping sends a single PING to the relay r using tt and returns the round-trip
+// time. It can be cancelled through ctx.
+func Ping(ctx context.Context, tt *transport.T, r *relayentry.T) (time.Duration, error) {
+	if r == nil || r.Addr == nil {
+		return 0, fmt.Errorf("cannot ping relay without address")
+	}
+
+	start := time.Now()
+	// a fresh connection is dialed for every ping instead of reusing the
+	// pooled ones of tt, whose dials are not bound to ctx
+	nc, err := (&net.Dialer{}).DialContext(ctx, "tcp", r.Addr.Host)
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer nc.Close()
+
+	c, err := tt.DialWLContext(ctx, nc, "tcp", &r.Addr.URL, &wlnet.Init{
+		Command: "PING",
+		Version: &clientrelay.T.Version,
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+
+		c.Close()
+		nc.Close()
+	}()
+
+	st := &status.T{}
+
+	if err = json.NewDecoder(c).Decode(st); err != nil {
+		if ctx.Err() != nil {
+			return 0, ctx.Err()
+		}
+
+		return 0, err
+	}
+
+	if st.Code != http.StatusOK || st.Desc != "PONG" {
+		return 0, st
+	}
+
+	return time.Since(start), nil
+}
@@ -0,0 +1,124 @@
+// Copyright (c) 2022 Wireleap
+
+package probe
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wireleap/common/api/relayentry"
+	"github.com/wireleap/common/api/relaylist"
+	"github.com/wireleap/common/api/texturl"
+	"github.com/wireleap/common/wlnet/relay"
+	"github.com/wireleap/common/wlnet/transport"
+)
+
+func TestProbe(t *testing.T) {
+	tt := transport.New(transport.Options{TLSVerify: false, Timeout: 5 * time.Second})
+	s := httptest.NewUnstartedServer(relay.New(tt, relay.Options{ErrorOrigin: "test"}))
+	s.EnableHTTP2 = true
+	s.StartTLS()
+	defer s.Close()
+
+	var (
+		up = &relayentry.T{
+			Role: "backing",
+			Addr: texturl.URLMustParse(strings.Replace(s.URL, "https", "wireleap", 1)),
+		}
+		down = &relayentry.T{
+			Role: "backing",
+			Addr: texturl.URLMustParse("wireleap://127.0.0.1:1"),
+		}
+		rl = relaylist.T{"up": up, "down": down, "null": nil, "noaddr": {Role: "backing"}}
+		p  = New(tt, Options{Timeout: 5 * time.Second})
+	)
+
+	for i := 0; i < 3; i++ {
+		errs := p.PingAll(context.Background(), rl)
+
+		if errs["up"] != nil {
+			t.Fatal(errs["up"])
+		}
+
+		if errs["down"] == nil {
+			t.Fatal("ping to unreachable relay succeeded")
+		}
+
+		if errs["null"] == nil || errs["noaddr"] == nil {
+			t.Fatalf("ping to relays without address succeeded: %v", errs)
+		}
+	}
+
+	hup, ok := p.Health(up)
+	if !ok || hup.Probes != 3 || hup.FailRate != 0 || hup.Latency <= 0 {
+		t.Fatalf("unexpected health for reachable relay: %+v", hup)
+	}
+
+	hdown, ok := p.Health(down)
+	if !ok || hdown.Probes != 3 || hdown.FailRate != 1 {
+		t.Fatalf("unexpected health for unreachable relay: %+v", hdown)
+	}
+
+	if p.Weight(up) <= p.Weight(down) {
+		t.Fatal("unreachable relay has better score than reachable one")
+	}
+
+	for _, r := range []*relayentry.T{nil, rl["noaddr"]} {
+		if h, ok := p.Health(r); ok || h.Probes != 0 || p.Weight(r) != 1 {
+			t.Fatalf("unexpected health for relay without address: %+v, %v", h, ok)
+		}
+	}
+}
+
+func TestPingCancel(t *testing.T) {
+	// accepts connections but never completes the TLS handshake
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 1)
+
+	go func() {
+		if c, err := l.Accept(); err == nil {
+			accepted <- c
+		}
+	}()
+
+	tt := transport.New(transport.Options{TLSVerify: false, Timeout: time.Minute})
+	r := &relayentry.T{Addr: texturl.URLMustParse("wireleap://" + l.Addr().String())}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+
+	if _, err = Ping(ctx, tt, r); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+
+	if d := time.Since(start); d > 5*time.Second {
+		t.Fatalf("ping took %s despite cancellation", d)
+	}
+
+	// the stalled dial is abandoned
+	select {
+	case c := <-accepted:
+		defer c.Close()
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+		if _, err = io.Copy(io.Discard, c); err != nil {
+			t.Fatalf("expected stalled connection to be closed, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("relay was never dialed")
+	}
+}
@@ -7,12 +7,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
 
 	"github.com/wireleap/common/api/interfaces/clientrelay"
 	"github.com/wireleap/common/api/sharetoken"
 	"github.com/wireleap/common/api/texturl"
+	"github.com/wireleap/common/logger"
 
 	"github.com/blang/semver"
 )
@@ -32,7 +32,7 @@ type Init struct {
 func (i *Init) Headers() map[string]string {
 	b, err := json.Marshal(i)
 	if err != nil {
-		log.Printf("error when marshaling payload %+v: %s", i, err)
+		logger.Default.Error("error when marshaling payload", "payload", i, "error", err)
 		return map[string]string{}
 	}
 
@@ -78,16 +78,20 @@ func (i *Init) sanityCheck() error {
 		return fmt.Errorf("unknown protocol in payload: %s", i.Protocol)
 	}
 
-	switch i.Remote.Scheme {
-	case "wireleap", "https", "target":
-		// OK
-	default:
-		return fmt.Errorf("unknown URL scheme in payload: %s", i.Remote.Scheme)
-	}
-
 	switch i.Command {
 	case "CONNECT":
-		// OK
+		if i.Remote == nil {
+			return fmt.Errorf("no remote address in payload")
+		}
+
+		switch i.Remote.Scheme {
+		case "wireleap", "https", "target":
+			// OK
+		default:
+			return fmt.Errorf("unknown URL scheme in payload: %s", i.Remote.Scheme)
+		}
+	case "MUX":
+		// remotes are given per stream
 	default:
 		return fmt.Errorf("unknown command in payload: %s", i.Command)
 	}
@@ -0,0 +1,178 @@
+// Copyright (c) 2022 Wireleap
+
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/wireleap/common/api/status"
+)
+
+// Bucket is a token bucket limiting throughput to a rate in bytes per second
+// while allowing bursts of up to a given size.
+type Bucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewBucket creates a new full bucket with the given rate in bytes per second
+// and burst size in bytes. If burst is not positive, it is set to rate.
+func NewBucket(rate, burst int64) *Bucket {
+	if burst <= 0 {
+		burst = rate
+	}
+
+	return &Bucket{
+		rate:   float64(rate),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// NewBucketEvery creates a new full bucket gaining a token every interval
+// and holding up to burst tokens, which is useful for limiting events such
+// as requests rather than bytes. If burst is not positive, it is set to 1.
+func NewBucketEvery(interval time.Duration, burst int64) *Bucket {
+	if burst <= 0 {
+		burst = 1
+	}
+
+	return &Bucket{
+		rate:   float64(time.Second) / float64(interval),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// refill adds the tokens gained since the last refill. b.mu must be held.
+func (b *Bucket) refill() {
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	b.last = now
+
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+// reserve takes n tokens from the bucket and returns how long to wait until
+// they are available. Tokens can be taken in advance, so requests larger
+// than the burst size are delayed rather than refused.
+func (b *Bucket) reserve(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill()
+	b.tokens -= float64(n)
+
+	if b.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// Wait blocks until n bytes can be transferred or ctx is done. In the
+// latter case, the tokens are given back and the error of ctx is returned.
+func (b *Bucket) Wait(ctx context.Context, n int) error {
+	d := b.reserve(n)
+
+	if d <= 0 {
+		return nil
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		b.mu.Lock()
+		b.tokens += float64(n)
+		b.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// Take takes n tokens from the bucket if they are available without
+// waiting. Otherwise, no tokens are taken and the time until they will be
+// available is returned.
+func (b *Bucket) Take(n int) (ok bool, wait time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill()
+
+	if missing := float64(n) - b.tokens; missing > 0 {
+		return false, time.Duration(missing / b.rate * float64(time.Second))
+	}
+
+	b.tokens -= float64(n)
+	return true, 0
+}
+
+// Quota limits the number of bytes transferred within a time window.
+type Quota struct {
+	mu     sync.Mutex
+	limit  int64
+	window time.Duration
+	used   int64
+	start  time.Time
+}
+
+// NewQuota creates a new quota of limit bytes per window. If window is zero,
+// the quota never resets.
+func NewQuota(limit int64, window time.Duration) *Quota {
+	return &Quota{limit: limit, window: window, start: time.Now()}
+}
+
+// rollover starts a new window if the current one is over. q.mu must be
+// held.
+func (q *Quota) rollover(now time.Time) {
+	if q.window > 0 && now.Sub(q.start) >= q.window {
+		q.used = 0
+		q.start = now
+	}
+}
+
+// Use accounts for n bytes and returns status.ErrQuotaExceeded if this
+// exceeds the quota for the current window.
+func (q *Quota) Use(n int) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.rollover(time.Now())
+
+	if q.used+int64(n) > q.limit {
+		q.used = q.limit
+		return status.ErrQuotaExceeded
+	}
+
+	q.used += int64(n)
+	return nil
+}
+
+// Used returns the number of bytes used in the current window.
+func (q *Quota) Used() int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.rollover(time.Now())
+	return q.used
+}
+
+// expired returns whether the current window of q is over at now.
+func (q *Quota) expired(now time.Time) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.window > 0 && now.Sub(q.start) >= q.window
+}
@@ -0,0 +1,223 @@
+// Copyright (c) 2022 Wireleap
+
+// Package ratelimit provides bandwidth rate limiting and traffic quotas for
+// relayed connections.
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Options are the limits enforced by a T. Rates are in bytes per second and
+// count traffic in both directions; zero values disable the respective
+// limit.
+type Options struct {
+	// ConnRate and ConnBurst limit every single connection.
+	ConnRate, ConnBurst int64
+	// KeyRate and KeyBurst limit all connections sharing a key (usually
+	// the servicekey public key of the sharetoken) combined.
+	KeyRate, KeyBurst int64
+	// GlobalRate and GlobalBurst limit all connections combined.
+	GlobalRate, GlobalBurst int64
+	// KeyQuota is the maximum number of bytes all connections sharing a
+	// key can transfer within KeyQuotaWindow. If KeyQuotaWindow is zero,
+	// the quota never resets.
+	KeyQuota       int64
+	KeyQuotaWindow time.Duration
+}
+
+// sweepInterval is how often unused per-key state is cleaned up.
+const sweepInterval = time.Minute
+
+// T enforces rate limits and quotas on wrapped connections.
+type T struct {
+	Options
+
+	global *Bucket
+
+	mu    sync.Mutex
+	keys  map[string]*keyState
+	swept time.Time
+}
+
+// keyState holds the limits shared by connections with the same key.
+type keyState struct {
+	bucket *Bucket
+	quota  *Quota
+	refs   int
+}
+
+// New creates a new T enforcing the limits in o.
+func New(o Options) *T {
+	t := &T{Options: o, keys: map[string]*keyState{}, swept: time.Now()}
+
+	if o.GlobalRate > 0 {
+		t.global = NewBucket(o.GlobalRate, o.GlobalBurst)
+	}
+
+	return t
+}
+
+// acquire returns the state for key, creating it if needed.
+func (t *T) acquire(key string) *keyState {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+
+	if now.Sub(t.swept) >= sweepInterval {
+		for k, ks := range t.keys {
+			if ks.refs == 0 && (ks.quota == nil || ks.quota.expired(now)) {
+				delete(t.keys, k)
+			}
+		}
+
+		t.swept = now
+	}
+
+	ks := t.keys[key]
+
+	if ks == nil {
+		ks = &keyState{}
+
+		if t.KeyRate > 0 {
+			ks.bucket = NewBucket(t.KeyRate, t.KeyBurst)
+		}
+
+		if t.KeyQuota > 0 {
+			ks.quota = NewQuota(t.KeyQuota, t.KeyQuotaWindow)
+		}
+
+		t.keys[key] = ks
+	}
+
+	ks.refs++
+	return ks
+}
+
+// release drops a reference to the state for key. The state is kept around
+// until it is swept so quotas survive reconnects.
+func (t *T) release(ks *keyState) {
+	t.mu.Lock()
+	ks.refs--
+	t.mu.Unlock()
+}
+
+// Wrap wraps c so reads from and writes to it are subject to the limits of
+// t. Per-key limits are only enforced if key is not empty. Exceeding a quota
+// causes reads and writes to fail with status.ErrQuotaExceeded. A nil T
+// returns c as-is.
+func (t *T) Wrap(c io.ReadWriteCloser, key string) io.ReadWriteCloser {
+	if t == nil {
+		return c
+	}
+
+	w := &conn{ReadWriteCloser: c, t: t}
+
+	if t.ConnRate > 0 {
+		w.buckets = append(w.buckets, NewBucket(t.ConnRate, t.ConnBurst))
+	}
+
+	if key != "" && (t.KeyRate > 0 || t.KeyQuota > 0) {
+		w.ks = t.acquire(key)
+
+		if w.ks.bucket != nil {
+			w.buckets = append(w.buckets, w.ks.bucket)
+		}
+
+		w.quota = w.ks.quota
+	}
+
+	if t.global != nil {
+		w.buckets = append(w.buckets, t.global)
+	}
+
+	if len(w.buckets) == 0 && w.quota == nil {
+		return c
+	}
+
+	// closing the connection aborts waits for the buckets
+	w.ctx, w.cancel = context.WithCancel(context.Background())
+	return w
+}
+
+// conn is a rate limited connection.
+type conn struct {
+	io.ReadWriteCloser
+
+	t       *T
+	ks      *keyState
+	buckets []*Bucket
+	quota   *Quota
+	once    sync.Once
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+// charge accounts for n bytes, waiting for all buckets.
+func (c *conn) charge(n int) error {
+	if c.quota != nil {
+		if err := c.quota.Use(n); err != nil {
+			return err
+		}
+	}
+
+	for _, b := range c.buckets {
+		if err := b.Wait(c.ctx, n); err != nil {
+			return net.ErrClosed
+		}
+	}
+
+	return nil
+}
+
+// Read reads from the underlying connection and delays further reads to
+// stay within the rate limits. Data read past the quota is discarded.
+func (c *conn) Read(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(p)
+
+	if n > 0 {
+		if qerr := c.charge(n); qerr != nil {
+			return 0, qerr
+		}
+	}
+
+	return n, err
+}
+
+// Write waits until p can be written within the rate limits and writes it.
+func (c *conn) Write(p []byte) (int, error) {
+	if err := c.charge(len(p)); err != nil {
+		return 0, err
+	}
+
+	return c.ReadWriteCloser.Write(p)
+}
+
+// CloseWrite half-closes the underlying connection if it supports it, so
+// rate limited connections can still be spliced with half-close semantics.
+func (c *conn) CloseWrite() error {
+	if cw, ok := c.ReadWriteCloser.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+
+	return fmt.Errorf("%T does not support half-closing", c.ReadWriteCloser)
+}
+
+// Close closes the underlying connection, aborting pending waits.
+func (c *conn) Close() error {
+	c.once.Do(func() {
+		c.cancel()
+
+		if c.ks != nil {
+			c.t.release(c.ks)
+		}
+	})
+
+	return c.ReadWriteCloser.Close()
+}
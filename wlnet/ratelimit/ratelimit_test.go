@@ -0,0 +1,178 @@
+// Copyright (c) 2022 Wireleap
+
+package ratelimit
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/wireleap/common/api/status"
+)
+
+type rwc struct{ bytes.Buffer }
+
+func (*rwc) Close() error { return nil }
+
+func TestBucket(t *testing.T) {
+	b := NewBucket(1000, 100)
+	start := time.Now()
+
+	// burst goes through immediately, the rest at 1000 B/s
+	for i := 0; i < 4; i++ {
+		b.Wait(context.Background(), 100)
+	}
+
+	if d := time.Since(start); d < 250*time.Millisecond || d > 2*time.Second {
+		t.Fatalf("expected ~300ms of delay, got %s", d)
+	}
+}
+
+func TestBucketTake(t *testing.T) {
+	b := NewBucketEvery(100*time.Millisecond, 2)
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := b.Take(1); !ok {
+			t.Fatalf("take %d: expected burst to allow it", i)
+		}
+	}
+
+	ok, wait := b.Take(1)
+
+	if ok || wait <= 0 || wait > 100*time.Millisecond {
+		t.Fatalf("expected refusal with wait up to 100ms, got %v %s", ok, wait)
+	}
+
+	time.Sleep(wait + 10*time.Millisecond)
+
+	if ok, _ := b.Take(1); !ok {
+		t.Fatal("expected token to be available after waiting")
+	}
+}
+
+func TestQuota(t *testing.T) {
+	q := NewQuota(100, 100*time.Millisecond)
+
+	if err := q.Use(60); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Use(60); !errors.Is(err, status.ErrQuotaExceeded) {
+		t.Fatalf("expected quota error, got %v", err)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+
+	if q.Used() != 0 {
+		t.Fatal("quota did not reset after window")
+	}
+	if err := q.Use(60); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWrap(t *testing.T) {
+	l := New(Options{KeyQuota: 100})
+
+	// no limits without a key
+	var c0 rwc
+	if w := l.Wrap(&c0, ""); w != io.ReadWriteCloser(&c0) {
+		t.Fatal("connection without key was wrapped")
+	}
+
+	// quota is shared by connections with the same key and survives them
+	var c1, c2 rwc
+	w1 := l.Wrap(&c1, "key")
+	if _, err := w1.Write(make([]byte, 60)); err != nil {
+		t.Fatal(err)
+	}
+	w1.Close()
+
+	w2 := l.Wrap(&c2, "key")
+	defer w2.Close()
+	c2.Write(make([]byte, 60))
+	_, err := w2.Read(make([]byte, 60))
+	st := &status.T{}
+	if !errors.As(err, &st) || st.Code != status.ErrTooManyRequests.Code {
+		t.Fatalf("expected quota error, got %v", err)
+	}
+
+	// other keys are unaffected
+	var c3 rwc
+	w3 := l.Wrap(&c3, "other")
+	defer w3.Close()
+	if _, err = w3.Write(make([]byte, 60)); err != nil {
+		t.Fatal(err)
+	}
+
+	// per-connection rate
+	l = New(Options{ConnRate: 1000, ConnBurst: 100})
+	var c4 rwc
+	w4 := l.Wrap(&c4, "")
+	start := time.Now()
+	if _, err = w4.Write(make([]byte, 400)); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 250*time.Millisecond {
+		t.Fatalf("write was not rate limited: %s", d)
+	}
+}
+
+func TestBucketWaitCancel(t *testing.T) {
+	b := NewBucket(100, 100)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if err := b.Wait(ctx, 1000); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline error, got %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("wait was not cancelled: %s", d)
+	}
+
+	// cancelled waits give their tokens back
+	if ok, _ := b.Take(50); !ok {
+		t.Fatal("expected tokens of the cancelled wait to be given back")
+	}
+}
+
+type halfCloser struct {
+	rwc
+	closedWrite bool
+}
+
+func (c *halfCloser) CloseWrite() error { c.closedWrite = true; return nil }
+
+func TestWrapHalfClose(t *testing.T) {
+	l := New(Options{ConnRate: 100, ConnBurst: 100})
+
+	var c0 halfCloser
+	w0 := l.Wrap(&c0, "")
+	cw, ok := w0.(interface{ CloseWrite() error })
+	if !ok {
+		t.Fatal("wrapped connection does not implement CloseWrite")
+	}
+	if err := cw.CloseWrite(); err != nil || !c0.closedWrite {
+		t.Fatalf("CloseWrite was not forwarded: %v", err)
+	}
+
+	var c1 rwc
+	if err := l.Wrap(&c1, "").(interface{ CloseWrite() error }).CloseWrite(); err == nil {
+		t.Fatal("expected error half-closing a connection which does not support it")
+	}
+
+	// closing aborts pending writes
+	var c2 rwc
+	w2 := l.Wrap(&c2, "")
+	time.AfterFunc(50*time.Millisecond, func() { w2.Close() })
+	start := time.Now()
+	if _, err := w2.Write(make([]byte, 1000)); err == nil {
+		t.Fatal("expected write to fail after close")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("write was not aborted by close: %s", d)
+	}
+}
@@ -0,0 +1,37 @@
+// Copyright (c) 2022 Wireleap
+
+package relay
+
+import (
+	"strconv"
+
+	"github.com/wireleap/common/api/status"
+	"github.com/wireleap/common/metrics"
+)
+
+var (
+	connsActive = metrics.Default.Gauge(
+		"wireleap_relay_connections_active",
+		"Number of connections currently being relayed.",
+	)
+	connsTotal = metrics.Default.Counter(
+		"wireleap_relay_connections_total",
+		"Total number of relayed connections by protocol.",
+		"protocol",
+	)
+	dialErrors = metrics.Default.Counter(
+		"wireleap_relay_dial_errors_total",
+		"Total number of failed dials by status code and origin.",
+		"code", "origin",
+	)
+	spliceBytes = metrics.Default.Counter(
+		"wireleap_relay_splice_bytes_total",
+		"Total number of bytes relayed by direction.",
+		"direction",
+	)
+)
+
+// countDialError counts the dial error status st.
+func countDialError(st *status.T) {
+	dialErrors.Inc(strconv.Itoa(st.Code), st.Origin)
+}
@@ -4,10 +4,9 @@ package relay
 
 import (
 	"context"
-	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net"
 	"net/http"
 	"os"
@@ -15,15 +14,21 @@ import (
 
 	"github.com/wireleap/common/api/sharetoken"
 	"github.com/wireleap/common/api/status"
+	"github.com/wireleap/common/logger"
 	"github.com/wireleap/common/wlnet"
+	"github.com/wireleap/common/wlnet/egress"
 	"github.com/wireleap/common/wlnet/flushwriter"
 	"github.com/wireleap/common/wlnet/h2rwc"
+	"github.com/wireleap/common/wlnet/mux"
+	"github.com/wireleap/common/wlnet/ratelimit"
 	"github.com/wireleap/common/wlnet/transport"
 )
 
 type T struct {
 	*transport.T
 	Options
+
+	limiter *ratelimit.T
 }
 
 type Options struct {
@@ -33,15 +38,46 @@ type Options struct {
 	MaxTime time.Duration
 	// HandleST is a generic function which is called on incoming sharetokens.
 	HandleST func(*sharetoken.T) error
+	// HandleStats is an optional function which is called with the traffic
+	// stats of every connection once it is finished, along with the
+	// sharetoken it was established with (if any).
+	HandleStats func(*sharetoken.T, wlnet.Stats)
 	// ErrorOrigin is an optional string to use when signaling the origin of
 	// errors downstream.
 	ErrorOrigin string
 	// AllowLoopback sets whether to allow dialing loopback addresses. While
-	// useful for testing, it presents a security risk in production.
+	// useful for testing, it presents a security risk in production. It is
+	// only used if Egress is nil.
 	AllowLoopback bool
+	// Egress is the egress policy restricting the addresses the relay
+	// connects to, optionally per contract. If set, remote hostnames are
+	// resolved and checked before dialing and the checked address is
+	// dialed.
+	Egress *egress.Set
+	// UDPIdleTimeout is the maximum time a UDP flow can go without any
+	// datagrams before it is torn down. If zero, DefaultUDPIdleTimeout is
+	// used.
+	UDPIdleTimeout time.Duration
+	// HalfCloseTimeout enables half-close aware splicing of TCP
+	// connections if not zero: when the client signals EOF, it is passed on
+	// to the remote and the connection is kept open until the remote is
+	// done or has been idle for this long.
+	HalfCloseTimeout time.Duration
+	// Limits are the bandwidth rate limits and quotas enforced on relayed
+	// connections. Per-key limits apply to the servicekey public key of
+	// the sharetoken.
+	Limits ratelimit.Options
+	// Logger is the logger used by the relay. If nil, logger.Default is
+	// used.
+	Logger logger.Logger
 }
 
-func New(tt *transport.T, o Options) *T { return &T{T: tt, Options: o} }
+// DefaultUDPIdleTimeout is the default value of Options.UDPIdleTimeout.
+const DefaultUDPIdleTimeout = 2 * time.Minute
+
+func New(tt *transport.T, o Options) *T {
+	return &T{T: tt, Options: o, limiter: ratelimit.New(o.Limits)}
+}
 
 // isLoopback determines whether the presented address is a loopback interface
 // address.
@@ -69,7 +105,6 @@ func (t *T) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	h := w.Header()
-	h.Set("Trailer", "wl-status")
 
 	var c io.ReadWriteCloser = h2rwc.T{
 		Writer:     flushwriter.T{Writer: w},
@@ -100,7 +135,7 @@ func (t *T) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// ensure the connection is accepted and fail otherwise
-	ctx := context.Background()
+	ctx := logger.NewContext(r.Context(), logger.OrDefault(t.Logger))
 
 	if t.HandleST != nil {
 		err = t.HandleST(p.Token)
@@ -115,22 +150,93 @@ func (t *T) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	switch p.Command {
+	case "CONNECT":
+		// OK
+	case mux.Command:
+		// stream errors are sent in close frames
+		t.serveMux(ctx, c, p.Token)
+		return
+	default:
+		(&status.T{
+			Code:   http.StatusBadRequest,
+			Desc:   fmt.Sprintf("unknown command in payload: %s", p.Command),
+			Origin: origin,
+		}).ToHeader(h)
+		return
+	}
+
 	// signal target errors differently
-	if p.Remote.Scheme == "target" {
+	if p.Remote != nil && p.Remote.Scheme == "target" {
 		origin = "target"
 	}
 
-	// no dials to localhost (this relay's host)
-	if !t.AllowLoopback && isLoopback(p.Remote.Hostname()) {
-		(&status.T{
+	c2, st := t.dial(ctx, p, p.Token, origin)
+
+	if st != nil {
+		countDialError(st)
+		st.ToHeader(h)
+		return
+	}
+
+	// errors from here on are sent in the trailer since the headers will be
+	// sent by the first write
+	h.Set("Trailer", status.Header)
+	defer track(ctx)()
+
+	if st = t.splice(ctx, c, c2, p.Protocol, origin, p.Token); st != nil {
+		st.ToHeader(h)
+	}
+}
+
+// dial dials the remote requested in the init payload p using the egress
+// policy for the verified sharetoken st. Errors are returned as statuses with
+// the given origin, except for egress policy violations which originate from
+// this relay.
+func (t *T) dial(ctx context.Context, p *wlnet.Init, st *sharetoken.T, origin string) (net.Conn, *status.T) {
+	if p.Remote == nil {
+		return nil, &status.T{
+			Code:   http.StatusBadRequest,
+			Desc:   "no remote address in payload",
+			Origin: origin,
+		}
+	}
+
+	addr := p.Remote.Host
+
+	if pol := t.Egress.For(st); pol != nil {
+		if pol.LookupIP == nil {
+			// resolve using the transport resolver so lookups for policy
+			// checks do not go to the host resolver
+			pol = pol.WithLookup(t.T.LookupIP)
+		}
+
+		// policy violations are reported as coming from this relay
+		a, err := pol.Resolve(ctx, p.Protocol, addr)
+
+		if err != nil {
+			var st *status.T
+
+			if !errors.As(err, &st) {
+				st = &status.T{Code: http.StatusBadGateway, Desc: err.Error()}
+			}
+
+			stcopy := *st
+			stcopy.Origin = t.ErrorOrigin
+			return nil, &stcopy
+		}
+
+		addr = a
+	} else if !t.AllowLoopback && isLoopback(p.Remote.Hostname()) {
+		// no dials to localhost (this relay's host)
+		return nil, &status.T{
 			Code: http.StatusBadRequest,
 			Desc: fmt.Sprintf(
 				"loopback address '%s' requested, refusing to dial",
 				p.Remote.Hostname(),
 			),
 			Origin: origin,
-		}).ToHeader(h)
-		return
+		}
 	}
 
 	// hide requested target for privacy
@@ -141,62 +247,173 @@ func (t *T) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		shown = p.Remote.String()
 	}
 
-	log.Printf("Dialing %s connection to %s", p.Protocol, shown)
-	c2, err := t.T.Transport.DialContext(ctx, p.Protocol, p.Remote.Host)
+	logger.OrDefault(t.Logger).Info("dialing connection", "protocol", p.Protocol, "remote", shown)
+	c2, err := t.T.Transport.DialContext(ctx, p.Protocol, addr)
 
 	if err != nil {
 		// TODO more granular errors
 
 		if os.IsTimeout(err) {
-			(&status.T{
+			return nil, &status.T{
 				Code:   http.StatusRequestTimeout,
 				Desc:   err.Error(),
 				Origin: origin,
-			}).ToHeader(h)
-		} else {
-			(&status.T{
-				Code:   http.StatusBadGateway,
-				Desc:   err.Error(),
-				Origin: origin,
-			}).ToHeader(h)
+			}
 		}
 
-		return
+		return nil, &status.T{
+			Code:   http.StatusBadGateway,
+			Desc:   err.Error(),
+			Origin: origin,
+		}
 	}
 
-	err = wlnet.Splice(ctx, c, c2, t.MaxTime, t.BufSize)
+	return c2, nil
+}
 
-	if err != nil {
-		// TODO more granular errors
+// splice splices the client connection c and the dialed connection c2
+// according to protocol and reports the traffic stats for the sharetoken st.
+// Errors are returned as statuses with the given origin.
+func (t *T) splice(ctx context.Context, c io.ReadWriteCloser, c2 net.Conn, protocol string, origin string, st *sharetoken.T) *status.T {
+	var (
+		stats wlnet.Stats
+		err   error
+		key   string
+	)
 
-		if os.IsTimeout(err) {
-			(&status.T{
-				Code:   http.StatusRequestTimeout,
-				Desc:   err.Error(),
-				Origin: origin,
-			}).ToHeader(h)
+	if st != nil {
+		key = st.PublicKey.String()
+	}
+
+	c = t.limiter.Wrap(c, key)
+
+	connsTotal.Inc(protocol)
+	connsActive.Inc()
+	defer connsActive.Dec()
+
+	switch protocol {
+	case "udp", "udp4", "udp6":
+		// datagrams are framed over the h/2 stream
+		idle := t.UDPIdleTimeout
+
+		if idle == 0 {
+			idle = DefaultUDPIdleTimeout
+		}
+
+		stats, err = wlnet.SpliceDatagram(ctx, c, c2, t.MaxTime, idle)
+	default:
+		if t.HalfCloseTimeout != 0 {
+			stats, err = wlnet.SpliceHalfClose(ctx, c, c2, t.MaxTime, t.HalfCloseTimeout, t.BufSize)
 		} else {
-			(&status.T{
-				Code:   http.StatusGone,
-				Desc:   err.Error(),
-				Origin: origin,
-			}).ToHeader(h)
+			stats, err = wlnet.Splice(ctx, c, c2, t.MaxTime, t.BufSize)
 		}
 	}
+
+	spliceBytes.Add(float64(stats.Up.Bytes), "up")
+	spliceBytes.Add(float64(stats.Down.Bytes), "down")
+
+	if t.HandleStats != nil {
+		t.HandleStats(st, stats)
+	}
+
+	if err == nil {
+		return nil
+	}
+
+	// limit breaches are reported as-is since they originate here
+	var serr *status.T
+
+	if errors.As(err, &serr) {
+		lerr := *serr
+		lerr.Origin = t.ErrorOrigin
+		return &lerr
+	}
+
+	// TODO more granular errors
+
+	if os.IsTimeout(err) {
+		return &status.T{
+			Code:   http.StatusRequestTimeout,
+			Desc:   err.Error(),
+			Origin: origin,
+		}
+	}
+
+	return &status.T{
+		Code:   http.StatusGone,
+		Desc:   err.Error(),
+		Origin: origin,
+	}
 }
 
-// ListenAndServeHTTP listens on the specified address and passes the
-// connections to ServeHTTP.
-func (t *T) ListenAndServeHTTP(addr string) error {
-	l, err := tls.Listen("tcp", addr, t.Transport.TLSClientConfig)
-	if err != nil {
-		return err
+// serveMux serves a multiplexed session over c. Every stream of the session
+// is dialed and spliced the same way as a regular connection, but the
+// sharetoken st of the session init payload covers all of them.
+func (t *T) serveMux(ctx context.Context, c io.ReadWriteCloser, st *sharetoken.T) {
+	m := mux.New(c, mux.Options{Server: true})
+	defer m.Close()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			m.Close()
+		case <-m.Done():
+		}
+	}()
+
+	for {
+		s, err := m.Accept()
+
+		if err != nil {
+			return
+		}
+
+		go t.serveStream(ctx, s, st)
 	}
-	s := http.Server{
-		Addr:      addr,
-		Handler:   t,
-		TLSConfig: t.Transport.TLSClientConfig,
+}
+
+// serveStream serves a single stream of a multiplexed session.
+func (t *T) serveStream(ctx context.Context, s *mux.Stream, st *sharetoken.T) {
+	var (
+		p      = s.Init
+		origin = t.ErrorOrigin
+	)
+
+	if p.Command != "CONNECT" {
+		s.CloseWithError(&status.T{
+			Code:   http.StatusBadRequest,
+			Desc:   fmt.Sprintf("unknown command in stream payload: %s", p.Command),
+			Origin: origin,
+		})
+		return
 	}
-	go s.Serve(l)
-	return nil
+
+	if p.Remote != nil && p.Remote.Scheme == "target" {
+		origin = "target"
+	}
+
+	// the stream token is not verified, only the session one is
+	c2, serr := t.dial(ctx, p, st, origin)
+
+	if serr != nil {
+		countDialError(serr)
+		s.CloseWithError(serr)
+		return
+	}
+
+	if err := s.Ack(); err != nil {
+		c2.Close()
+		return
+	}
+
+	// the stream is closed by the splice, so errors cannot be sent back
+	defer track(ctx)()
+	t.splice(ctx, s, c2, p.Protocol, origin, st)
+}
+
+// ListenAndServeHTTP listens on the specified address and passes the
+// connections to ServeHTTP. Use Listen to be able to shut the server down.
+func (t *T) ListenAndServeHTTP(addr string) error {
+	_, err := t.Listen(addr)
+	return err
 }
@@ -4,11 +4,15 @@ package relay
 
 import (
 	"bytes"
+	"context"
 	"crypto/ed25519"
+	"crypto/tls"
+	"errors"
 	"io"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
@@ -16,8 +20,13 @@ import (
 	"github.com/wireleap/common/api/servicekey"
 	"github.com/wireleap/common/api/sharetoken"
 	"github.com/wireleap/common/api/signer"
+	"github.com/wireleap/common/api/status"
 	"github.com/wireleap/common/api/texturl"
+	"github.com/wireleap/common/api/tlscert"
 	"github.com/wireleap/common/wlnet"
+	"github.com/wireleap/common/wlnet/egress"
+	"github.com/wireleap/common/wlnet/mux"
+	"github.com/wireleap/common/wlnet/ratelimit"
 	"github.com/wireleap/common/wlnet/transport"
 )
 
@@ -115,3 +124,422 @@ func TestWLRelay(t *testing.T) {
 		t.Fatal("wireleap-relay received corrupted message", p0, p2[:n])
 	}
 }
+
+// dnsQuery returns a DNS-style query datagram for name with the given id.
+func dnsQuery(id uint16, name string) []byte {
+	b := []byte{byte(id >> 8), byte(id), 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0}
+	for _, l := range strings.Split(name, ".") {
+		b = append(b, byte(len(l)))
+		b = append(b, l...)
+	}
+	return append(b, 0, 0, 1, 0, 1)
+}
+
+func TestUDPRelay(t *testing.T) {
+	tt := transport.New(transport.Options{
+		TLSVerify: false,
+		Timeout:   time.Second * 5,
+	})
+	sc := make(chan wlnet.Stats, 1)
+	s := httptest.NewUnstartedServer(New(tt, Options{
+		BufSize:        2048,
+		AllowLoopback:  true,
+		UDPIdleTimeout: 500 * time.Millisecond,
+		HandleStats:    func(_ *sharetoken.T, s wlnet.Stats) { sc <- s },
+	}))
+	s.EnableHTTP2 = true
+	s.StartTLS()
+	defer s.Close()
+
+	// emulate resolver answering every query with the response bit set
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	go func() {
+		buf := make([]byte, wlnet.MaxDatagramSize)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			buf[2] |= 0x80
+			pc.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	init := &wlnet.Init{
+		Command:  "CONNECT",
+		Protocol: "udp",
+		Remote:   texturl.URLMustParse("target://" + pc.LocalAddr().String()),
+		Version:  &clientrelay.T.Version,
+	}
+	c, err := tt.DialWL(nil, "tcp", &texturl.URLMustParse(strings.Replace(s.URL, "https", "wireleap", 1)).URL, init)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dc := wlnet.NewDatagramConn(c)
+	defer dc.Close()
+
+	qs := [][]byte{
+		dnsQuery(1, "example.com"),
+		dnsQuery(2, "a.very.long.subdomain.example.org"),
+		dnsQuery(3, "wireleap.com"),
+	}
+	// send all queries before reading to check boundaries are kept
+	for _, q := range qs {
+		if _, err = dc.Write(q); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, q := range qs {
+		buf := make([]byte, 512)
+		n, err := dc.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != len(q) || buf[1] != q[1] || buf[2]&0x80 == 0 {
+			t.Fatalf("unexpected response to query %d: %x", q[1], buf[:n])
+		}
+	}
+
+	// idle flow is torn down with a timeout status
+	_, err = dc.Read(make([]byte, 512))
+	st := &status.T{}
+	if !errors.As(err, &st) || st.Code != http.StatusRequestTimeout {
+		t.Fatalf("expected idle timeout status, got %v", err)
+	}
+
+	// traffic is accounted
+	n := int64(0)
+	for _, q := range qs {
+		n += int64(len(q))
+	}
+	if stats := <-sc; stats.Up.Bytes != n || stats.Down.Bytes != n {
+		t.Fatalf("expected %d bytes each way, got %+v", n, stats)
+	}
+}
+
+func TestRelayQuota(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sk := servicekey.New(priv)
+	sk.Contract.SettlementOpen = time.Now().Add(time.Minute).Unix()
+	sk.Contract.SettlementClose = time.Now().Add(2 * time.Minute).Unix()
+	sk.Contract.Sign(signer.New(priv))
+	st, err := sharetoken.New(sk, pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tt := transport.New(transport.Options{
+		TLSVerify: false,
+		Timeout:   time.Second * 5,
+	})
+	s := httptest.NewUnstartedServer(New(tt, Options{
+		BufSize:       2048,
+		ErrorOrigin:   "backing",
+		AllowLoopback: true,
+		Limits:        ratelimit.Options{KeyQuota: 1024},
+	}))
+	s.EnableHTTP2 = true
+	s.StartTLS()
+	defer s.Close()
+
+	// emulate echo target
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() { io.Copy(c, c); c.Close() }()
+		}
+	}()
+
+	init := &wlnet.Init{
+		Command:  "CONNECT",
+		Protocol: "tcp",
+		Remote:   texturl.URLMustParse("target://" + l.Addr().String()),
+		Token:    st,
+		Version:  &clientrelay.T.Version,
+	}
+	c, err := tt.DialWL(nil, "tcp", &texturl.URLMustParse(strings.Replace(s.URL, "https", "wireleap", 1)).URL, init)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// within quota
+	p := make([]byte, 256)
+	if _, err = c.Write(p); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = io.ReadFull(c, p); err != nil {
+		t.Fatal(err)
+	}
+
+	// past quota
+	c.Write(make([]byte, 1024))
+	_, err = io.ReadAll(c)
+	sterr := &status.T{}
+	if !errors.As(err, &sterr) || sterr.Code != http.StatusTooManyRequests || sterr.Origin != "backing" {
+		t.Fatalf("expected quota status from relay, got %v", err)
+	}
+}
+
+func TestRelayEgress(t *testing.T) {
+	tt := transport.New(transport.Options{
+		TLSVerify: false,
+		Timeout:   time.Second * 5,
+	})
+	def, err := egress.New(egress.Rules{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := httptest.NewUnstartedServer(New(tt, Options{
+		BufSize:     2048,
+		ErrorOrigin: "backing",
+		Egress:      &egress.Set{Default: def},
+	}))
+	s.EnableHTTP2 = true
+	s.StartTLS()
+	defer s.Close()
+
+	for _, remote := range []string{"target://127.0.0.1:80", "target://localhost:80", "wireleap://[::ffff:169.254.169.254]:80"} {
+		init := &wlnet.Init{
+			Command:  "CONNECT",
+			Protocol: "tcp",
+			Remote:   texturl.URLMustParse(remote),
+			Version:  &clientrelay.T.Version,
+		}
+		c, err := tt.DialWL(nil, "tcp", &texturl.URLMustParse(strings.Replace(s.URL, "https", "wireleap", 1)).URL, init)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Write([]byte("hello"))
+		_, err = c.Read(make([]byte, 1))
+		c.Close()
+		st := &status.T{}
+		if !errors.As(err, &st) || st.Code != http.StatusForbidden || st.Origin != "backing" {
+			t.Fatalf("expected egress denial for %s, got %v", remote, err)
+		}
+	}
+}
+
+func TestServerShutdown(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := tlscert.Certificate(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt := transport.New(transport.Options{
+		Certs:   []tls.Certificate{cert},
+		Timeout: time.Second * 5,
+	})
+
+	// emulate echo target
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() { io.Copy(c, c); c.Close() }()
+		}
+	}()
+
+	init := &wlnet.Init{
+		Command:  "CONNECT",
+		Protocol: "tcp",
+		Remote:   texturl.URLMustParse("target://" + l.Addr().String()),
+		Version:  &clientrelay.T.Version,
+	}
+	dial := func(s *Server) net.Conn {
+		tt := transport.New(transport.Options{TLSVerify: false, Timeout: time.Second * 5})
+		c, err := tt.DialWL(nil, "tcp", &texturl.URLMustParse("wireleap://"+s.Addr).URL, init)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := []byte("hello")
+		if _, err = c.Write(p); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = io.ReadFull(c, p); err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	// drained before the deadline
+	s, err := New(rt, Options{BufSize: 2048, AllowLoopback: true}).Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := dial(s)
+	if n := s.Active(); n != 1 {
+		t.Fatalf("expected 1 active connection, got %d", n)
+	}
+	time.AfterFunc(50*time.Millisecond, func() { c.Close() })
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	forced, err := s.Shutdown(ctx)
+	if err != nil || forced != 0 {
+		t.Fatalf("expected clean shutdown, got %d forced, %v", forced, err)
+	}
+	if err = <-s.Err(); err != http.ErrServerClosed {
+		t.Fatalf("unexpected serve error: %v", err)
+	}
+	if connsTotal.Value("tcp") < 1 || spliceBytes.Value("up") < 5 || spliceBytes.Value("down") < 5 {
+		t.Fatal("relayed connection was not counted in metrics")
+	}
+
+	// forcibly closed at the deadline
+	s, err = New(rt, Options{BufSize: 2048, AllowLoopback: true}).Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c = dial(s)
+	defer c.Close()
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	forced, err = s.Shutdown(ctx)
+	if err != context.DeadlineExceeded || forced != 1 {
+		t.Fatalf("expected 1 forced close at deadline, got %d, %v", forced, err)
+	}
+	done := make(chan error, 1)
+	go func() { _, err := io.ReadAll(c); done <- err }()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection was not closed")
+	}
+	s, err = New(rt, Options{}).Listen(s.Addr)
+	if err != nil {
+		t.Fatalf("listener was not closed: %v", err)
+	}
+	s.Close()
+}
+
+// contractST returns a sharetoken for relay pubkey rpk issued under a new
+// contract.
+func contractST(t *testing.T, rpk ed25519.PublicKey) *sharetoken.T {
+	_, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sk := servicekey.New(priv)
+	sk.Contract.SettlementOpen = time.Now().Add(time.Minute).Unix()
+	sk.Contract.SettlementClose = time.Now().Add(2 * time.Minute).Unix()
+	sk.Contract.Sign(signer.New(priv))
+	st, err := sharetoken.New(sk, rpk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return st
+}
+
+func TestRelayMuxEgress(t *testing.T) {
+	rpk, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	laxST, strictST := contractST(t, rpk), contractST(t, rpk)
+	lax, err := egress.New(egress.Rules{AllowPrivate: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	def, err := egress.New(egress.Rules{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tt := transport.New(transport.Options{TLSVerify: false, Timeout: 5 * time.Second})
+	s := httptest.NewUnstartedServer(New(tt, Options{
+		BufSize:     2048,
+		ErrorOrigin: "backing",
+		Egress: &egress.Set{
+			Default:   def,
+			Contracts: map[string]*egress.T{laxST.Contract.PublicKey.String(): lax},
+		},
+	}))
+	s.EnableHTTP2 = true
+	s.StartTLS()
+	defer s.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() { io.Copy(c, c); c.Close() }()
+		}
+	}()
+
+	relayURL := &texturl.URLMustParse(strings.Replace(s.URL, "https", "wireleap", 1)).URL
+	target := texturl.URLMustParse("target://" + l.Addr().String())
+
+	// the policy is picked by the session token, not the stream token
+	for _, c := range []struct {
+		session, stream *sharetoken.T
+		allowed         bool
+	}{
+		{laxST, strictST, true},
+		{laxST, nil, true},
+		{strictST, laxST, false},
+	} {
+		conn, err := tt.DialWL(nil, "tcp", relayURL, &wlnet.Init{
+			Command:  mux.Command,
+			Protocol: "tcp",
+			Token:    c.session,
+			Version:  &clientrelay.T.Version,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := mux.New(conn, mux.Options{})
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		st, err := m.Open(ctx, &wlnet.Init{
+			Command:  "CONNECT",
+			Protocol: "tcp",
+			Remote:   target,
+			Token:    c.stream,
+			Version:  &clientrelay.T.Version,
+		})
+		cancel()
+		if err == nil {
+			p := []byte("hello")
+			st.Write(p)
+			_, err = io.ReadFull(st, p)
+		}
+		m.Close()
+		sterr := &status.T{}
+		switch {
+		case c.allowed && err != nil:
+			t.Fatalf("expected stream to be allowed, got %v", err)
+		case !c.allowed && (!errors.As(err, &sterr) || sterr.Code != http.StatusForbidden):
+			t.Fatalf("expected egress denial, got %v", err)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright (c) 2022 Wireleap
+
+package relay
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/wireleap/common/logger"
+)
+
+// Server is a running relay server which can be shut down gracefully.
+type Server struct {
+	*http.Server
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	errc   chan error
+	log    logger.Logger
+
+	mu     sync.Mutex
+	active int
+}
+
+// serverKey is the context key under which the Server handling a request is
+// stored.
+type serverKey struct{}
+
+// track marks the start of a spliced connection for the Server handling ctx,
+// if any, and returns the function marking its end.
+func track(ctx context.Context) func() {
+	s, ok := ctx.Value(serverKey{}).(*Server)
+
+	if !ok {
+		return func() {}
+	}
+
+	s.mu.Lock()
+	s.active++
+	s.mu.Unlock()
+
+	return func() {
+		s.mu.Lock()
+		s.active--
+		s.mu.Unlock()
+	}
+}
+
+// Active returns the number of connections currently being spliced.
+func (s *Server) Active() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.active
+}
+
+// Listen listens on the specified address and serves the connections using
+// ServeHTTP in the background until the returned Server is shut down.
+func (t *T) Listen(addr string) (*Server, error) {
+	l, err := tls.Listen("tcp", addr, t.Transport.TLSClientConfig)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return t.Serve(l), nil
+}
+
+// Serve serves the connections accepted on l using ServeHTTP in the
+// background until the returned Server is shut down. l should be a TLS
+// listener.
+func (t *T) Serve(l net.Listener) *Server {
+	s := &Server{errc: make(chan error, 1), log: logger.OrDefault(t.Logger)}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.Server = &http.Server{
+		Addr:      l.Addr().String(),
+		Handler:   t,
+		TLSConfig: t.Transport.TLSClientConfig,
+		// in-flight splices are stopped by cancelling this context
+		BaseContext: func(net.Listener) context.Context {
+			return context.WithValue(s.ctx, serverKey{}, s)
+		},
+	}
+
+	go func() { s.errc <- s.Server.Serve(l) }()
+	return s
+}
+
+// Shutdown stops accepting new connections and waits for in-flight ones to
+// finish until ctx is done. Connections still active at that point are
+// forcibly closed by cancelling their splices and their number is returned
+// along with the error of ctx.
+func (s *Server) Shutdown(ctx context.Context) (forced int, err error) {
+	defer s.cancel()
+
+	if err = s.Server.Shutdown(ctx); err == nil {
+		return 0, nil
+	}
+
+	forced = s.Active()
+	s.cancel()
+	s.Server.Close()
+	return forced, err
+}
+
+// Err returns a channel receiving the error which stopped the server from
+// serving, which is http.ErrServerClosed after Shutdown.
+func (s *Server) Err() <-chan error { return s.errc }
+
+// SignalHandler returns a handler for cli.SignalMap which shuts s down,
+// draining connections for up to drain, and then makes the process exit.
+func (s *Server) SignalHandler(drain time.Duration) func() bool {
+	return func() bool {
+		ctx, cancel := context.WithTimeout(context.Background(), drain)
+		defer cancel()
+
+		s.log.Info("draining relay connections", "drain", drain)
+
+		if forced, err := s.Shutdown(ctx); err != nil {
+			s.log.Warn("forcibly closed relay connections", "forced", forced, "error", err)
+		}
+
+		return true
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright (c) 2022 Wireleap
+
+package resolver
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// Cache defaults.
+const (
+	DefaultTTL         = time.Minute
+	DefaultMaxTTL      = time.Hour
+	DefaultNegativeTTL = 30 * time.Second
+	DefaultMaxEntries  = 4096
+)
+
+// Cache is a Resolver caching the results of another Resolver, including
+// hosts which were not found.
+type Cache struct {
+	// Resolver is the cached resolver.
+	Resolver Resolver
+	// TTL is the caching time for results of resolvers which do not report
+	// TTLs.
+	TTL time.Duration
+	// MaxTTL caps the caching time of results.
+	MaxTTL time.Duration
+	// NegativeTTL is the caching time for hosts which were not found.
+	NegativeTTL time.Duration
+	// MaxEntries is the maximum number of cached results.
+	MaxEntries int
+
+	mu      sync.Mutex
+	entries map[string]*entry
+}
+
+type entry struct {
+	ips     []net.IP
+	err     error
+	expires time.Time
+}
+
+// NewCache creates a new Cache for r with default settings.
+func NewCache(r Resolver) *Cache {
+	return &Cache{
+		Resolver:    r,
+		TTL:         DefaultTTL,
+		MaxTTL:      DefaultMaxTTL,
+		NegativeTTL: DefaultNegativeTTL,
+		MaxEntries:  DefaultMaxEntries,
+		entries:     map[string]*entry{},
+	}
+}
+
+// LookupIP implements Resolver.
+func (c *Cache) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return filter(network, []net.IP{ip}), nil
+	}
+
+	var (
+		key = network + "/" + canonical(host)
+		now = time.Now()
+	)
+
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	c.mu.Unlock()
+
+	if ok && now.Before(e.expires) {
+		return e.ips, e.err
+	}
+
+	var (
+		ips []net.IP
+		ttl = c.TTL
+		err error
+	)
+
+	if tr, ok := c.Resolver.(TTLResolver); ok {
+		ips, ttl, err = tr.LookupIPTTL(ctx, network, host)
+	} else {
+		ips, err = c.Resolver.LookupIP(ctx, network, host)
+	}
+
+	switch {
+	case IsNotFound(err):
+		ttl = c.NegativeTTL
+	case err != nil:
+		// transient errors are not cached
+		return nil, err
+	}
+
+	if c.MaxTTL > 0 && ttl > c.MaxTTL {
+		ttl = c.MaxTTL
+	}
+
+	if ttl > 0 {
+		c.store(key, &entry{ips: ips, err: err, expires: now.Add(ttl)}, now)
+	}
+
+	return ips, err
+}
+
+// store caches e under key, evicting entries if the cache is full.
+func (c *Cache) store(key string, e *entry, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.entries == nil {
+		c.entries = map[string]*entry{}
+	}
+
+	if c.MaxEntries > 0 && len(c.entries) >= c.MaxEntries {
+		for k, e := range c.entries {
+			if !now.Before(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+
+		// still full, evict arbitrary entries
+		for k := range c.entries {
+			if len(c.entries) < c.MaxEntries {
+				break
+			}
+
+			delete(c.entries, k)
+		}
+	}
+
+	c.entries[key] = e
+}
+
+// Purge removes all cached results.
+func (c *Cache) Purge() {
+	c.mu.Lock()
+	c.entries = map[string]*entry{}
+	c.mu.Unlock()
+}
@@ -0,0 +1,471 @@
+// Copyright (c) 2022 Wireleap
+
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/wireleap/common/wlnet"
+)
+
+// DNS message constants, see RFC 1035.
+const (
+	typeA     = 1
+	typeCNAME = 5
+	typeAAAA  = 28
+	classIN   = 1
+
+	flagQR = 1 << 15
+	flagTC = 1 << 9
+	flagRD = 1 << 8
+
+	rcodeNXDomain = 3
+)
+
+// maxMessageSize is the maximum size of a DNS message accepted over UDP.
+const maxMessageSize = 4096
+
+// buildQuery builds a recursive DNS query for name of type qtype.
+func buildQuery(id uint16, name string, qtype uint16) ([]byte, error) {
+	b := make([]byte, 12, 12+len(name)+6)
+	binary.BigEndian.PutUint16(b[0:], id)
+	binary.BigEndian.PutUint16(b[2:], flagRD)
+	binary.BigEndian.PutUint16(b[4:], 1)
+
+	if len(name) > 253 {
+		return nil, fmt.Errorf("name %q is too long", name)
+	}
+
+	for _, l := range bytes.Split([]byte(name), []byte{'.'}) {
+		if len(l) == 0 || len(l) > 63 {
+			return nil, fmt.Errorf("invalid name %q", name)
+		}
+
+		b = append(b, byte(len(l)))
+		b = append(b, l...)
+	}
+
+	b = append(b, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint16(b[len(b)-4:], qtype)
+	binary.BigEndian.PutUint16(b[len(b)-2:], classIN)
+	return b, nil
+}
+
+var errMalformed = errors.New("malformed DNS response")
+
+// maxPointers is the maximum number of compression pointers followed in a
+// name, which protects against pointer loops.
+const maxPointers = 16
+
+// readName reads the possibly compressed name at off and returns it in
+// canonical form along with the offset past it.
+func readName(b []byte, off int) (string, int, error) {
+	var (
+		name []byte
+		next = -1
+		ptrs = 0
+	)
+
+	for {
+		if off >= len(b) {
+			return "", 0, errMalformed
+		}
+
+		l := int(b[off])
+
+		switch {
+		case l == 0:
+			if next < 0 {
+				next = off + 1
+			}
+
+			return canonical(string(name)), next, nil
+		case l&0xc0 == 0xc0:
+			if off+2 > len(b) || ptrs == maxPointers {
+				return "", 0, errMalformed
+			}
+
+			if next < 0 {
+				next = off + 2
+			}
+
+			ptrs++
+			off = int(binary.BigEndian.Uint16(b[off:]) & 0x3fff)
+			continue
+		case l&0xc0 != 0 || off+1+l > len(b) || len(name)+1+l > 255:
+			return "", 0, errMalformed
+		}
+
+		name = append(append(name, b[off+1:off+1+l]...), '.')
+		off += 1 + l
+	}
+}
+
+// record is a resource record of a DNS response.
+type record struct {
+	name  string
+	typ   uint16
+	class uint16
+	ttl   uint32
+	// data is the record data, or the canonical target name for CNAME
+	// records.
+	data []byte
+}
+
+// parseResponse parses the addresses and their minimum TTL from the DNS
+// response b to the query of type qtype for host with the given id. The
+// question of the response must match the query. Only A or AAAA records
+// (as asked by qtype) owned by the queried name or by a name it is aliased
+// to through the CNAME records of the response are used; all other records
+// are ignored.
+func parseResponse(b []byte, id uint16, host string, qtype uint16) ([]net.IP, time.Duration, error) {
+	if len(b) < 12 {
+		return nil, 0, errMalformed
+	}
+
+	var (
+		flags = binary.BigEndian.Uint16(b[2:])
+		qd    = int(binary.BigEndian.Uint16(b[4:]))
+		an    = int(binary.BigEndian.Uint16(b[6:]))
+		name  = canonical(host)
+	)
+
+	switch {
+	case binary.BigEndian.Uint16(b) != id || flags&flagQR == 0:
+		return nil, 0, errMalformed
+	case flags&0xf == rcodeNXDomain:
+		return nil, 0, NotFound(host)
+	case flags&0xf != 0:
+		return nil, 0, fmt.Errorf("DNS query for %s failed with rcode %d", host, flags&0xf)
+	case qd != 1:
+		return nil, 0, errMalformed
+	}
+
+	qname, off, err := readName(b, 12)
+
+	switch {
+	case err != nil:
+		return nil, 0, err
+	case off+4 > len(b):
+		return nil, 0, errMalformed
+	case qname != name ||
+		binary.BigEndian.Uint16(b[off:]) != qtype ||
+		binary.BigEndian.Uint16(b[off+2:]) != classIN:
+		return nil, 0, fmt.Errorf("%w: question does not match query for %s", errMalformed, host)
+	}
+
+	off += 4
+	rrs := make([]record, 0, an)
+
+	for i := 0; i < an; i++ {
+		var r record
+
+		if r.name, off, err = readName(b, off); err != nil {
+			return nil, 0, err
+		}
+
+		if off+10 > len(b) {
+			return nil, 0, errMalformed
+		}
+
+		r.typ = binary.BigEndian.Uint16(b[off:])
+		r.class = binary.BigEndian.Uint16(b[off+2:])
+		r.ttl = binary.BigEndian.Uint32(b[off+4:])
+		rlen := int(binary.BigEndian.Uint16(b[off+8:]))
+		off += 10
+
+		if off+rlen > len(b) {
+			return nil, 0, errMalformed
+		}
+
+		if r.typ == typeCNAME {
+			target, _, err := readName(b, off)
+
+			if err != nil {
+				return nil, 0, err
+			}
+
+			r.data = []byte(target)
+		} else {
+			r.data = b[off : off+rlen]
+		}
+
+		rrs = append(rrs, r)
+		off += rlen
+	}
+
+	// follow CNAME chains from the queried name, in any order
+	owners := map[string]bool{name: true}
+
+	for found := true; found; {
+		found = false
+
+		for _, r := range rrs {
+			if r.typ == typeCNAME && r.class == classIN && owners[r.name] && !owners[string(r.data)] {
+				owners[string(r.data)] = true
+				found = true
+			}
+		}
+	}
+
+	var (
+		ips []net.IP
+		ttl uint32
+	)
+
+	for _, r := range rrs {
+		if r.class != classIN || r.typ != qtype || !owners[r.name] {
+			continue
+		}
+
+		if (r.typ == typeA && len(r.data) == net.IPv4len) || (r.typ == typeAAAA && len(r.data) == net.IPv6len) {
+			ips = append(ips, net.IP(append([]byte(nil), r.data...)))
+
+			if len(ips) == 1 || r.ttl < ttl {
+				ttl = r.ttl
+			}
+		}
+	}
+
+	if len(ips) == 0 {
+		return nil, 0, NotFound(host)
+	}
+
+	return ips, time.Duration(ttl) * time.Second, nil
+}
+
+// exchanger sends a DNS query and returns the response.
+type exchanger func(ctx context.Context, q []byte) ([]byte, error)
+
+// lookup resolves host for network using ex to send queries.
+func lookup(ctx context.Context, ex exchanger, network, host string, randomID bool) ([]net.IP, time.Duration, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return filter(network, []net.IP{ip}), 0, nil
+	}
+
+	name := canonical(host)
+	qtypes := []uint16{typeA, typeAAAA}
+
+	switch network {
+	case "ip4":
+		qtypes = qtypes[:1]
+	case "ip6":
+		qtypes = qtypes[1:]
+	}
+
+	var (
+		ips  []net.IP
+		ttl  time.Duration
+		errs []error
+	)
+
+	for _, qt := range qtypes {
+		var id uint16
+
+		if randomID {
+			var rb [2]byte
+
+			if _, err := rand.Read(rb[:]); err != nil {
+				return nil, 0, err
+			}
+
+			id = binary.BigEndian.Uint16(rb[:])
+		}
+
+		q, err := buildQuery(id, name, qt)
+
+		if err != nil {
+			return nil, 0, err
+		}
+
+		r, err := ex(ctx, q)
+
+		if err == nil {
+			var (
+				rips []net.IP
+				rttl time.Duration
+			)
+
+			if rips, rttl, err = parseResponse(r, id, host, qt); err == nil {
+				if len(ips) == 0 || rttl < ttl {
+					ttl = rttl
+				}
+
+				ips = append(ips, rips...)
+				continue
+			}
+		}
+
+		errs = append(errs, err)
+	}
+
+	if len(ips) > 0 {
+		return ips, ttl, nil
+	}
+
+	// only report not found if no query failed otherwise
+	for _, err := range errs {
+		if !IsNotFound(err) {
+			return nil, 0, err
+		}
+	}
+
+	return nil, 0, NotFound(host)
+}
+
+// Upstream resolves hostnames by querying a fixed DNS server.
+type Upstream struct {
+	// Addr is the address of the DNS server as host:port.
+	Addr string
+	// Network is "udp" (the default) or "tcp". Truncated UDP responses are
+	// retried over TCP.
+	Network string
+	// Timeout is the timeout of a single query. If zero, 5s is used.
+	Timeout time.Duration
+}
+
+// LookupIP implements Resolver.
+func (u *Upstream) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	ips, _, err := u.LookupIPTTL(ctx, network, host)
+	return ips, err
+}
+
+// LookupIPTTL implements TTLResolver.
+func (u *Upstream) LookupIPTTL(ctx context.Context, network, host string) ([]net.IP, time.Duration, error) {
+	return lookup(ctx, u.exchange, network, host, true)
+}
+
+func (u *Upstream) exchange(ctx context.Context, q []byte) ([]byte, error) {
+	if u.Network == "tcp" {
+		return u.exchangeNet(ctx, "tcp", q)
+	}
+
+	r, err := u.exchangeNet(ctx, "udp", q)
+
+	if err == nil && len(r) >= 4 && binary.BigEndian.Uint16(r[2:])&flagTC != 0 {
+		return u.exchangeNet(ctx, "tcp", q)
+	}
+
+	return r, err
+}
+
+func (u *Upstream) exchangeNet(ctx context.Context, network string, q []byte) ([]byte, error) {
+	timeout := u.Timeout
+
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var d net.Dialer
+	c, err := d.DialContext(ctx, network, u.Addr)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer c.Close()
+
+	if dl, ok := ctx.Deadline(); ok {
+		c.SetDeadline(dl)
+	}
+
+	buf := make([]byte, maxMessageSize)
+
+	if network == "tcp" {
+		// TCP messages are length-prefixed the same way as datagrams
+		if err = wlnet.WriteDatagram(c, q); err != nil {
+			return nil, err
+		}
+
+		buf = make([]byte, wlnet.MaxDatagramSize)
+		n, err := wlnet.ReadDatagram(c, buf)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return buf[:n], nil
+	}
+
+	if _, err = c.Write(q); err != nil {
+		return nil, err
+	}
+
+	for {
+		n, err := c.Read(buf)
+
+		if err != nil {
+			return nil, err
+		}
+
+		// ignore stray responses to other queries
+		if n >= 2 && bytes.Equal(buf[:2], q[:2]) {
+			return buf[:n], nil
+		}
+	}
+}
+
+// DoH resolves hostnames using DNS-over-HTTPS (RFC 8484).
+type DoH struct {
+	// URL is the URL of the DoH endpoint, e.g.
+	// https://cloudflare-dns.com/dns-query.
+	URL string
+	// Client is the HTTP client used for queries. If nil,
+	// http.DefaultClient is used.
+	Client *http.Client
+}
+
+// LookupIP implements Resolver.
+func (d *DoH) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	ips, _, err := d.LookupIPTTL(ctx, network, host)
+	return ips, err
+}
+
+// LookupIPTTL implements TTLResolver.
+func (d *DoH) LookupIPTTL(ctx context.Context, network, host string) ([]net.IP, time.Duration, error) {
+	// id 0 is recommended for DoH to make responses cacheable
+	return lookup(ctx, d.exchange, network, host, false)
+}
+
+func (d *DoH) exchange(ctx context.Context, q []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.URL, bytes.NewReader(q))
+
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	cl := d.Client
+
+	if cl == nil {
+		cl = http.DefaultClient
+	}
+
+	res, err := cl.Do(req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DoH query to %s failed with status %d", d.URL, res.StatusCode)
+	}
+
+	return io.ReadAll(io.LimitReader(res.Body, wlnet.MaxDatagramSize))
+}
@@ -0,0 +1,85 @@
+// Copyright (c) 2022 Wireleap
+
+// Package resolver provides pluggable hostname resolution for relays so that
+// target lookups can be directed to a resolver of choice instead of the host
+// resolver.
+package resolver
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+)
+
+// Resolver resolves hostnames to IP addresses. The network is one of "ip",
+// "ip4" or "ip6", the same as for net.Resolver.LookupIP.
+type Resolver interface {
+	LookupIP(ctx context.Context, network, host string) ([]net.IP, error)
+}
+
+// TTLResolver is a Resolver which also reports for how long resolved
+// addresses (or their absence) can be cached.
+type TTLResolver interface {
+	Resolver
+	LookupIPTTL(ctx context.Context, network, host string) ([]net.IP, time.Duration, error)
+}
+
+// NotFound returns the error returned by resolvers in this package when host
+// does not exist or has no addresses.
+func NotFound(host string) error {
+	return &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+// IsNotFound returns whether err signals that a host was not found.
+func IsNotFound(err error) bool {
+	de, ok := err.(*net.DNSError)
+	return ok && de.IsNotFound
+}
+
+// canonical returns the canonical form of host for lookups and caching.
+func canonical(host string) string {
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// filter returns the addresses from ips matching network.
+func filter(network string, ips []net.IP) (r []net.IP) {
+	for _, ip := range ips {
+		is4 := ip.To4() != nil
+
+		if (network == "ip4" && !is4) || (network == "ip6" && is4) {
+			continue
+		}
+
+		r = append(r, ip)
+	}
+
+	return
+}
+
+// System resolves hostnames using the host resolver.
+type System struct{}
+
+// LookupIP implements Resolver.
+func (System) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	return net.DefaultResolver.LookupIP(ctx, network, host)
+}
+
+// Static is an in-process resolver with a fixed mapping of hostnames to
+// addresses, mostly useful for tests.
+type Static map[string][]net.IP
+
+// LookupIP implements Resolver.
+func (s Static) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+
+	ips := filter(network, s[canonical(host)])
+
+	if len(ips) == 0 {
+		return nil, NotFound(host)
+	}
+
+	return ips, nil
+}
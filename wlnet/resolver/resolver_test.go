@@ -0,0 +1,446 @@
+// Copyright (c) 2022 Wireleap
+
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wireleap/common/wlnet"
+)
+
+// fakeDNS is an in-process DNS server answering from a fixed set of records
+// over UDP and TCP on the same port.
+type fakeDNS struct {
+	records  map[string][]net.IP
+	ttl      uint32
+	truncate bool // truncate all UDP responses
+
+	mu         sync.Mutex
+	udpQueries int
+	tcpQueries int
+
+	pc net.PacketConn
+	l  net.Listener
+}
+
+func newFakeDNS(t *testing.T, records map[string][]net.IP, ttl uint32, truncate bool) *fakeDNS {
+	f := &fakeDNS{records: records, ttl: ttl, truncate: truncate}
+	var err error
+	for i := 0; i < 10; i++ {
+		if f.l, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+			t.Fatal(err)
+		}
+		if f.pc, err = net.ListenPacket("udp", f.l.Addr().String()); err == nil {
+			break
+		}
+		f.l.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	go f.serveUDP()
+	go f.serveTCP()
+	t.Cleanup(func() {
+		f.pc.Close()
+		f.l.Close()
+	})
+	return f
+}
+
+func (f *fakeDNS) addr() string { return f.l.Addr().String() }
+
+func (f *fakeDNS) serveUDP() {
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, a, err := f.pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		f.mu.Lock()
+		f.udpQueries++
+		f.mu.Unlock()
+		f.pc.WriteTo(f.respond(buf[:n], f.truncate), a)
+	}
+}
+
+func (f *fakeDNS) serveTCP() {
+	for {
+		c, err := f.l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer c.Close()
+			buf := make([]byte, wlnet.MaxDatagramSize)
+			n, err := wlnet.ReadDatagram(c, buf)
+			if err != nil {
+				return
+			}
+			f.mu.Lock()
+			f.tcpQueries++
+			f.mu.Unlock()
+			wlnet.WriteDatagram(c, f.respond(buf[:n], false))
+		}()
+	}
+}
+
+func (f *fakeDNS) counts() (int, int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.udpQueries, f.tcpQueries
+}
+
+// respond builds the response to query q.
+func (f *fakeDNS) respond(q []byte, truncate bool) []byte {
+	name, end, err := readName(q, 12)
+	if err != nil {
+		return nil
+	}
+	qtype := binary.BigEndian.Uint16(q[end:])
+
+	r := append([]byte(nil), q[:end+4]...)
+	flags := uint16(flagQR | flagRD)
+	ips, ok := f.records[name]
+	switch {
+	case !ok:
+		flags |= rcodeNXDomain
+	case truncate:
+		flags |= flagTC
+		ips = nil
+	}
+	binary.BigEndian.PutUint16(r[2:], flags)
+
+	var an uint16
+	for _, ip := range ips {
+		rd, typ := []byte(ip.To4()), uint16(typeA)
+		if rd == nil {
+			rd, typ = []byte(ip.To16()), typeAAAA
+		}
+		if typ != qtype {
+			continue
+		}
+		an++
+		rr := make([]byte, 12)
+		binary.BigEndian.PutUint16(rr[0:], 0xc00c) // pointer to question name
+		binary.BigEndian.PutUint16(rr[2:], typ)
+		binary.BigEndian.PutUint16(rr[4:], classIN)
+		binary.BigEndian.PutUint32(rr[6:], f.ttl+uint32(an))
+		binary.BigEndian.PutUint16(rr[10:], uint16(len(rd)))
+		r = append(append(r, rr...), rd...)
+	}
+	binary.BigEndian.PutUint16(r[6:], an)
+	return r
+}
+
+var testRecords = map[string][]net.IP{
+	"example.test": {net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2"), net.ParseIP("2001:db8::1")},
+	"v4only.test":  {net.ParseIP("192.0.2.3")},
+}
+
+func sameIPs(a, b []net.IP) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func testLookups(t *testing.T, r TTLResolver) {
+	ctx := context.Background()
+	for _, c := range []struct {
+		network, host string
+		want          []net.IP
+	}{
+		{"ip", "example.test", testRecords["example.test"]},
+		{"ip", "Example.Test.", testRecords["example.test"]},
+		{"ip4", "example.test", testRecords["example.test"][:2]},
+		{"ip6", "example.test", testRecords["example.test"][2:]},
+		{"ip", "v4only.test", testRecords["v4only.test"]},
+		{"ip", "192.0.2.9", []net.IP{net.ParseIP("192.0.2.9")}},
+	} {
+		ips, ttl, err := r.LookupIPTTL(ctx, c.network, c.host)
+		if err != nil {
+			t.Fatalf("%s %s: %s", c.network, c.host, err)
+		}
+		if !sameIPs(ips, c.want) {
+			t.Errorf("%s %s: got %v, want %v", c.network, c.host, ips, c.want)
+		}
+		if net.ParseIP(c.host) == nil && ttl != 301*time.Second {
+			t.Errorf("%s %s: got ttl %s, want minimum of 301s", c.network, c.host, ttl)
+		}
+	}
+	for _, network := range []string{"ip", "ip6"} {
+		host := "missing.test"
+		if network == "ip6" {
+			host = "v4only.test"
+		}
+		if _, _, err := r.LookupIPTTL(ctx, network, host); !IsNotFound(err) {
+			t.Errorf("%s %s: expected not found error, got %v", network, host, err)
+		}
+	}
+}
+
+// response builds a response to a query for qname of type qtype carrying
+// the records rrs.
+func response(t *testing.T, qname string, qtype uint16, rrs ...[]byte) []byte {
+	r, err := buildQuery(0, qname, qtype)
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary.BigEndian.PutUint16(r[2:], flagQR|flagRD)
+	binary.BigEndian.PutUint16(r[6:], uint16(len(rrs)))
+	for _, rr := range rrs {
+		r = append(r, rr...)
+	}
+	return r
+}
+
+// rr builds an uncompressed resource record for name with a TTL of 60s.
+func rr(t *testing.T, name string, typ uint16, data []byte) []byte {
+	r, err := buildQuery(0, name, typ)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r = append(r[12:], 0, 0, 0, 60, 0, 0)
+	binary.BigEndian.PutUint16(r[len(r)-2:], uint16(len(data)))
+	return append(r, data...)
+}
+
+// cname returns the CNAME record data for target.
+func cname(t *testing.T, target string) []byte {
+	q, err := buildQuery(0, target, typeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q[12 : len(q)-4]
+}
+
+func TestParseResponse(t *testing.T) {
+	var (
+		v4 = []byte(net.ParseIP("192.0.2.1").To4())
+		v6 = []byte(net.ParseIP("2001:db8::1"))
+	)
+	for _, c := range []struct {
+		name string
+		b    []byte
+		want []net.IP
+		err  error
+	}{
+		{"owner", response(t, "a.test", typeA, rr(t, "A.test", typeA, v4)), []net.IP{v4}, nil},
+		{"other owner", response(t, "a.test", typeA, rr(t, "b.test", typeA, v4)), nil, NotFound("a.test")},
+		{"unasked type", response(t, "a.test", typeA, rr(t, "a.test", typeAAAA, v6)), nil, NotFound("a.test")},
+		{"cname chain", response(t, "a.test", typeA,
+			rr(t, "c.test", typeA, v4),
+			rr(t, "b.test", typeCNAME, cname(t, "c.test")),
+			rr(t, "a.test", typeCNAME, cname(t, "b.test")),
+			rr(t, "d.test", typeA, []byte{192, 0, 2, 66}),
+		), []net.IP{v4}, nil},
+		{"unrelated cname", response(t, "a.test", typeA,
+			rr(t, "x.test", typeCNAME, cname(t, "b.test")),
+			rr(t, "b.test", typeA, v4),
+		), nil, NotFound("a.test")},
+		{"other question", response(t, "b.test", typeA, rr(t, "b.test", typeA, v4)), nil, errMalformed},
+		{"other question type", response(t, "a.test", typeAAAA, rr(t, "a.test", typeA, v4)), nil, errMalformed},
+		{"pointer loop", append(response(t, "a.test", typeA)[:12], 0xc0, 12, 0, 1, 0, 1), nil, errMalformed},
+	} {
+		ips, _, err := parseResponse(c.b, 0, "a.test", typeA)
+		if !errors.Is(err, c.err) && !(IsNotFound(c.err) && IsNotFound(err)) {
+			t.Errorf("%s: expected error %v, got %v", c.name, c.err, err)
+		}
+		if !sameIPs(ips, c.want) {
+			t.Errorf("%s: got %v, want %v", c.name, ips, c.want)
+		}
+	}
+}
+
+func TestUpstream(t *testing.T) {
+	f := newFakeDNS(t, testRecords, 300, false)
+	for _, network := range []string{"udp", "tcp"} {
+		t.Run(network, func(t *testing.T) {
+			testLookups(t, &Upstream{Addr: f.addr(), Network: network, Timeout: time.Second})
+		})
+	}
+}
+
+func TestUpstreamTruncated(t *testing.T) {
+	f := newFakeDNS(t, testRecords, 300, true)
+	u := &Upstream{Addr: f.addr(), Timeout: time.Second}
+	ips, err := u.LookupIP(context.Background(), "ip4", "example.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sameIPs(ips, testRecords["example.test"][:2]) {
+		t.Errorf("got %v", ips)
+	}
+	if udp, tcp := f.counts(); udp != 1 || tcp != 1 {
+		t.Errorf("expected 1 UDP and 1 TCP query, got %d and %d", udp, tcp)
+	}
+}
+
+func TestDoH(t *testing.T) {
+	f := &fakeDNS{records: testRecords, ttl: 300}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/dns-query" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/dns-message" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		q, err := io.ReadAll(r.Body)
+		if err != nil || len(q) < 12 || !bytes.Equal(q[:2], []byte{0, 0}) {
+			http.Error(w, "bad query", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(f.respond(q, false))
+	}))
+	defer s.Close()
+
+	testLookups(t, &DoH{URL: s.URL + "/dns-query", Client: s.Client()})
+
+	_, err := (&DoH{URL: s.URL + "/404", Client: s.Client()}).LookupIP(context.Background(), "ip", "example.test")
+	if err == nil || IsNotFound(err) {
+		t.Errorf("expected HTTP error, got %v", err)
+	}
+}
+
+func TestStatic(t *testing.T) {
+	s := Static(testRecords)
+	ips, err := s.LookupIP(context.Background(), "ip6", "EXAMPLE.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sameIPs(ips, testRecords["example.test"][2:]) {
+		t.Errorf("got %v", ips)
+	}
+	if _, err = s.LookupIP(context.Background(), "ip", "missing.test"); !IsNotFound(err) {
+		t.Errorf("expected not found error, got %v", err)
+	}
+}
+
+// counting is a Resolver counting its lookups.
+type counting struct {
+	Resolver
+	mu   sync.Mutex
+	n    int
+	fail error
+}
+
+func (c *counting) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	c.mu.Lock()
+	c.n++
+	fail := c.fail
+	c.mu.Unlock()
+	if fail != nil {
+		return nil, fail
+	}
+	return c.Resolver.LookupIP(ctx, network, host)
+}
+
+func (c *counting) count() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.n
+}
+
+func TestCache(t *testing.T) {
+	ctx := context.Background()
+	cr := &counting{Resolver: Static(testRecords)}
+	c := NewCache(cr)
+	c.TTL = 100 * time.Millisecond
+	c.NegativeTTL = 100 * time.Millisecond
+
+	for i := 0; i < 3; i++ {
+		ips, err := c.LookupIP(ctx, "ip", "example.test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !sameIPs(ips, testRecords["example.test"]) {
+			t.Fatalf("got %v", ips)
+		}
+		if _, err = c.LookupIP(ctx, "ip", "missing.test"); !IsNotFound(err) {
+			t.Fatalf("expected not found error, got %v", err)
+		}
+	}
+	if n := cr.count(); n != 2 {
+		t.Fatalf("expected 2 lookups, got %d", n)
+	}
+
+	// different networks are cached separately
+	if _, err := c.LookupIP(ctx, "ip4", "example.test"); err != nil {
+		t.Fatal(err)
+	}
+	if n := cr.count(); n != 3 {
+		t.Fatalf("expected 3 lookups, got %d", n)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if _, err := c.LookupIP(ctx, "ip", "example.test"); err != nil {
+		t.Fatal(err)
+	}
+	if n := cr.count(); n != 4 {
+		t.Fatalf("expected expired entry to be looked up again, got %d lookups", n)
+	}
+
+	// transient errors are not cached
+	c.Purge()
+	cr.fail = errors.New("network unreachable")
+	for i := 0; i < 2; i++ {
+		if _, err := c.LookupIP(ctx, "ip", "example.test"); err != cr.fail {
+			t.Fatalf("expected transient error, got %v", err)
+		}
+	}
+	if n := cr.count(); n != 6 {
+		t.Fatalf("expected 6 lookups, got %d", n)
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+	f := newFakeDNS(t, testRecords, 0, false)
+	c := NewCache(&Upstream{Addr: f.addr(), Network: "tcp", Timeout: time.Second})
+	c.MaxTTL = 50 * time.Millisecond
+
+	// reported TTLs of 1s are capped to MaxTTL
+	for i := 0; i < 2; i++ {
+		if _, err := c.LookupIP(context.Background(), "ip4", "v4only.test"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, tcp := f.counts(); tcp != 1 {
+		t.Fatalf("expected 1 query, got %d", tcp)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, err := c.LookupIP(context.Background(), "ip4", "v4only.test"); err != nil {
+		t.Fatal(err)
+	}
+	if _, tcp := f.counts(); tcp != 2 {
+		t.Fatalf("expected 2 queries, got %d", tcp)
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	c := NewCache(Static(testRecords))
+	c.MaxEntries = 2
+	for _, host := range []string{"example.test", "v4only.test", "missing.test"} {
+		c.LookupIP(context.Background(), "ip", host)
+	}
+	if n := len(c.entries); n > 2 {
+		t.Fatalf("expected at most 2 entries, got %d", n)
+	}
+}
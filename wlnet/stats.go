@@ -0,0 +1,68 @@
+// Copyright (c) 2022 Wireleap
+
+package wlnet
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// Stats is the traffic accounting of a single spliced connection.
+type Stats struct {
+	// Up is the traffic copied from src to dst (client to remote for
+	// relays).
+	Up Direction
+	// Down is the traffic copied from dst to src (remote to client for
+	// relays).
+	Down Direction
+	// Start is the time the splice started.
+	Start time.Time
+	// Duration is the total duration of the splice.
+	Duration time.Duration
+}
+
+// Total returns the total number of bytes copied in both directions.
+func (s Stats) Total() int64 { return s.Up.Bytes + s.Down.Bytes }
+
+// Direction is the traffic accounting of one direction of a splice.
+type Direction struct {
+	// Bytes is the number of bytes copied.
+	Bytes int64
+	// Duration is the time from the start of the splice until the last
+	// byte was copied in this direction.
+	Duration time.Duration
+}
+
+// counter is an io.Writer which counts the bytes written through it into a
+// Direction.
+type counter struct {
+	io.Writer
+
+	start time.Time
+	d     *Direction
+}
+
+func (c counter) Write(p []byte) (n int, err error) {
+	n, err = c.Writer.Write(p)
+
+	if n > 0 {
+		c.d.add(n, c.start)
+	}
+
+	return
+}
+
+// add records n bytes copied in a splice started at start.
+func (d *Direction) add(n int, start time.Time) {
+	atomic.AddInt64(&d.Bytes, int64(n))
+	atomic.StoreInt64((*int64)(&d.Duration), int64(time.Since(start)))
+}
+
+// load returns a copy of d which is safe to use while d is still updated.
+func (d *Direction) load() Direction {
+	return Direction{
+		Bytes:    atomic.LoadInt64(&d.Bytes),
+		Duration: time.Duration(atomic.LoadInt64((*int64)(&d.Duration))),
+	}
+}
@@ -0,0 +1,273 @@
+// Copyright (c) 2022 Wireleap
+
+package transport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"sync"
+
+	"github.com/wireleap/common/api/interfaces/clientrelay"
+	"github.com/wireleap/common/api/relayentry"
+	"github.com/wireleap/common/api/sharetoken"
+	"github.com/wireleap/common/api/texturl"
+	"github.com/wireleap/common/wlnet"
+)
+
+// HopError is an error which occurred at a specific hop of a circuit.
+type HopError struct {
+	// Hop is the index of the failing hop in the circuit.
+	Hop int
+	// Relay is the relay at the failing hop.
+	Relay *relayentry.T
+	// Err is the underlying error, usually a *status.T from the relay.
+	Err error
+}
+
+func (e *HopError) Error() string {
+	return fmt.Sprintf("circuit hop %d (%s): %s", e.Hop, e.Relay, e.Err)
+}
+
+func (e *HopError) Unwrap() error { return e.Err }
+
+// hopConn is a connection to a single circuit hop which records the first
+// error encountered while using it.
+type hopConn struct {
+	net.Conn
+
+	mu  sync.Mutex
+	err error
+}
+
+func (c *hopConn) record(err error) {
+	if err == nil || errors.Is(err, io.EOF) {
+		return
+	}
+
+	c.mu.Lock()
+	if c.err == nil {
+		c.err = err
+	}
+	c.mu.Unlock()
+}
+
+func (c *hopConn) Read(p []byte) (n int, err error) {
+	n, err = c.Conn.Read(p)
+	c.record(err)
+	return
+}
+
+func (c *hopConn) Write(p []byte) (n int, err error) {
+	n, err = c.Conn.Write(p)
+	c.record(err)
+	return
+}
+
+func (c *hopConn) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// Circuit is a connection to a target tunneled through a circuit of relays.
+// Errors returned from its methods are *HopError pointing to the hop which
+// caused them.
+type Circuit struct {
+	net.Conn
+
+	hops  []*relayentry.T
+	conns []*hopConn
+	// err is the error which failed the setup of the circuit, if any.
+	err error
+
+	once sync.Once
+	done chan struct{}
+}
+
+// DialCircuit dials target using the given protocol through the relays in
+// hops, the first of which is dialed directly. Every hop is sent its own
+// init payload containing the sharetoken at the same index in tokens (which
+// can be empty if relays do not require sharetokens). The connection to
+// every following hop is tunneled through the previous one. If the transport
+// was created with PinPubkeys, the certificate of every hop must be for its
+// relay entry's public key. Cancelling ctx aborts the setup of the hops
+// and tears down the circuit if it is not closed yet. For UDP protocols, the circuit carries framed
+// datagrams and should be wrapped using wlnet.NewDatagramConn.
+func (t *T) DialCircuit(ctx context.Context, protocol string, hops []*relayentry.T, target *url.URL, tokens []*sharetoken.T) (*Circuit, error) {
+	c, err := t.dialCircuit(ctx, hops, tokens, &wlnet.Init{
+		Command:  "CONNECT",
+		Protocol: protocol,
+		Remote:   &texturl.URL{URL: *target},
+		Version:  &clientrelay.T.Version,
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Close()
+		case <-c.done:
+		}
+	}()
+
+	return c, nil
+}
+
+// dialCircuit dials a circuit through hops, sending last as the init payload
+// of the last hop. Cancelling ctx aborts the setup of the hops, but does not
+// tear down the circuit once set up.
+func (t *T) dialCircuit(ctx context.Context, hops []*relayentry.T, tokens []*sharetoken.T, last *wlnet.Init) (*Circuit, error) {
+	if len(hops) == 0 {
+		return nil, fmt.Errorf("cannot dial circuit without hops")
+	}
+
+	if len(tokens) != 0 && len(tokens) != len(hops) {
+		return nil, fmt.Errorf("expected %d sharetokens for circuit, got %d", len(hops), len(tokens))
+	}
+
+	c := &Circuit{hops: hops, done: make(chan struct{})}
+	circuitsActive.Inc()
+
+	// every hop is needed to dial the previous one, so all are checked
+	// before dialing anything
+	for i, hop := range hops {
+		if hop == nil || hop.Addr == nil {
+			c.err = &HopError{Hop: i, Relay: hop, Err: fmt.Errorf("relay address is missing")}
+			c.Close()
+			return nil, c.err
+		}
+	}
+
+	var prev net.Conn
+
+	for i, hop := range hops {
+		if err := ctx.Err(); err != nil {
+			c.Close()
+			return nil, err
+		}
+
+		p := &wlnet.Init{
+			Command:  "CONNECT",
+			Protocol: "tcp",
+			Version:  &clientrelay.T.Version,
+		}
+
+		if i < len(hops)-1 {
+			p.Remote = hops[i+1].Addr
+		} else {
+			lp := *last
+			p = &lp
+		}
+
+		if len(tokens) > 0 {
+			p.Token = tokens[i]
+		}
+
+		var (
+			hc  net.Conn
+			err error
+		)
+
+		if t.pin {
+			hc, err = t.DialWLPinnedContext(ctx, prev, "tcp", &hop.Addr.URL, p, hop.Pubkey.T())
+		} else {
+			hc, err = t.DialWLContext(ctx, prev, "tcp", &hop.Addr.URL, p)
+		}
+
+		if err != nil {
+			c.err = &HopError{Hop: i, Relay: hop, Err: err}
+			c.Close()
+			return nil, c.err
+		}
+
+		c.conns = append(c.conns, &hopConn{Conn: hc})
+		prev = c.conns[i]
+	}
+
+	c.Conn = prev
+	circuitsTotal.Inc()
+	return c, nil
+}
+
+// Hops returns the relays making up the circuit.
+func (c *Circuit) Hops() []*relayentry.T { return c.hops }
+
+// Read reads from the target connection.
+func (c *Circuit) Read(p []byte) (n int, err error) {
+	n, err = c.Conn.Read(p)
+	return n, c.wrap(err)
+}
+
+// Write writes to the target connection.
+func (c *Circuit) Write(p []byte) (n int, err error) {
+	n, err = c.Conn.Write(p)
+	return n, c.wrap(err)
+}
+
+// CloseWrite half-closes the connection to the target if supported by the
+// last hop connection.
+func (c *Circuit) CloseWrite() error {
+	cw, ok := c.conns[len(c.conns)-1].Conn.(wlnet.CloseWriter)
+
+	if !ok {
+		return fmt.Errorf("circuit does not support half-closing")
+	}
+
+	return c.wrap(cw.CloseWrite())
+}
+
+// Close tears down the circuit starting from the last hop.
+func (c *Circuit) Close() error {
+	c.once.Do(func() {
+		close(c.done)
+		circuitsActive.Dec()
+
+		// only the error of the first failing hop is counted, since it
+		// causes errors on all hops tunneled through it
+		err := c.err
+
+		for i := 0; err == nil && i < len(c.conns); i++ {
+			err = c.conns[i].Err()
+		}
+
+		if err != nil {
+			countHopError(err)
+		}
+
+		for i := len(c.conns) - 1; i >= 0; i-- {
+			c.conns[i].Close()
+		}
+	})
+
+	return nil
+}
+
+// wrap maps err to the hop which caused it. Since an error on a hop causes
+// errors on all hops tunneled through it, the first hop which encountered
+// an error is responsible.
+func (c *Circuit) wrap(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	// plain EOF so the circuit works with io.ReadAll and friends
+	if errors.Is(err, io.EOF) {
+		return io.EOF
+	}
+
+	for i, hc := range c.conns {
+		if herr := hc.Err(); herr != nil {
+			return &HopError{Hop: i, Relay: c.hops[i], Err: herr}
+		}
+	}
+
+	last := len(c.conns) - 1
+	return &HopError{Hop: last, Relay: c.hops[last], Err: err}
+}
@@ -0,0 +1,504 @@
+// Copyright (c) 2022 Wireleap
+
+package transport_test
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wireleap/common/api/jsonb"
+	"github.com/wireleap/common/api/relayentry"
+	"github.com/wireleap/common/api/status"
+	"github.com/wireleap/common/api/texturl"
+	"github.com/wireleap/common/api/tlscert"
+	"github.com/wireleap/common/wlnet"
+	"github.com/wireleap/common/wlnet/mux"
+	"github.com/wireleap/common/wlnet/relay"
+	"github.com/wireleap/common/wlnet/transport"
+)
+
+func startRelay(t *testing.T, tt *transport.T, origin string) *relayentry.T {
+	s := httptest.NewUnstartedServer(relay.New(tt, relay.Options{
+		BufSize:       2048,
+		ErrorOrigin:   origin,
+		AllowLoopback: true,
+	}))
+	s.EnableHTTP2 = true
+	s.StartTLS()
+	t.Cleanup(s.Close)
+	return &relayentry.T{
+		Role: origin,
+		Addr: texturl.URLMustParse(strings.Replace(s.URL, "https", "wireleap", 1)),
+	}
+}
+
+// startPinnedRelay starts a relay with a certificate for a new ed25519 key
+// like real relays use.
+func startPinnedRelay(t *testing.T, tt *transport.T, origin string) *relayentry.T {
+	pub, pk, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := tlscert.Certificate(pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := httptest.NewUnstartedServer(relay.New(tt, relay.Options{
+		BufSize:       2048,
+		ErrorOrigin:   origin,
+		AllowLoopback: true,
+	}))
+	s.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	s.EnableHTTP2 = true
+	s.StartTLS()
+	t.Cleanup(s.Close)
+	return &relayentry.T{
+		Role:   origin,
+		Addr:   texturl.URLMustParse(strings.Replace(s.URL, "https", "wireleap", 1)),
+		Pubkey: jsonb.PK(pub),
+	}
+}
+
+func startEcho(t *testing.T) *url.URL {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() { io.Copy(c, c); c.Close() }()
+		}
+	}()
+	return &url.URL{Scheme: "target", Host: l.Addr().String()}
+}
+
+func TestDialCircuit(t *testing.T) {
+	tt := transport.New(transport.Options{TLSVerify: false, Timeout: 5 * time.Second})
+	hops := []*relayentry.T{
+		startRelay(t, tt, "fronting"),
+		startRelay(t, tt, "backing"),
+	}
+	target := startEcho(t)
+
+	c, err := tt.DialCircuit(context.Background(), "tcp", hops, target, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p0 := []byte("hello circuit!")
+	if _, err = c.Write(p0); err != nil {
+		t.Fatal(err)
+	}
+	p1 := make([]byte, len(p0))
+	if _, err = io.ReadFull(c, p1); err != nil {
+		t.Fatal(err)
+	}
+	if string(p0) != string(p1) {
+		t.Fatalf("echo mismatch: sent %q, got %q", p0, p1)
+	}
+	c.Close()
+
+	// failing target
+	dead := &url.URL{Scheme: "target", Host: "127.0.0.1:1"}
+	c, err = tt.DialCircuit(context.Background(), "tcp", hops, dead, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write(p0)
+	_, err = c.Read(p1)
+
+	var (
+		herr *transport.HopError
+		st   *status.T
+	)
+	if !errors.As(err, &herr) || herr.Hop != 1 {
+		t.Fatalf("expected error from hop 1, got %v", err)
+	}
+	if !errors.As(err, &st) || st.Origin != "target" {
+		t.Fatalf("expected target status error, got %v", err)
+	}
+
+	// failing hop
+	broken := []*relayentry.T{hops[0], {Addr: texturl.URLMustParse("wireleap://127.0.0.1:1")}}
+	c, err = tt.DialCircuit(context.Background(), "tcp", broken, target, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write(p0)
+	_, err = c.Read(p1)
+	if !errors.As(err, &herr) || herr.Hop != 0 {
+		t.Fatalf("expected error from hop 0, got %v", err)
+	}
+	if !errors.As(err, &st) || st.Origin != "fronting" {
+		t.Fatalf("expected fronting status error, got %v", err)
+	}
+}
+
+func TestDialCircuitPinned(t *testing.T) {
+	// relays themselves do not pin to check that the client does
+	rt := transport.New(transport.Options{TLSVerify: false, Timeout: 5 * time.Second})
+	tt := transport.New(transport.Options{TLSVerify: true, PinPubkeys: true, Timeout: 5 * time.Second})
+	hops := []*relayentry.T{
+		startPinnedRelay(t, rt, "fronting"),
+		startPinnedRelay(t, rt, "backing"),
+	}
+	target := startEcho(t)
+
+	for i := 0; i < 2; i++ {
+		c, err := tt.DialCircuit(context.Background(), "tcp", hops, target, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = echo(c, []byte("hello pinned circuit!")); err != nil {
+			t.Fatal(err)
+		}
+		c.Close()
+	}
+
+	for i := range hops {
+		// swap in a different key for hop i
+		other, _, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bad := []*relayentry.T{hops[0], hops[1]}
+		h := *hops[i]
+		h.Pubkey = jsonb.PK(other)
+		bad[i] = &h
+
+		c, err := tt.DialCircuit(context.Background(), "tcp", bad, target, nil)
+		if err == nil {
+			err = echo(c, []byte("hello impostor!"))
+			c.Close()
+		}
+		var herr *transport.HopError
+		if !errors.As(err, &herr) || herr.Hop != i {
+			t.Fatalf("expected error from hop %d, got %v", i, err)
+		}
+		if !strings.Contains(err.Error(), tlscert.ErrPubkeyMismatch.Error()) {
+			t.Fatalf("expected pubkey mismatch error, got %v", err)
+		}
+	}
+
+	// hops without public keys cannot be pinned
+	nokey := []*relayentry.T{hops[0], {Addr: hops[1].Addr}}
+	c, err := tt.DialCircuit(context.Background(), "tcp", nokey, target, nil)
+	if err == nil {
+		c.Close()
+		t.Fatal("expected error dialing hop without public key")
+	}
+}
+
+// legacyRelay emulates a relay which does not support multiplexing.
+func legacyRelay(t *testing.T, tt *transport.T) *relayentry.T {
+	r := relay.New(tt, relay.Options{BufSize: 2048, ErrorOrigin: "backing", AllowLoopback: true})
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if p, err := wlnet.InitFromHeaders(req.Header); err == nil && p.Command == mux.Command {
+			(&status.T{Code: http.StatusBadRequest, Desc: "unknown command", Origin: "backing"}).ToHeader(w.Header())
+			return
+		}
+		r.ServeHTTP(w, req)
+	}))
+	s.EnableHTTP2 = true
+	s.StartTLS()
+	t.Cleanup(s.Close)
+	return &relayentry.T{
+		Role: "backing",
+		Addr: texturl.URLMustParse(strings.Replace(s.URL, "https", "wireleap", 1)),
+	}
+}
+
+func echo(c net.Conn, p0 []byte) error {
+	if _, err := c.Write(p0); err != nil {
+		return err
+	}
+	p1 := make([]byte, len(p0))
+	if _, err := io.ReadFull(c, p1); err != nil {
+		return err
+	}
+	if string(p0) != string(p1) {
+		return fmt.Errorf("echo mismatch: sent %q, got %q", p0, p1)
+	}
+	return nil
+}
+
+func TestMuxDialer(t *testing.T) {
+	tt := transport.New(transport.Options{TLSVerify: false, Timeout: 5 * time.Second})
+	target := startEcho(t)
+
+	d := tt.NewMuxDialer([]*relayentry.T{
+		startRelay(t, tt, "fronting"),
+		startRelay(t, tt, "backing"),
+	}, nil)
+	defer d.Close()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c, err := d.Dial(context.Background(), "tcp", target)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer c.Close()
+			if _, ok := c.(*mux.Stream); !ok {
+				errs <- fmt.Errorf("connection %d is not multiplexed", i)
+				return
+			}
+			errs <- echo(c, []byte(fmt.Sprintf("hello stream %d!", i)))
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// refused stream
+	_, err := d.Dial(context.Background(), "tcp", &url.URL{Scheme: "target", Host: "127.0.0.1:1"})
+	var (
+		herr *transport.HopError
+		st   *status.T
+	)
+	if !errors.As(err, &herr) || herr.Hop != 1 || !errors.As(err, &st) || st.Origin != "target" {
+		t.Fatalf("expected target error from hop 1, got %v", err)
+	}
+	if !d.Multiplexed() {
+		t.Fatal("dialer fell back after a refused stream")
+	}
+
+	// fallback to a circuit per connection
+	d2 := tt.NewMuxDialer([]*relayentry.T{
+		startRelay(t, tt, "fronting"),
+		legacyRelay(t, tt),
+	}, nil)
+	defer d2.Close()
+	for i := 0; i < 2; i++ {
+		c, err := d2.Dial(context.Background(), "tcp", target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := c.(*transport.Circuit); !ok {
+			t.Fatal("expected fallback to circuit")
+		}
+		if err = echo(c, []byte("hello fallback!")); err != nil {
+			t.Fatal(err)
+		}
+		c.Close()
+	}
+	if d2.Multiplexed() {
+		t.Fatal("dialer did not fall back")
+	}
+}
+
+func TestCircuitCloseWrite(t *testing.T) {
+	tt := transport.New(transport.Options{TLSVerify: false, Timeout: 5 * time.Second})
+	s := httptest.NewUnstartedServer(relay.New(tt, relay.Options{
+		BufSize:          2048,
+		AllowLoopback:    true,
+		HalfCloseTimeout: time.Second,
+	}))
+	s.EnableHTTP2 = true
+	s.StartTLS()
+	defer s.Close()
+
+	// target responding only after the request is complete
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		req, _ := io.ReadAll(c)
+		c.Write(append([]byte("got "), req...))
+		c.Close()
+	}()
+
+	hops := []*relayentry.T{{Addr: texturl.URLMustParse(strings.Replace(s.URL, "https", "wireleap", 1))}}
+	c, err := tt.DialCircuit(context.Background(), "tcp", hops, &url.URL{Scheme: "target", Host: l.Addr().String()}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, err = c.Write([]byte("request")); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	res, err := io.ReadAll(c)
+	if err != nil || string(res) != "got request" {
+		t.Fatalf("unexpected response %q, %v", res, err)
+	}
+}
+
+func TestDialCircuitCancel(t *testing.T) {
+	tt := transport.New(transport.Options{TLSVerify: false, Timeout: 5 * time.Second})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	dialed := make(chan struct{}, 1)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			dialed <- struct{}{}
+			defer c.Close()
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	hops := []*relayentry.T{{Addr: texturl.URLMustParse("wireleap://" + l.Addr().String())}}
+	if _, err = tt.DialCircuit(ctx, "tcp", hops, startEcho(t), nil); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected cancelled circuit setup, got %v", err)
+	}
+	select {
+	case <-dialed:
+		t.Fatal("hop was dialed despite cancellation")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// the h/2 handshake with a stalled relay is aborted
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	c, err := tt.DialWLContext(ctx, nil, "tcp", &hops[0].Addr.URL, &wlnet.Init{Command: "PING"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	start := time.Now()
+	if _, err = c.Read(make([]byte, 1)); err == nil || time.Since(start) > 2*time.Second {
+		t.Fatalf("expected aborted handshake, got %v after %s", err, time.Since(start))
+	}
+}
+
+func TestDialCircuitMissingHop(t *testing.T) {
+	tt := transport.New(transport.Options{TLSVerify: false, Timeout: 5 * time.Second})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	dialed := make(chan struct{}, 1)
+	go func() {
+		if c, err := l.Accept(); err == nil {
+			dialed <- struct{}{}
+			c.Close()
+		}
+	}()
+
+	first := &relayentry.T{Addr: texturl.URLMustParse("wireleap://" + l.Addr().String())}
+	for _, hops := range [][]*relayentry.T{{first, nil}, {first, {}}} {
+		_, err = tt.DialCircuit(context.Background(), "tcp", hops, startEcho(t), nil)
+		var herr *transport.HopError
+		if !errors.As(err, &herr) || herr.Hop != 1 {
+			t.Fatalf("expected error from hop 1, got %v", err)
+		}
+	}
+	select {
+	case <-dialed:
+		t.Fatal("first hop was dialed despite missing next hop")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestMuxDialerRetry(t *testing.T) {
+	tt := transport.New(transport.Options{TLSVerify: false, Timeout: 5 * time.Second})
+	target := startEcho(t)
+
+	// relay failing its first mux session
+	r := relay.New(tt, relay.Options{BufSize: 2048, ErrorOrigin: "backing", AllowLoopback: true})
+	var once sync.Once
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		failed := false
+		once.Do(func() {
+			(&status.T{Code: http.StatusServiceUnavailable, Desc: "overloaded", Origin: "backing"}).ToHeader(w.Header())
+			failed = true
+		})
+		if !failed {
+			r.ServeHTTP(w, req)
+		}
+	}))
+	s.EnableHTTP2 = true
+	s.StartTLS()
+	defer s.Close()
+	d := tt.NewMuxDialer([]*relayentry.T{{Addr: texturl.URLMustParse(strings.Replace(s.URL, "https", "wireleap", 1))}}, nil)
+	defer d.Close()
+	if _, err := d.Dial(context.Background(), "tcp", target); err == nil {
+		t.Fatal("expected failed session")
+	}
+	if !d.Multiplexed() {
+		t.Fatal("dialer fell back after a transient session failure")
+	}
+	c, err := d.Dial(context.Background(), "tcp", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, ok := c.(*mux.Stream); !ok {
+		t.Fatal("expected multiplexing to be retried")
+	}
+	if err = echo(c, []byte("hello again!")); err != nil {
+		t.Fatal(err)
+	}
+
+	// stalled relay
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+	d2 := tt.NewMuxDialer([]*relayentry.T{{Addr: texturl.URLMustParse("wireleap://" + l.Addr().String())}}, nil)
+	defer d2.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err = d2.Dial(ctx, "tcp", target); err == nil || time.Since(start) > 2*time.Second {
+		t.Fatalf("expected dial to be aborted by its context, got %v after %s", err, time.Since(start))
+	}
+	if !d2.Multiplexed() {
+		t.Fatal("dialer fell back after an aborted session")
+	}
+}
@@ -0,0 +1,39 @@
+// Copyright (c) 2022 Wireleap
+
+package transport
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/wireleap/common/api/status"
+	"github.com/wireleap/common/metrics"
+)
+
+var (
+	circuitsActive = metrics.Default.Gauge(
+		"wireleap_transport_circuits_active",
+		"Number of currently open circuits.",
+	)
+	circuitsTotal = metrics.Default.Counter(
+		"wireleap_transport_circuits_total",
+		"Total number of circuits dialed.",
+	)
+	hopErrors = metrics.Default.Counter(
+		"wireleap_transport_hop_errors_total",
+		"Total number of circuits failed at a hop by status code and origin.",
+		"code", "origin",
+	)
+)
+
+// countHopError counts err in hopErrors. Errors which are not statuses are
+// counted with code 0 and origin "local".
+func countHopError(err error) {
+	var st *status.T
+
+	if errors.As(err, &st) {
+		hopErrors.Inc(strconv.Itoa(st.Code), st.Origin)
+	} else {
+		hopErrors.Inc("0", "local")
+	}
+}
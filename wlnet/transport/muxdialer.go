@@ -0,0 +1,202 @@
+// Copyright (c) 2022 Wireleap
+
+package transport
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/wireleap/common/api/interfaces/clientrelay"
+	"github.com/wireleap/common/api/relayentry"
+	"github.com/wireleap/common/api/sharetoken"
+	"github.com/wireleap/common/api/status"
+	"github.com/wireleap/common/api/texturl"
+	"github.com/wireleap/common/wlnet"
+	"github.com/wireleap/common/wlnet/mux"
+)
+
+// MuxDialer dials target connections as streams of a single multiplexed
+// session over one circuit, so that opening a connection does not require a
+// new h/2 stream and init payload per hop. If the last hop does not support
+// multiplexing, it falls back to dialing a circuit per connection.
+// Sessions which fail otherwise are dialed again on the next Dial.
+type MuxDialer struct {
+	// T is the transport used to dial circuits.
+	T *T
+	// Hops are the relays of the circuit.
+	Hops []*relayentry.T
+	// Tokens are the sharetokens for the hops, as in DialCircuit.
+	Tokens []*sharetoken.T
+	// Options are the options of the mux session.
+	Options mux.Options
+
+	mu sync.Mutex
+	m  *mux.T
+	// dialing is closed when the session dial in progress, if any, is done.
+	dialing  chan struct{}
+	fallback bool
+}
+
+// NewMuxDialer creates a new MuxDialer for the given circuit.
+func (t *T) NewMuxDialer(hops []*relayentry.T, tokens []*sharetoken.T) *MuxDialer {
+	return &MuxDialer{T: t, Hops: hops, Tokens: tokens}
+}
+
+// Multiplexed returns false if the dialer has fallen back to dialing a
+// circuit per connection.
+func (d *MuxDialer) Multiplexed() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return !d.fallback
+}
+
+// session returns the current mux session, dialing a new one if needed.
+// Only one session is dialed at a time; concurrent callers wait for it
+// unless ctx is done first. Cancelling ctx aborts the setup of the session
+// circuit, but once set up, the session is not affected by ctx.
+func (d *MuxDialer) session(ctx context.Context) (*mux.T, error) {
+	d.mu.Lock()
+
+	for {
+		if d.m != nil {
+			select {
+			case <-d.m.Done():
+				d.m = nil
+			default:
+				m := d.m
+				d.mu.Unlock()
+				return m, nil
+			}
+		}
+
+		if d.dialing == nil {
+			break
+		}
+
+		dialing := d.dialing
+		d.mu.Unlock()
+
+		select {
+		case <-dialing:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		d.mu.Lock()
+	}
+
+	dialing := make(chan struct{})
+	d.dialing = dialing
+	d.mu.Unlock()
+
+	c, err := d.T.dialCircuit(ctx, d.Hops, d.Tokens, &wlnet.Init{
+		Command:  mux.Command,
+		Protocol: "tcp",
+		Version:  &clientrelay.T.Version,
+	})
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.dialing = nil
+	close(dialing)
+
+	if err != nil {
+		return nil, err
+	}
+
+	d.m = mux.New(c, d.Options)
+	return d.m, nil
+}
+
+// rejected returns whether the session error err is the last hop refusing
+// the mux command because it does not know it.
+func (d *MuxDialer) rejected(err error) bool {
+	var (
+		herr *HopError
+		st   *status.T
+	)
+
+	return errors.As(err, &herr) && herr.Hop == len(d.Hops)-1 &&
+		errors.As(err, &st) && st.Code == http.StatusBadRequest &&
+		strings.Contains(st.Desc, "unknown command")
+}
+
+// Dial dials target using the given protocol. The returned connection is a
+// *mux.Stream, or a *Circuit if multiplexing is not supported.
+func (d *MuxDialer) Dial(ctx context.Context, protocol string, target *url.URL) (net.Conn, error) {
+	d.mu.Lock()
+	fallback := d.fallback
+	d.mu.Unlock()
+
+	if fallback {
+		return d.T.DialCircuit(ctx, protocol, d.Hops, target, d.Tokens)
+	}
+
+	m, err := d.session(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := m.Open(ctx, &wlnet.Init{
+		Command:  "CONNECT",
+		Protocol: protocol,
+		Remote:   &texturl.URL{URL: *target},
+		Version:  &clientrelay.T.Version,
+	})
+
+	if err == nil {
+		return s, nil
+	}
+
+	select {
+	case <-m.Done():
+		// the session itself failed; it is dialed again next time unless
+		// the last hop does not support multiplexing
+		d.mu.Lock()
+		if d.m == m {
+			d.m = nil
+		}
+		if d.rejected(m.Err()) {
+			d.fallback = true
+		}
+		fallback = d.fallback
+		d.mu.Unlock()
+
+		if fallback {
+			return d.T.DialCircuit(ctx, protocol, d.Hops, target, d.Tokens)
+		}
+
+		return nil, err
+	default:
+	}
+
+	// the stream was refused by the last hop
+	var st *status.T
+
+	if errors.As(err, &st) {
+		last := len(d.Hops) - 1
+		return nil, &HopError{Hop: last, Relay: d.Hops[last], Err: err}
+	}
+
+	return nil, err
+}
+
+// Close closes the mux session and all of its streams.
+func (d *MuxDialer) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.m != nil {
+		d.m.Close()
+		d.m = nil
+	}
+
+	return nil
+}
@@ -3,21 +3,52 @@
 package transport
 
 import (
+	"container/list"
 	"context"
+	"crypto/ed25519"
 	"crypto/tls"
 	"fmt"
 	"net"
 	"net/http"
 	"net/url"
+	"sync"
 	"time"
 
+	"github.com/wireleap/common/api/tlscert"
 	"github.com/wireleap/common/wlnet"
 	"github.com/wireleap/common/wlnet/h2conn"
+	"github.com/wireleap/common/wlnet/resolver"
 )
 
+// DefaultMaxPinned is the default maximum number of relays for which a T
+// keeps a transport with a pinned certificate.
+const DefaultMaxPinned = 256
+
 // T is a complete Wireleap network transport which can dial to other
 // wireleap-relays via H/2 over TCP and targets via TCP or UDP.
-type T struct{ *http.Transport }
+type T struct {
+	*http.Transport
+
+	// resolver is the resolver used for target hostnames, if any.
+	resolver resolver.Resolver
+	// pin enables pinning relay certificates to relay public keys.
+	pin bool
+	// nd is the dialer used for new connections.
+	nd *net.Dialer
+
+	// maxPinned is the maximum number of pinned transports kept.
+	maxPinned int
+
+	mu     sync.Mutex
+	pinned map[string]*list.Element
+	ll     *list.List
+}
+
+// pinnedEntry is an element of T.ll.
+type pinnedEntry struct {
+	key string
+	tt  *http.Transport
+}
 
 // Options is a struct which contains options for initializing a T.
 type Options struct {
@@ -27,6 +58,17 @@ type Options struct {
 	Certs []tls.Certificate
 	// Timeout is the maximum time for new connections
 	Timeout time.Duration
+	// Resolver is used to resolve target hostnames instead of the host
+	// resolver if set
+	Resolver resolver.Resolver
+	// PinPubkeys makes circuits verify that the certificate of every relay
+	// is for the relay's ed25519 public key instead of relying on TLSVerify
+	PinPubkeys bool
+	// MaxPinned is the maximum number of relays for which connections with
+	// pinned certificates are pooled. When it is reached, the pool of the
+	// least recently dialed relay is dropped and its idle connections are
+	// closed. If zero, DefaultMaxPinned is used.
+	MaxPinned int
 }
 
 // New creates a default T with the supplied options.
@@ -52,36 +94,153 @@ func New(opts Options) *T {
 				MaxIdleConns:          4096,
 				IdleConnTimeout:       5 * time.Minute,
 			},
+			resolver:  opts.Resolver,
+			pin:       opts.PinPubkeys,
+			nd:        nd,
+			maxPinned: opts.MaxPinned,
+			pinned:    map[string]*list.Element{},
+			ll:        list.New(),
 		}
 	)
+	if t.maxPinned <= 0 {
+		t.maxPinned = DefaultMaxPinned
+	}
+	if opts.Resolver != nil {
+		t.Transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return resolveDial(ctx, nd, opts.Resolver, network, addr)
+		}
+	}
 	return t
 }
 
+// LookupIP resolves host using the configured resolver or the host resolver
+// if none is configured.
+func (t *T) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	if t.resolver == nil {
+		return net.DefaultResolver.LookupIP(ctx, network, host)
+	}
+	return t.resolver.LookupIP(ctx, network, host)
+}
+
+// resolveDial dials addr with nd after resolving its host with r, trying
+// every resolved address in order until one succeeds.
+func resolveDial(ctx context.Context, nd *net.Dialer, r resolver.Resolver, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		return nd.DialContext(ctx, network, addr)
+	}
+	ipnet := "ip"
+	switch network {
+	case "tcp4", "udp4":
+		ipnet = "ip4"
+	case "tcp6", "udp6":
+		ipnet = "ip6"
+	}
+	ips, err := r.LookupIP(ctx, ipnet, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, resolver.NotFound(host)
+	}
+	for _, ip := range ips {
+		var c net.Conn
+		if c, err = nd.DialContext(ctx, network, net.JoinHostPort(ip.String(), port)); err == nil {
+			return c, nil
+		}
+	}
+	return nil, err
+}
+
 // DialWL creates a new connection to relay or target.
 func (t *T) DialWL(c0 net.Conn, protocol string, remote *url.URL, payload *wlnet.Init) (c net.Conn, err error) {
+	return t.dialWL(context.Background(), c0, protocol, remote, payload, nil)
+}
+
+// DialWLContext is like DialWL, but the connection setup (including the h/2
+// handshake with a relay) is aborted if ctx is done before it completes.
+// Once established, the connection is not affected by ctx.
+func (t *T) DialWLContext(ctx context.Context, c0 net.Conn, protocol string, remote *url.URL, payload *wlnet.Init) (c net.Conn, err error) {
+	return t.dialWL(ctx, c0, protocol, remote, payload, nil)
+}
+
+// DialWLPinned is like DialWL, but if remote is a relay, its TLS certificate
+// is only accepted if it is for the ed25519 public key pubkey, regardless of
+// TLSVerify.
+func (t *T) DialWLPinned(c0 net.Conn, protocol string, remote *url.URL, payload *wlnet.Init, pubkey ed25519.PublicKey) (c net.Conn, err error) {
+	return t.DialWLPinnedContext(context.Background(), c0, protocol, remote, payload, pubkey)
+}
+
+// DialWLPinnedContext is like DialWLPinned, but the connection setup is
+// aborted if ctx is done before it completes, as in DialWLContext.
+func (t *T) DialWLPinnedContext(ctx context.Context, c0 net.Conn, protocol string, remote *url.URL, payload *wlnet.Init, pubkey ed25519.PublicKey) (c net.Conn, err error) {
+	if len(pubkey) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid public key for relay %s", remote)
+	}
+	return t.dialWL(ctx, c0, protocol, remote, payload, pubkey)
+}
+
+// pinnedTransport returns the transport used for direct connections to the
+// relay with the public key pubkey, creating it if needed so that connections
+// to the same relay can be reused. The transport of the least recently used
+// relay is dropped if there are too many.
+func (t *T) pinnedTransport(pubkey ed25519.PublicKey) *http.Transport {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if e, ok := t.pinned[string(pubkey)]; ok {
+		t.ll.MoveToFront(e)
+		return e.Value.(*pinnedEntry).tt
+	}
+	if t.ll.Len() >= t.maxPinned {
+		e := t.ll.Back()
+		t.ll.Remove(e)
+		pe := e.Value.(*pinnedEntry)
+		delete(t.pinned, pe.key)
+		// connections still in use are closed by IdleConnTimeout once done
+		pe.tt.CloseIdleConnections()
+	}
+	tc := t.Transport.TLSClientConfig.Clone()
+	// chains and hostnames are meaningless for self-signed relay certs
+	tc.InsecureSkipVerify = true
+	tc.VerifyPeerCertificate = tlscert.VerifyPubkey(pubkey)
+	tt := t.Transport.Clone()
+	tt.TLSClientConfig = tc
+	tt.DialTLSContext = (&tls.Dialer{NetDialer: t.nd, Config: tc}).DialContext
+	t.pinned[string(pubkey)] = t.ll.PushFront(&pinnedEntry{key: string(pubkey), tt: tt})
+	return tt
+}
+
+func (t *T) dialWL(ctx context.Context, c0 net.Conn, protocol string, remote *url.URL, payload *wlnet.Init, pubkey ed25519.PublicKey) (c net.Conn, err error) {
 	switch remote.Scheme {
 	case "target":
 		// NOTE: this code path is only used by relays
 		// client never dials target directly
 		// c0/payload unused, could both be nil
-		c, err = t.Transport.DialContext(context.TODO(), protocol, remote.Host)
+		c, err = t.Transport.DialContext(ctx, protocol, remote.Host)
 	case "wireleap":
 		tt := t.Transport
+		if pubkey != nil {
+			tt = t.pinnedTransport(pubkey)
+		}
 		if c0 != nil {
 			// if previous connection supplied, use it to tunnel
-			tt = t.Transport.Clone()
+			tc := tt.TLSClientConfig
+			tt = tt.Clone()
 			tt.DialContext = func(ctx context.Context, network, host string) (net.Conn, error) {
 				return c0, nil
 			}
 			tt.DialTLSContext = func(ctx context.Context, network, host string) (net.Conn, error) {
-				return tls.Client(c0, t.Transport.TLSClientConfig), nil
+				return tls.Client(c0, tc), nil
 			}
 		}
 		// convert to a stdlib-known scheme
 		u2 := *remote
 		u2.Scheme = "https"
 		// payload used for headers
-		c, err = h2conn.New(tt, u2.String(), payload.Headers())
+		c, err = h2conn.NewContext(ctx, tt, u2.String(), payload.Headers())
 	default:
 		err = fmt.Errorf("unsupported dial scheme '%s' in %s", remote.Scheme, remote)
 	}
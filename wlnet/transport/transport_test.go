@@ -3,10 +3,22 @@
 package transport
 
 import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/tls"
+	"io"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"testing"
 	"time"
+
+	"github.com/wireleap/common/api/relayentry"
+	"github.com/wireleap/common/api/texturl"
+	"github.com/wireleap/common/api/tlscert"
+	"github.com/wireleap/common/wlnet/resolver"
 )
 
 func TestWLTransport(t *testing.T) {
@@ -57,3 +69,123 @@ func TestWLTransport(t *testing.T) {
 		})
 	}
 }
+
+func TestResolver(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err == nil {
+			c.Write([]byte("ok"))
+			c.Close()
+		}
+	}()
+
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	tt := New(Options{
+		Timeout: time.Second,
+		Resolver: resolver.Static{
+			"target.test": {net.ParseIP("127.0.0.1")},
+		},
+	})
+	u, err := url.Parse("target://target.test:" + port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := tt.DialWL(nil, "tcp", u, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	b, err := io.ReadAll(c)
+	if err != nil || string(b) != "ok" {
+		t.Fatalf("unexpected read: %q, %v", b, err)
+	}
+
+	u.Host = "missing.test:" + port
+	if _, err = tt.DialWL(nil, "tcp", u, nil); !resolver.IsNotFound(err) {
+		t.Fatalf("expected not found error, got %v", err)
+	}
+	ips, err := tt.LookupIP(context.Background(), "ip", "target.test")
+	if err != nil || len(ips) != 1 {
+		t.Fatalf("unexpected lookup result: %v, %v", ips, err)
+	}
+}
+
+func TestHopErrorsCounted(t *testing.T) {
+	tt := New(Options{Timeout: time.Second})
+	hops := []*relayentry.T{
+		{Addr: texturl.URLMustParse("wireleap://127.0.0.1:1")},
+		{Addr: texturl.URLMustParse("invalid://127.0.0.1:1")},
+	}
+	target := &url.URL{Scheme: "target", Host: "127.0.0.1:1"}
+	for i, hs := range [][]*relayentry.T{hops, {hops[0], {}}} {
+		n := hopErrors.Value("0", "local")
+		if _, err := tt.DialCircuit(context.Background(), "tcp", hs, target, nil); err == nil {
+			t.Fatalf("%d: expected circuit setup to fail", i)
+		}
+		if d := hopErrors.Value("0", "local") - n; d != 1 {
+			t.Fatalf("%d: expected failed hop to be counted once, got %v", i, d)
+		}
+	}
+}
+
+func TestPinnedTransportEviction(t *testing.T) {
+	tt := New(Options{PinPubkeys: true, MaxPinned: 2})
+	pk := func(b byte) ed25519.PublicKey { return bytes.Repeat([]byte{b}, ed25519.PublicKeySize) }
+	t1, t2 := tt.pinnedTransport(pk(1)), tt.pinnedTransport(pk(2))
+	if tt.pinnedTransport(pk(1)) != t1 {
+		t.Fatal("pinned transport was not reused")
+	}
+	// 2 is the least recently used
+	tt.pinnedTransport(pk(3))
+	if n := len(tt.pinned); n != 2 || tt.ll.Len() != 2 {
+		t.Fatalf("expected 2 pinned transports, got %d", n)
+	}
+	if tt.pinnedTransport(pk(1)) != t1 {
+		t.Fatal("recently used pinned transport was evicted")
+	}
+	if tt.pinnedTransport(pk(2)) == t2 {
+		t.Fatal("least recently used pinned transport was not evicted")
+	}
+
+	// idle connections of evicted transports are closed
+	pub, sk, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := tlscert.Certificate(sk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := make(chan struct{})
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	s.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	s.Config.ConnState = func(c net.Conn, cs http.ConnState) {
+		if cs == http.StateClosed {
+			close(closed)
+		}
+	}
+	s.EnableHTTP2 = true
+	s.StartTLS()
+	defer s.Close()
+	req, err := http.NewRequest(http.MethodGet, s.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := tt.pinnedTransport(pub).RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	tt.pinnedTransport(pk(4))
+	tt.pinnedTransport(pk(5))
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("idle connection of evicted transport was not closed")
+	}
+}